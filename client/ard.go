@@ -0,0 +1,105 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// ardCredentialSize is the size of the username and of the password in
+// the credentials block, their terminating null byte included.
+const ardCredentialSize = 64
+
+// ardMaxKeyLength bounds the size of the prime modulus sent by the server.
+const ardMaxKeyLength = 1024
+
+// ARDAuth is the Apple Remote Desktop authentication, security type 30,
+// required by the Screen Sharing of macOS. The client and the server
+// agree on a key with Diffie-Hellman, and the client sends its Username
+// and Password encrypted with AES-128 with the MD5 of the key.
+//
+// Username and Password are truncated to 63 bytes.
+type ARDAuth struct {
+	Username string
+	Password string
+}
+
+func (*ARDAuth) SecurityType() uint8 {
+	return 30
+}
+
+func (auth *ARDAuth) Handshake(c io.ReadWriteCloser) error {
+	// [generator uint16][key length uint16][prime modulus][server public key]
+	var params struct {
+		Generator uint16
+		KeyLength uint16
+	}
+	if err := binary.Read(c, binary.BigEndian, &params); err != nil {
+		return err
+	}
+	if params.KeyLength == 0 || params.KeyLength > ardMaxKeyLength {
+		return fmt.Errorf("invalid ARD key length %d", params.KeyLength)
+	}
+	keys := make([]byte, 2*int(params.KeyLength))
+	if _, err := io.ReadFull(c, keys); err != nil {
+		return err
+	}
+	prime := new(big.Int).SetBytes(keys[:params.KeyLength])
+	serverPublic := new(big.Int).SetBytes(keys[params.KeyLength:])
+
+	// public keys must be in [2, prime-2], else the shared key is trivial
+	upper := new(big.Int).Sub(prime, big.NewInt(2))
+	if upper.Cmp(big.NewInt(2)) < 0 {
+		return errors.New("invalid ARD prime modulus")
+	}
+	if serverPublic.Cmp(big.NewInt(2)) < 0 || serverPublic.Cmp(upper) > 0 {
+		return errors.New("invalid ARD server public key")
+	}
+
+	private, err := rand.Int(rand.Reader, new(big.Int).Sub(upper, big.NewInt(1)))
+	if err != nil {
+		return err
+	}
+	private.Add(private, big.NewInt(2))
+	public := new(big.Int).Exp(big.NewInt(int64(params.Generator)), private, prime)
+	shared := new(big.Int).Exp(serverPublic, private, prime)
+
+	key := md5.Sum(shared.FillBytes(make([]byte, params.KeyLength)))
+	credentials, err := auth.credentials()
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+	// AES-128 in ECB mode
+	for i := 0; i < len(credentials); i += aes.BlockSize {
+		block.Encrypt(credentials[i:], credentials[i:])
+	}
+
+	// [encrypted credentials][client public key]
+	reply := append(credentials, public.FillBytes(make([]byte, params.KeyLength))...)
+	_, err = c.Write(reply)
+	return err
+}
+
+// credentials returns the null terminated Username and Password, each
+// padded to ardCredentialSize with random bytes.
+func (auth *ARDAuth) credentials() ([]byte, error) {
+	credentials := make([]byte, 2*ardCredentialSize)
+	if _, err := rand.Read(credentials); err != nil {
+		return nil, err
+	}
+	for i, s := range []string{auth.Username, auth.Password} {
+		field := credentials[i*ardCredentialSize : (i+1)*ardCredentialSize]
+		n := copy(field[:ardCredentialSize-1], s)
+		field[n] = 0
+	}
+	return credentials, nil
+}
@@ -0,0 +1,129 @@
+package client
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/md5"
+	"crypto/rand"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+)
+
+// ardPrime is the 1024-bit MODP group of RFC 2409.
+var ardPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381"+
+		"FFFFFFFFFFFFFFFF", 16)
+
+// fakeARDServer is the server side of the ARD handshake. It returns the
+// username and password sent by the client.
+func fakeARDServer(c net.Conn, serverPublic *big.Int) (string, string, error) {
+	const keyLength = 128
+	private, err := rand.Int(rand.Reader, ardPrime)
+	if err != nil {
+		return "", "", err
+	}
+	if serverPublic == nil {
+		serverPublic = new(big.Int).Exp(big.NewInt(2), private, ardPrime)
+	}
+	params := []byte{0, 2, 0, keyLength}
+	params = append(params, ardPrime.FillBytes(make([]byte, keyLength))...)
+	params = append(params, serverPublic.FillBytes(make([]byte, keyLength))...)
+	if _, err := c.Write(params); err != nil {
+		return "", "", err
+	}
+
+	reply := make([]byte, 2*ardCredentialSize+keyLength)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return "", "", err
+	}
+	clientPublic := new(big.Int).SetBytes(reply[2*ardCredentialSize:])
+	shared := new(big.Int).Exp(clientPublic, private, ardPrime)
+	key := md5.Sum(shared.FillBytes(make([]byte, keyLength)))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return "", "", err
+	}
+	credentials := reply[:2*ardCredentialSize]
+	for i := 0; i < len(credentials); i += aes.BlockSize {
+		block.Decrypt(credentials[i:], credentials[i:])
+	}
+	field := func(b []byte) string {
+		return string(b[:bytes.IndexByte(b, 0)])
+	}
+	return field(credentials[:ardCredentialSize]), field(credentials[ardCredentialSize:]), nil
+}
+
+func TestARDAuth_Handshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	type result struct {
+		username, password string
+		err                error
+	}
+	done := make(chan result, 1)
+	go func() {
+		username, password, err := fakeARDServer(server, nil)
+		done <- result{username, password, err}
+	}()
+
+	auth := &ARDAuth{Username: "alice", Password: "correct horse battery staple"}
+	if err := auth.Handshake(client); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("fake server failed: %s", res.err)
+	}
+	if res.username != auth.Username || res.password != auth.Password {
+		t.Fatalf("unexpected credentials %q/%q", res.username, res.password)
+	}
+}
+
+func TestARDAuth_TruncatesCredentials(t *testing.T) {
+	auth := &ARDAuth{Username: string(bytes.Repeat([]byte("u"), 100)), Password: "p"}
+	credentials, err := auth.credentials()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(credentials) != 2*ardCredentialSize {
+		t.Fatalf("expected %d bytes, got %d", 2*ardCredentialSize, len(credentials))
+	}
+	if credentials[ardCredentialSize-1] != 0 {
+		t.Fatal("expected the username to be null terminated")
+	}
+	if got := credentials[ardCredentialSize : ardCredentialSize+2]; !bytes.Equal(got, []byte{'p', 0}) {
+		t.Fatalf("unexpected password field %q", got)
+	}
+}
+
+func TestARDAuth_RejectsTrivialServerKey(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go fakeARDServer(server, big.NewInt(1))
+
+	err := (&ARDAuth{Username: "alice", Password: "secret"}).Handshake(client)
+	if err == nil || err.Error() != "invalid ARD server public key" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestARDAuth_Impl(t *testing.T) {
+	var raw interface{}
+	raw = new(ARDAuth)
+	if _, ok := raw.(ClientAuth); !ok {
+		t.Fatal("ARDAuth doesn't implement ClientAuth")
+	}
+	if raw.(ClientAuth).SecurityType() != 30 {
+		t.Fatal("expected security type 30")
+	}
+}
@@ -51,12 +51,20 @@ type ClientConn struct {
 	// Name associated with the desktop, sent from the server.
 	DesktopName string
 
+	// MinorVersion is the minor version of the RFB 3.x protocol
+	// negotiated with the server: 3, 7 or 8.
+	MinorVersion uint
+
 	// The pixel format associated with the connection. This shouldn't
 	// be modified. If you wish to set a new pixel format, use the
 	// SetPixelFormat method.
 	PixelFormat common.PixelFormat
 
 	Listeners *common.MultiListener
+
+	// Interceptors can inspect, rewrite or drop the parsed server
+	// messages before their bytes reach the Listeners
+	Interceptors *common.ServerInterceptorChain
 }
 
 // A ClientConfig structure is used to configure a ClientConn. After
@@ -79,10 +87,11 @@ type ClientConfig struct {
 
 func NewClientConn(c net.Conn, cfg *ClientConfig, encodings ...common.IEncoding) (*ClientConn, error) {
 	conn := &ClientConn{
-		conn:      c,
-		config:    cfg,
-		Listeners: &common.MultiListener{},
-		Encs:      encodings,
+		conn:         c,
+		config:       cfg,
+		Listeners:    &common.MultiListener{},
+		Interceptors: &common.ServerInterceptorChain{},
+		Encs:         encodings,
 	}
 	return conn, nil
 }
@@ -336,6 +345,24 @@ func parseProtocolVersion(pv []byte) (uint, uint, error) {
 	return major, minor, nil
 }
 
+// negotiateVersion returns the minor version the client speaks, given
+// the version of the server. Servers announcing 3.4 to 3.6 are spoken to
+// with 3.3, as the protocol says of the versions it does not define.
+func negotiateVersion(major, minor uint) (uint, error) {
+	if major < 3 {
+		return 0, fmt.Errorf("unsupported major version, less than 3: %d", major)
+	}
+	switch {
+	case major > 3 || minor >= 8:
+		return 8, nil
+	case minor == 7:
+		return 7, nil
+	case minor >= 3:
+		return 3, nil
+	}
+	return 0, fmt.Errorf("unsupported minor version, less than 3: %d", minor)
+}
+
 func (c *ClientConn) handshake() error {
 	var protocolVersion [pvLen]byte
 
@@ -348,71 +375,45 @@ func (c *ClientConn) handshake() error {
 	if err != nil {
 		return err
 	}
-	if maxMajor < 3 {
-		return fmt.Errorf("unsupported major version, less than 3: %d", maxMajor)
-	}
-	if maxMinor < 8 {
-		return fmt.Errorf("unsupported minor version, less than 8: %d", maxMinor)
+	if c.MinorVersion, err = negotiateVersion(maxMajor, maxMinor); err != nil {
+		return err
 	}
 
 	// Respond with the version we will support
-	if _, err = c.conn.Write([]byte("RFB 003.008\n")); err != nil {
+	if _, err = fmt.Fprintf(c.conn, "RFB 003.%03d\n", c.MinorVersion); err != nil {
 		return err
 	}
 
 	// 7.1.2 Security Handshake from server
-	var numSecurityTypes uint8
-	if err = binary.Read(c.conn, binary.BigEndian, &numSecurityTypes); err != nil {
-		return fmt.Errorf("error reading security types: %v", err)
-	}
-
-	if numSecurityTypes == 0 {
-		return fmt.Errorf("error: no security types: %s", c.readErrorReason())
-	}
-
-	securityTypes := make([]uint8, numSecurityTypes)
-	if err = binary.Read(c.conn, binary.BigEndian, &securityTypes); err != nil {
+	auth, err := c.securityType()
+	if err != nil {
 		return err
 	}
 
-	clientSecurityTypes := c.config.Auth
-	if clientSecurityTypes == nil {
-		clientSecurityTypes = []ClientAuth{new(ClientAuthNone)}
-	}
-
-	var auth ClientAuth
-FindAuth:
-	for _, curAuth := range clientSecurityTypes {
-		for _, securityType := range securityTypes {
-			if curAuth.SecurityType() == securityType {
-				// We use the first matching supported authentication
-				auth = curAuth
-				break FindAuth
-			}
+	if upgrader, ok := auth.(TransportAuth); ok {
+		conn, err := upgrader.HandshakeTransport(c.conn)
+		if err != nil {
+			return err
 		}
-	}
-
-	if auth == nil {
-		return fmt.Errorf("no suitable auth schemes found. server supported: %#v", securityTypes)
-	}
-
-	// Respond back with the security type we'll use
-	if err = binary.Write(c.conn, binary.BigEndian, auth.SecurityType()); err != nil {
-		return err
-	}
-
-	if err = auth.Handshake(c.conn); err != nil {
+		c.conn = conn
+	} else if err = auth.Handshake(c.conn); err != nil {
 		return err
 	}
 
-	// 7.1.3 SecurityResult Handshake
-	var securityResult uint32
-	if err = binary.Read(c.conn, binary.BigEndian, &securityResult); err != nil {
-		return err
-	}
+	// 7.1.3 SecurityResult Handshake, which versions 3.3 and 3.7 skip for
+	// the None security type, and send without a reason
+	if c.MinorVersion >= 8 || auth.SecurityType() != 1 {
+		var securityResult uint32
+		if err = binary.Read(c.conn, binary.BigEndian, &securityResult); err != nil {
+			return err
+		}
 
-	if securityResult == 1 {
-		return fmt.Errorf("security handshake failed: %s", c.readErrorReason())
+		if securityResult == 1 {
+			if c.MinorVersion < 8 {
+				return errors.New("security handshake failed")
+			}
+			return fmt.Errorf("security handshake failed: %s", c.readErrorReason())
+		}
 	}
 
 	// 7.3.1 ClientInit
@@ -449,7 +450,6 @@ FindAuth:
 		return err
 	}
 
-	c.DesktopName = string(nameBytes)
 	srvInit := common.ServerInit{
 		NameLength:  nameLength,
 		NameText:    nameBytes,
@@ -457,6 +457,12 @@ FindAuth:
 		FBWidth:     c.FrameBufferWidth,
 		PixelFormat: c.PixelFormat,
 	}
+	if err = c.Interceptors.InterceptServerInit(&srvInit); err != nil {
+		return fmt.Errorf("server init interceptor error: %v", err)
+	}
+	srvInit.NameLength = uint32(len(srvInit.NameText))
+	c.DesktopName = string(srvInit.NameText)
+
 	rfbSeg := &common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &srvInit}
 
 	return c.Listeners.Consume(rfbSeg)
@@ -517,14 +523,160 @@ func (c *ClientConn) mainLoop(ctx context.Context, logger *zap.Logger) {
 				return
 			}
 
+			// with interceptors, hold the message back until they had a look at it
+			var held *heldSegments
+			if c.Interceptors.Len() > 0 {
+				held = &heldSegments{}
+				reader.Listeners = &common.MultiListener{}
+				reader.Listeners.AddListener(held)
+			}
+
 			reader.SendMessageStart(common.ServerMessageType(messageType))
 			reader.PublishBytes([]byte{byte(messageType)})
-			if _, err := msg.Read(c, reader); err != nil {
+			parsedMsg, err := msg.Read(c, reader)
+			if err != nil {
 				logger.Error("error parsing message", zap.Error(err))
 				return
 			}
+
+			if held != nil {
+				reader.Listeners = c.Listeners
+				if parsedMsg, err = c.releaseIntercepted(parsedMsg, held); err != nil {
+					logger.Error("error intercepting message", zap.Error(err))
+					return
+				}
+				if parsedMsg == nil {
+					continue
+				}
+			}
+
+			c.Listeners.Consume(&common.RfbSegment{
+				SegmentType: common.SegmentFullyParsedServerMessage,
+				Message:     parsedMsg,
+			})
+		}
+	}
+}
+
+// heldSegments keeps the segments of a server message while it is parsed.
+type heldSegments struct {
+	segments []*common.RfbSegment
+}
+
+func (h *heldSegments) Consume(seg *common.RfbSegment) error {
+	if seg.SegmentType == common.SegmentBytes {
+		// the reader may reuse its buffers
+		seg = &common.RfbSegment{SegmentType: seg.SegmentType, Bytes: append([]byte(nil), seg.Bytes...)}
+	}
+	h.segments = append(h.segments, seg)
+	return nil
+}
+
+// bytes returns the bytes of the held message, as read.
+func (h *heldSegments) bytes() []byte {
+	var buf bytes.Buffer
+	for _, seg := range h.segments {
+		if seg.SegmentType == common.SegmentBytes {
+			buf.Write(seg.Bytes)
+		}
+	}
+	return buf.Bytes()
+}
+
+// releaseIntercepted runs a held message through the interceptors, and
+// passes whatever they return on to the listeners: the original
+// segments, the serialized replacement message, or nothing. Interceptors
+// may edit the message in place, so the original segments are only
+// passed on when the message returned still serializes to them.
+func (c *ClientConn) releaseIntercepted(msg common.ServerMessage, held *heldSegments) (common.ServerMessage, error) {
+	out, err := c.Interceptors.Intercept(msg)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	if err := out.Write(&buf); err != nil {
+		return nil, fmt.Errorf("failed to serialize %s: %v", out, err)
+	}
+	segs := held.segments
+	if !bytes.Equal(buf.Bytes(), held.bytes()) {
+		segs = []*common.RfbSegment{
+			{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.ServerMessageType(out.Type()))},
+			{SegmentType: common.SegmentBytes, Bytes: buf.Bytes()},
+			{SegmentType: common.SegmentMessageEnd, UpcomingObjectType: int(common.ServerMessageType(out.Type()))},
+		}
+	}
+	for _, seg := range segs {
+		if err := c.Listeners.Consume(seg); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// securityType picks the security type of the connection. With version
+// 3.3, the server decides it alone, else the client picks one of the
+// types offered by the server.
+func (c *ClientConn) securityType() (ClientAuth, error) {
+	clientSecurityTypes := c.config.Auth
+	if clientSecurityTypes == nil {
+		clientSecurityTypes = []ClientAuth{new(ClientAuthNone)}
+	}
+
+	if c.MinorVersion == 3 {
+		var securityType uint32
+		if err := binary.Read(c.conn, binary.BigEndian, &securityType); err != nil {
+			return nil, fmt.Errorf("error reading security type: %v", err)
+		}
+		if securityType == 0 {
+			return nil, fmt.Errorf("error: no security types: %s", c.readErrorReason())
+		}
+		for _, curAuth := range clientSecurityTypes {
+			if uint32(curAuth.SecurityType()) == securityType {
+				return curAuth, nil
+			}
+		}
+		return nil, fmt.Errorf("no suitable auth schemes found. server requires: %d", securityType)
+	}
+
+	var numSecurityTypes uint8
+	if err := binary.Read(c.conn, binary.BigEndian, &numSecurityTypes); err != nil {
+		return nil, fmt.Errorf("error reading security types: %v", err)
+	}
+
+	if numSecurityTypes == 0 {
+		return nil, fmt.Errorf("error: no security types: %s", c.readErrorReason())
+	}
+
+	securityTypes := make([]uint8, numSecurityTypes)
+	if err := binary.Read(c.conn, binary.BigEndian, &securityTypes); err != nil {
+		return nil, err
+	}
+
+	var auth ClientAuth
+FindAuth:
+	for _, curAuth := range clientSecurityTypes {
+		for _, securityType := range securityTypes {
+			if curAuth.SecurityType() == securityType {
+				// We use the first matching supported authentication
+				auth = curAuth
+				break FindAuth
+			}
 		}
 	}
+
+	if auth == nil {
+		return nil, fmt.Errorf("no suitable auth schemes found. server supported: %#v", securityTypes)
+	}
+
+	// Respond back with the security type we'll use
+	if err := binary.Write(c.conn, binary.BigEndian, auth.SecurityType()); err != nil {
+		return nil, err
+	}
+	return auth, nil
 }
 
 func (c *ClientConn) readErrorReason() string {
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/borderzero/vncproxy/common"
+	"go.uber.org/zap"
+)
+
+// segmentBytes collects the bytes of the segments passed to listeners,
+// until the connection is closed.
+type segmentBytes struct {
+	bytes.Buffer
+	closed chan struct{}
+	// rects are the encodings of the rectangle separators
+	rects []int
+}
+
+func (s *segmentBytes) Consume(seg *common.RfbSegment) error {
+	switch seg.SegmentType {
+	case common.SegmentBytes:
+		s.Write(seg.Bytes)
+	case common.SegmentRectSeparator:
+		s.rects = append(s.rects, seg.UpcomingObjectType)
+	case common.SegmentConnectionClosed:
+		close(s.closed)
+	}
+	return nil
+}
+
+// relay runs the main loop of a connection with the given interceptor
+// on the messages sent by the server, and returns the bytes passed to
+// its listeners.
+func relay(t *testing.T, interceptor common.ServerMessageInterceptor, msgs ...[]byte) []byte {
+	return run(t, interceptor, msgs...).Bytes()
+}
+
+// run runs the main loop of a connection on the messages sent by the
+// server, with the interceptor if not nil, and returns its listener.
+func run(t *testing.T, interceptor common.ServerMessageInterceptor, msgs ...[]byte) *segmentBytes {
+	server, c := net.Pipe()
+	conn, err := NewClientConn(c, &ClientConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.PixelFormat = common.PixelFormat{BPP: 32, Depth: 24, TrueColor: 1, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8}
+	if interceptor != nil {
+		conn.Interceptors.AddInterceptor(interceptor)
+	}
+	listener := &segmentBytes{closed: make(chan struct{})}
+	conn.Listeners.AddListener(listener)
+	go conn.mainLoop(context.Background(), zap.NewNop())
+
+	for _, msg := range msgs {
+		if _, err := server.Write(msg); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	server.Close()
+	<-listener.closed
+	return listener
+}
+
+func serialize(t *testing.T, msgs ...common.ServerMessage) []byte {
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		if err := msg.Write(&buf); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// framebufferUpdate returns a framebuffer update of raw 1x1 rectangles
+// on the first row, of the given pixels.
+func framebufferUpdate(pixels ...[]byte) []byte {
+	msg := binary.BigEndian.AppendUint16([]byte{0, 0}, uint16(len(pixels)))
+	for x, pixel := range pixels {
+		for _, v := range []uint16{uint16(x), 0, 1, 1, 0, 0} {
+			msg = binary.BigEndian.AppendUint16(msg, v)
+		}
+		msg = append(msg, pixel...)
+	}
+	return msg
+}
+
+func TestMainLoop_Interceptors(t *testing.T) {
+	cutText := serialize(t, &MsgServerCutText{Text: "password"})
+	bell := serialize(t, new(MsgBell))
+	update := framebufferUpdate([]byte{1, 2, 3, 0}, []byte{4, 5, 6, 0})
+
+	tests := []struct {
+		name        string
+		interceptor common.ServerMessageInterceptorFunc
+		msgs        [][]byte
+		want        []byte
+	}{
+		{
+			name:        "unchanged",
+			interceptor: func(msg common.ServerMessage) (common.ServerMessage, error) { return msg, nil },
+			msgs:        [][]byte{cutText, update, bell},
+			want:        bytes.Join([][]byte{cutText, update, bell}, nil),
+		},
+		{
+			name: "edited in place",
+			interceptor: func(msg common.ServerMessage) (common.ServerMessage, error) {
+				switch m := msg.(type) {
+				case *MsgServerCutText:
+					m.Text = "********"
+				case *MsgFramebufferUpdate:
+					m.Rectangles = m.Rectangles[:1]
+				}
+				return msg, nil
+			},
+			msgs: [][]byte{cutText, update, bell},
+			want: bytes.Join([][]byte{serialize(t, &MsgServerCutText{Text: "********"}), framebufferUpdate([]byte{1, 2, 3, 0}), bell}, nil),
+		},
+		{
+			name: "replaced and dropped",
+			interceptor: func(msg common.ServerMessage) (common.ServerMessage, error) {
+				if _, ok := msg.(*MsgBell); ok {
+					return nil, nil
+				}
+				return &MsgServerCutText{Text: "replaced"}, nil
+			},
+			msgs: [][]byte{cutText, bell},
+			want: serialize(t, &MsgServerCutText{Text: "replaced"}),
+		},
+	}
+
+	for _, tt := range tests {
+		if got := relay(t, tt.interceptor, tt.msgs...); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestMainLoop_RectSeparators(t *testing.T) {
+	update := framebufferUpdate([]byte{1, 2, 3, 0}, []byte{4, 5, 6, 0})
+	listener := run(t, nil, update)
+	if !bytes.Equal(listener.Bytes(), update) {
+		t.Fatalf("expected %v, got %v", update, listener.Bytes())
+	}
+	// each rectangle is announced with its encoding
+	if len(listener.rects) != 2 || listener.rects[0] != int(common.EncRaw) || listener.rects[1] != int(common.EncRaw) {
+		t.Fatalf("unexpected rectangle separators %v", listener.rects)
+	}
+}
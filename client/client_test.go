@@ -1,7 +1,9 @@
 package client
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"testing"
 )
@@ -46,7 +48,7 @@ func newMockServer(t *testing.T, version string) string {
 // }
 
 // func TestClient_LowMinorVersion(t *testing.T) {
-// 	nc, err := net.Dial("tcp", newMockServer(t, "003.007"))
+// 	nc, err := net.Dial("tcp", newMockServer(t, "003.002"))
 // 	if err != nil {
 // 		t.Fatalf("error connecting to mock server: %s", err)
 // 	}
@@ -56,7 +58,7 @@ func newMockServer(t *testing.T, version string) string {
 // 		t.Fatal("error expected")
 // 	}
 
-// 	if err.Error() != "unsupported minor version, less than 8: 7" {
+// 	if err.Error() != "unsupported minor version, less than 3: 2" {
 // 		t.Fatalf("unexpected error: %s", err)
 // 	}
 // }
@@ -93,3 +95,173 @@ func TestParseProtocolVersion(t *testing.T) {
 		}
 	}
 }
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		major, minor uint
+		want         uint
+		isErr        bool
+	}{
+		{3, 8, 8, false},
+		{3, 889, 8, false}, // OS X
+		{4, 0, 8, false},
+		{3, 7, 7, false},
+		{3, 3, 3, false},
+		{3, 5, 3, false}, // Apple Remote Desktop 3.5
+		{3, 6, 3, false},
+		{3, 2, 0, true},
+		{2, 9, 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := negotiateVersion(tt.major, tt.minor)
+		if (err != nil) != tt.isErr {
+			t.Fatalf("negotiateVersion(%d, %d) unexpected error %v", tt.major, tt.minor, err)
+		}
+		if got != tt.want {
+			t.Errorf("negotiateVersion(%d, %d) = %d, want %d", tt.major, tt.minor, got, tt.want)
+		}
+	}
+}
+
+// legacyServer plays the server side of the handshake of a given
+// protocol version, up to the ServerInit message.
+type legacyServer struct {
+	version string
+	// security is written after the version is agreed on
+	security []byte
+	// choose makes the server read the security type picked by the client
+	choose bool
+	// vncAuth makes the server run the VNC authentication
+	vncAuth bool
+	// result, if set, is written as the SecurityResult
+	result []byte
+
+	// reply is the version the client answered with
+	reply string
+}
+
+func (s *legacyServer) serve(c net.Conn) error {
+	if _, err := io.WriteString(c, s.version); err != nil {
+		return err
+	}
+	reply := make([]byte, pvLen)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	s.reply = string(reply)
+	if _, err := c.Write(s.security); err != nil {
+		return err
+	}
+	if s.choose {
+		if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+			return err
+		}
+	}
+	if s.vncAuth {
+		if _, err := c.Write(make([]byte, 16)); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, make([]byte, 16)); err != nil {
+			return err
+		}
+	}
+	if s.result != nil {
+		if _, err := c.Write(s.result); err != nil {
+			return err
+		}
+		if !bytes.Equal(s.result, []byte{0, 0, 0, 0}) {
+			return nil
+		}
+	}
+
+	// ClientInit
+	if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+		return err
+	}
+	// ServerInit: 4x2, 32 bits per pixel, named "legacy"
+	serverInit := []byte{0, 4, 0, 2, 32, 24, 0, 1, 0, 255, 0, 255, 0, 255, 16, 8, 0, 0, 0, 0, 0, 0, 0, 6}
+	_, err := c.Write(append(serverInit, "legacy"...))
+	return err
+}
+
+func legacyHandshake(t *testing.T, s *legacyServer, auth ...ClientAuth) (*ClientConn, error) {
+	nc, sc := net.Pipe()
+	t.Cleanup(func() {
+		nc.Close()
+		sc.Close()
+	})
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(sc)
+	}()
+
+	cc, _ := NewClientConn(nc, &ClientConfig{Auth: auth})
+	if err := cc.handshake(); err != nil {
+		return nil, err
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("fake server failed: %s", err)
+	}
+	return cc, nil
+}
+
+func TestClient_Handshake33None(t *testing.T) {
+	cc, err := legacyHandshake(t, &legacyServer{version: "RFB 003.003\n", security: []byte{0, 0, 0, 1}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cc.MinorVersion != 3 || cc.DesktopName != "legacy" || cc.FrameBufferWidth != 4 {
+		t.Fatalf("unexpected connection: version 3.%d, %dx%d %q", cc.MinorVersion, cc.FrameBufferWidth, cc.FrameBufferHeight, cc.DesktopName)
+	}
+}
+
+func TestClient_Handshake33VNC(t *testing.T) {
+	s := &legacyServer{version: "RFB 003.005\n", security: []byte{0, 0, 0, 2}, vncAuth: true, result: []byte{0, 0, 0, 0}}
+	cc, err := legacyHandshake(t, s, &PasswordAuth{Password: "secret"}, &ClientAuthNone{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cc.MinorVersion != 3 || s.reply != "RFB 003.003\n" {
+		t.Fatalf("expected version 3.3, got 3.%d, answered %q", cc.MinorVersion, s.reply)
+	}
+}
+
+func TestClient_Handshake33Failure(t *testing.T) {
+	s := &legacyServer{version: "RFB 003.003\n", security: []byte{0, 0, 0, 2}, vncAuth: true, result: []byte{0, 0, 0, 1}}
+	_, err := legacyHandshake(t, s, &PasswordAuth{Password: "wrong"})
+	if err == nil || err.Error() != "security handshake failed" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClient_Handshake33Refused(t *testing.T) {
+	s := &legacyServer{version: "RFB 003.003\n", security: append([]byte{0, 0, 0, 0, 0, 0, 0, 4}, "busy"...)}
+	_, err := legacyHandshake(t, s)
+	if err == nil || err.Error() != "error: no security types: busy" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClient_Handshake37None(t *testing.T) {
+	s := &legacyServer{version: "RFB 003.007\n", security: []byte{2, 2, 1}, choose: true}
+	cc, err := legacyHandshake(t, s, &ClientAuthNone{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cc.MinorVersion != 7 || s.reply != "RFB 003.007\n" {
+		t.Fatalf("expected version 3.7, got 3.%d, answered %q", cc.MinorVersion, s.reply)
+	}
+}
+
+func TestClient_Handshake38None(t *testing.T) {
+	s := &legacyServer{version: "RFB 003.008\n", security: []byte{1, 1}, choose: true, result: []byte{0, 0, 0, 0}}
+	cc, err := legacyHandshake(t, s, &ClientAuthNone{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cc.MinorVersion != 8 {
+		t.Fatalf("expected version 3.8, got 3.%d", cc.MinorVersion)
+	}
+}
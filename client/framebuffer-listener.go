@@ -0,0 +1,71 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/encodings"
+)
+
+// FramebufferListener keeps an in-memory copy of the remote desktop of
+// a ClientConn, by decoding the framebuffer updates it receives.
+type FramebufferListener struct {
+	conn common.IClientConn
+
+	mu  sync.Mutex
+	fb  *encodings.Framebuffer
+	err error
+}
+
+// NewFramebufferListener returns a listener decoding the updates of conn.
+// It must be added to the listeners of conn before it connects, so it
+// sees the ServerInit message and every update.
+func NewFramebufferListener(conn common.IClientConn) *FramebufferListener {
+	return &FramebufferListener{conn: conn}
+}
+
+// Framebuffer returns the decoded framebuffer, or nil before the
+// ServerInit message was received.
+func (l *FramebufferListener) Framebuffer() *encodings.Framebuffer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fb
+}
+
+// Err returns the error that stopped decoding, if any. Once an update
+// fails to decode, the zlib streams are out of sync, so later updates
+// are ignored.
+func (l *FramebufferListener) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *FramebufferListener) Consume(seg *common.RfbSegment) error {
+	switch seg.SegmentType {
+	case common.SegmentServerInitMessage:
+		l.mu.Lock()
+		l.fb = encodings.NewFramebufferFromServerInit(seg.Message.(*common.ServerInit))
+		l.err = nil
+		l.mu.Unlock()
+
+	case common.SegmentFullyParsedServerMessage:
+		fb := l.Framebuffer()
+		if fb == nil || l.Err() != nil {
+			return nil
+		}
+		switch msg := seg.Message.(type) {
+		case *MsgFramebufferUpdate:
+			fb.SetPixelFormat(l.conn.CurrentPixelFormat())
+			if err := fb.Update(msg.Rectangles); err != nil {
+				l.mu.Lock()
+				l.err = err
+				l.mu.Unlock()
+			}
+		case *MsgSetColorMapEntries:
+			fb.SetColorMapEntries(msg.FirstColor, msg.Colors)
+		}
+	}
+	// decoding errors must not break the connection the listener watches
+	return nil
+}
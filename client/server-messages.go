@@ -1,6 +1,7 @@
 package client
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -67,7 +68,6 @@ func (fbm *MsgFramebufferUpdate) Read(c common.IClientConn, r *common.RfbReadHel
 	for i := uint16(0); i < numRects; i++ {
 
 		var encodingTypeInt int32
-		r.SendRectSeparator(-1)
 		rect := &rects[i]
 		data := []interface{}{
 			&rect.X,
@@ -83,6 +83,9 @@ func (fbm *MsgFramebufferUpdate) Read(c common.IClientConn, r *common.RfbReadHel
 			}
 		}
 
+		// the separator tells the listeners the encoding of the rectangle,
+		// such as the recorder, which cannot drop stateful ones
+		r.SendRectSeparator(int(encodingTypeInt))
 		encType := common.EncodingType(encodingTypeInt)
 
 		enc, supported := encMap[encodingTypeInt]
@@ -96,8 +99,9 @@ func (fbm *MsgFramebufferUpdate) Read(c common.IClientConn, r *common.RfbReadHel
 			if strings.Contains(encType.String(), "Pseudo") {
 				rect.Enc = &encodings.PseudoEncoding{Typ: encodingTypeInt}
 
-				//if this is the last rect, break the for loop
+				//if this is the last rect, drop the unused ones and break the for loop
 				if rect.Enc.Type() == int32(common.EncLastRectPseudo) {
+					rects = rects[:i+1]
 					break
 				}
 			} else {
@@ -110,6 +114,48 @@ func (fbm *MsgFramebufferUpdate) Read(c common.IClientConn, r *common.RfbReadHel
 	return &MsgFramebufferUpdate{rects}, nil
 }
 
+func (fbm *MsgFramebufferUpdate) Write(w io.Writer) error {
+	var buf bytes.Buffer
+
+	numRects := uint16(len(fbm.Rectangles))
+	if numRects > 0 && fbm.Rectangles[numRects-1].Enc.Type() == int32(common.EncLastRectPseudo) {
+		// keep the "terminated by LastRect" form the server used
+		numRects = 0xFFFF
+	}
+	data := []interface{}{
+		fbm.Type(),
+		uint8(0), // padding
+		numRects,
+	}
+	for _, val := range data {
+		if err := binary.Write(&buf, binary.BigEndian, val); err != nil {
+			return err
+		}
+	}
+
+	for i := range fbm.Rectangles {
+		rect := &fbm.Rectangles[i]
+		data := []interface{}{
+			rect.X,
+			rect.Y,
+			rect.Width,
+			rect.Height,
+			rect.Enc.Type(),
+		}
+		for _, val := range data {
+			if err := binary.Write(&buf, binary.BigEndian, val); err != nil {
+				return err
+			}
+		}
+		if _, err := rect.Enc.WriteTo(&buf); err != nil {
+			return fmt.Errorf("MsgFramebufferUpdate.Write: failed to write rect %s: %v", rect, err)
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
 // MsgSetColorMapEntries is sent by the server to set values into
 // the color map. This message will automatically update the color map
 // for the associated connection, but contains the color change data
@@ -178,6 +224,28 @@ func (m *MsgSetColorMapEntries) Read(c common.IClientConn, r *common.RfbReadHelp
 	return &result, nil
 }
 
+func (m *MsgSetColorMapEntries) Write(w io.Writer) error {
+	var buf bytes.Buffer
+
+	data := []interface{}{
+		m.Type(),
+		uint8(0), // padding
+		m.FirstColor,
+		uint16(len(m.Colors)),
+	}
+	for _, color := range m.Colors {
+		data = append(data, color.R, color.G, color.B)
+	}
+	for _, val := range data {
+		if err := binary.Write(&buf, binary.BigEndian, val); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
 // Bell signals that an audible bell should be made on the client.
 //
 // See RFC 6143 Section 7.6.3
@@ -199,7 +267,16 @@ func (m *MsgBell) Read(c common.IClientConn, r *common.RfbReadHelper) (common.Se
 	return new(MsgBell), nil
 }
 
-type MsgServerFence byte
+func (m *MsgBell) Write(w io.Writer) error {
+	_, err := w.Write([]byte{m.Type()})
+	return err
+}
+
+// MsgServerFence is a fence request or response from the server.
+type MsgServerFence struct {
+	Flags   uint32
+	Payload []byte
+}
 
 func (fbm *MsgServerFence) CopyTo(r io.Reader, w io.Writer, c common.IClientConn) error {
 	return nil
@@ -213,27 +290,47 @@ func (*MsgServerFence) Type() uint8 {
 }
 
 func (sf *MsgServerFence) Read(info common.IClientConn, c *common.RfbReadHelper) (common.ServerMessage, error) {
-	bytes := make([]byte, 3)
-	c.Read(bytes)
-	if _, err := c.Read(bytes); err != nil {
+	// Read off the padding
+	var padding [3]byte
+	if _, err := io.ReadFull(c, padding[:]); err != nil {
 		return nil, err
 	}
-	var flags uint32
-	if err := binary.Read(c, binary.BigEndian, &flags); err != nil {
+
+	var result MsgServerFence
+	if err := binary.Read(c, binary.BigEndian, &result.Flags); err != nil {
 		return nil, err
 	}
 
-	var length uint8
-	if err := binary.Read(c, binary.BigEndian, &length); err != nil {
+	length, err := c.ReadUint8()
+	if err != nil {
 		return nil, err
 	}
 
-	bytes = make([]byte, length)
-	if _, err := c.Read(bytes); err != nil {
+	if result.Payload, err = c.ReadBytes(int(length)); err != nil {
 		return nil, err
 	}
 	c.SendMessageEnd(common.ServerMessageType(sf.Type()))
-	return sf, nil
+	return &result, nil
+}
+
+func (sf *MsgServerFence) Write(w io.Writer) error {
+	var buf bytes.Buffer
+
+	data := []interface{}{
+		sf.Type(),
+		[3]byte{}, // padding
+		sf.Flags,
+		uint8(len(sf.Payload)),
+		sf.Payload,
+	}
+	for _, val := range data {
+		if err := binary.Write(&buf, binary.BigEndian, val); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
 // MsgServerCutText indicates the server has new text in the cut buffer.
@@ -244,7 +341,7 @@ type MsgServerCutText struct {
 }
 
 func (fbm *MsgServerCutText) CopyTo(r io.Reader, w io.Writer, c common.IClientConn) error {
-	reader := &common.RfbReadHelper{Reader: r}
+	reader := common.NewRfbReadHelper(r)
 	writeTo := &WriteTo{w, "MsgServerCutText.CopyTo"}
 	reader.Listeners.AddListener(writeTo)
 	_, err := fbm.Read(c, reader)
@@ -277,3 +374,22 @@ func (m *MsgServerCutText) Read(conn common.IClientConn, r *common.RfbReadHelper
 	r.SendMessageEnd(common.ServerMessageType(m.Type()))
 	return &MsgServerCutText{string(textBytes)}, nil
 }
+
+func (m *MsgServerCutText) Write(w io.Writer) error {
+	var buf bytes.Buffer
+
+	data := []interface{}{
+		m.Type(),
+		[3]byte{}, // padding
+		uint32(len(m.Text)),
+		[]byte(m.Text),
+	}
+	for _, val := range data {
+		if err := binary.Write(&buf, binary.BigEndian, val); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
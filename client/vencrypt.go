@@ -0,0 +1,190 @@
+package client
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// VeNCrypt subtypes, version 0.2.
+const (
+	VeNCryptPlain     uint32 = 256
+	VeNCryptTLSNone   uint32 = 257
+	VeNCryptTLSVNC    uint32 = 258
+	VeNCryptTLSPlain  uint32 = 259
+	VeNCryptX509None  uint32 = 260
+	VeNCryptX509VNC   uint32 = 261
+	VeNCryptX509Plain uint32 = 262
+)
+
+// TransportAuth is a ClientAuth which replaces the transport of the
+// connection during its handshake, e.g. to continue it over TLS.
+type TransportAuth interface {
+	ClientAuth
+
+	// HandshakeTransport performs the authentication handshake over c,
+	// and returns the transport the connection continues over.
+	HandshakeTransport(c io.ReadWriteCloser) (io.ReadWriteCloser, error)
+}
+
+// VeNCryptAuth is the VeNCrypt authentication, version 0.2: the
+// connection is upgraded to TLS, and the client then authenticates over
+// it with the subtype picked, with Username and Password (Plain), with
+// the Password of the VNC authentication (VNC), or not at all (None).
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#vencrypt
+//
+// The X509 subtypes verify the certificate of the server with
+// TLSConfig. The TLS subtypes do not verify it, as they are meant for
+// anonymous TLS; crypto/tls does not implement the anonymous
+// Diffie-Hellman cipher suites though, so they only work with servers
+// presenting a certificate. As anyone in the middle could then read the
+// credentials, the TLS subtypes are only accepted if TLSConfig skips the
+// verification of the certificate, or if SubTypes lists them.
+type VeNCryptAuth struct {
+	// TLSConfig configures the TLS client: its root CAs, client
+	// certificates and server name.
+	TLSConfig *tls.Config
+
+	Username string
+	Password string
+
+	// SubTypes are the subtypes the client accepts, in order of
+	// preference. If empty, the X509 subtypes are accepted, and the TLS
+	// ones after them if TLSConfig.InsecureSkipVerify is set, Plain being
+	// preferred over VNC over None, and only used if Username is set.
+	SubTypes []uint32
+}
+
+func (*VeNCryptAuth) SecurityType() uint8 {
+	return 19
+}
+
+// Handshake fails, as VeNCrypt replaces the transport of the connection
+// with HandshakeTransport.
+func (*VeNCryptAuth) Handshake(io.ReadWriteCloser) error {
+	return errors.New("VeNCrypt upgrades the transport, use HandshakeTransport")
+}
+
+func (auth *VeNCryptAuth) subTypes() []uint32 {
+	if len(auth.SubTypes) > 0 {
+		return auth.SubTypes
+	}
+	var subTypes []uint32
+	if auth.Username != "" {
+		subTypes = append(subTypes, VeNCryptX509Plain)
+	}
+	subTypes = append(subTypes, VeNCryptX509VNC, VeNCryptX509None)
+	if auth.TLSConfig == nil || !auth.TLSConfig.InsecureSkipVerify {
+		return subTypes
+	}
+	if auth.Username != "" {
+		subTypes = append(subTypes, VeNCryptTLSPlain)
+	}
+	return append(subTypes, VeNCryptTLSVNC, VeNCryptTLSNone)
+}
+
+func (auth *VeNCryptAuth) HandshakeTransport(c io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	nc, ok := c.(net.Conn)
+	if !ok {
+		return nil, errors.New("VeNCrypt requires a network connection")
+	}
+
+	// version
+	var version [2]uint8
+	if _, err := io.ReadFull(c, version[:]); err != nil {
+		return nil, err
+	}
+	if version[0] != 0 || version[1] < 2 {
+		return nil, fmt.Errorf("unsupported VeNCrypt version %d.%d", version[0], version[1])
+	}
+	if _, err := c.Write([]byte{0, 2}); err != nil {
+		return nil, err
+	}
+	var ack [1]uint8
+	if _, err := io.ReadFull(c, ack[:]); err != nil {
+		return nil, err
+	}
+	if ack[0] != 0 {
+		return nil, errors.New("server refused VeNCrypt version 0.2")
+	}
+
+	// subtype
+	var count uint8
+	if err := binary.Read(c, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, errors.New("server offered no VeNCrypt subtype")
+	}
+	offered := make([]uint32, count)
+	if err := binary.Read(c, binary.BigEndian, offered); err != nil {
+		return nil, err
+	}
+	subType, ok := pickSubType(auth.subTypes(), offered)
+	if !ok {
+		return nil, fmt.Errorf("no suitable VeNCrypt subtype found. server supported: %v", offered)
+	}
+	if err := binary.Write(c, binary.BigEndian, subType); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, ack[:]); err != nil {
+		return nil, err
+	}
+	if ack[0] != 1 {
+		return nil, fmt.Errorf("server refused VeNCrypt subtype %d", subType)
+	}
+
+	cfg := &tls.Config{}
+	if auth.TLSConfig != nil {
+		cfg = auth.TLSConfig.Clone()
+	}
+	switch subType {
+	case VeNCryptTLSNone, VeNCryptTLSVNC, VeNCryptTLSPlain:
+		cfg.InsecureSkipVerify = true
+	case VeNCryptX509None, VeNCryptX509VNC, VeNCryptX509Plain:
+	default:
+		return nil, fmt.Errorf("unsupported VeNCrypt subtype %d", subType)
+	}
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(nc.RemoteAddr().String())
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServerName = host
+	}
+	tc := tls.Client(nc, cfg)
+	if err := tc.Handshake(); err != nil {
+		return nil, fmt.Errorf("VeNCrypt TLS handshake failed: %v", err)
+	}
+
+	switch subType {
+	case VeNCryptTLSVNC, VeNCryptX509VNC:
+		if err := (&PasswordAuth{Password: auth.Password}).Handshake(tc); err != nil {
+			return nil, err
+		}
+	case VeNCryptTLSPlain, VeNCryptX509Plain:
+		lengths := []uint32{uint32(len(auth.Username)), uint32(len(auth.Password))}
+		if err := binary.Write(tc, binary.BigEndian, lengths); err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(tc, auth.Username+auth.Password); err != nil {
+			return nil, err
+		}
+	}
+	return tc, nil
+}
+
+// pickSubType returns the first of accepted which was offered.
+func pickSubType(accepted, offered []uint32) (uint32, bool) {
+	for _, a := range accepted {
+		for _, o := range offered {
+			if a == o {
+				return a, true
+			}
+		}
+	}
+	return 0, false
+}
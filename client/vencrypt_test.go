@@ -0,0 +1,212 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vnc-server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// vencryptServer is the server side of the VeNCrypt handshake, offering
+// subTypes and reading the Plain credentials.
+type vencryptServer struct {
+	cert     tls.Certificate
+	subTypes []uint32
+
+	subType  uint32
+	username string
+	password string
+}
+
+func (s *vencryptServer) serve(nc net.Conn) error {
+	if _, err := nc.Write([]byte{0, 2}); err != nil {
+		return err
+	}
+	var version [2]byte
+	if _, err := io.ReadFull(nc, version[:]); err != nil {
+		return err
+	}
+	if _, err := nc.Write([]byte{0, uint8(len(s.subTypes))}); err != nil {
+		return err
+	}
+	if err := binary.Write(nc, binary.BigEndian, s.subTypes); err != nil {
+		return err
+	}
+	if err := binary.Read(nc, binary.BigEndian, &s.subType); err != nil {
+		return err
+	}
+	if _, err := nc.Write([]byte{1}); err != nil {
+		return err
+	}
+	tc := tls.Server(nc, &tls.Config{Certificates: []tls.Certificate{s.cert}})
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	if s.subType == VeNCryptX509Plain || s.subType == VeNCryptTLSPlain {
+		var lengths [2]uint32
+		if err := binary.Read(tc, binary.BigEndian, &lengths); err != nil {
+			return err
+		}
+		creds := make([]byte, lengths[0]+lengths[1])
+		if _, err := io.ReadFull(tc, creds); err != nil {
+			return err
+		}
+		s.username, s.password = string(creds[:lengths[0]]), string(creds[lengths[0]:])
+	}
+	_, err := tc.Write([]byte("ok"))
+	return err
+}
+
+func vencryptHandshake(t *testing.T, s *vencryptServer, auth *VeNCryptAuth) (io.ReadWriteCloser, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+	defer ln.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		defer c.Close()
+		served <- s.serve(c)
+	}()
+
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting to mock server: %s", err)
+	}
+	conn, err := auth.HandshakeTransport(nc)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ok" {
+		t.Fatalf("unexpected reply over the transport: %q, %v", reply, err)
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("mock server failed: %s", err)
+	}
+	return conn, nil
+}
+
+func TestVeNCryptAuth_X509Plain(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	s := &vencryptServer{cert: cert, subTypes: []uint32{VeNCryptTLSNone, VeNCryptX509None, VeNCryptX509Plain}}
+	auth := &VeNCryptAuth{
+		TLSConfig: &tls.Config{RootCAs: pool},
+		Username:  "alice",
+		Password:  "secret",
+	}
+	conn, err := vencryptHandshake(t, s, auth)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Fatalf("expected the transport to be upgraded to TLS, got %T", conn)
+	}
+	if s.subType != VeNCryptX509Plain {
+		t.Errorf("expected subtype %d, got %d", VeNCryptX509Plain, s.subType)
+	}
+	if s.username != "alice" || s.password != "secret" {
+		t.Errorf("unexpected credentials %q/%q", s.username, s.password)
+	}
+}
+
+func TestVeNCryptAuth_TLSPlainRefusedWhenVerifying(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	s := &vencryptServer{cert: cert, subTypes: []uint32{VeNCryptTLSPlain}}
+	auth := &VeNCryptAuth{
+		TLSConfig: &tls.Config{RootCAs: pool},
+		Username:  "alice",
+		Password:  "secret",
+	}
+	_, err := vencryptHandshake(t, s, auth)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if s.username != "" || s.password != "" {
+		t.Fatalf("credentials were sent: %q/%q", s.username, s.password)
+	}
+}
+
+func TestVeNCryptAuth_TLSPlainWhenSkippingVerification(t *testing.T) {
+	cert, _ := selfSignedCert(t)
+	s := &vencryptServer{cert: cert, subTypes: []uint32{VeNCryptTLSPlain}}
+	auth := &VeNCryptAuth{
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		Username:  "alice",
+		Password:  "secret",
+	}
+	conn, err := vencryptHandshake(t, s, auth)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.Close()
+	if s.subType != VeNCryptTLSPlain {
+		t.Errorf("expected subtype %d, got %d", VeNCryptTLSPlain, s.subType)
+	}
+}
+
+func TestVeNCryptAuth_X509UntrustedCertificate(t *testing.T) {
+	cert, _ := selfSignedCert(t)
+	_, pool := selfSignedCert(t)
+	s := &vencryptServer{cert: cert, subTypes: []uint32{VeNCryptX509None}}
+	_, err := vencryptHandshake(t, s, &VeNCryptAuth{TLSConfig: &tls.Config{RootCAs: pool}})
+	if err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestPickSubType(t *testing.T) {
+	auth := &VeNCryptAuth{}
+	subType, ok := pickSubType(auth.subTypes(), []uint32{VeNCryptTLSPlain, VeNCryptTLSVNC, VeNCryptX509None})
+	if !ok || subType != VeNCryptX509None {
+		t.Errorf("expected subtype %d, got %d", VeNCryptX509None, subType)
+	}
+	if _, ok := pickSubType(auth.subTypes(), []uint32{VeNCryptPlain, VeNCryptX509Plain}); ok {
+		t.Error("expected no subtype without a username")
+	}
+	if _, ok := pickSubType(auth.subTypes(), []uint32{VeNCryptTLSNone, VeNCryptTLSVNC}); ok {
+		t.Error("expected no unverified subtype by default")
+	}
+}
@@ -15,7 +15,9 @@ type WriteTo struct {
 func (p *WriteTo) Consume(seg *common.RfbSegment) error {
 	switch seg.SegmentType {
 	case common.SegmentMessageStart:
+	case common.SegmentMessageEnd:
 	case common.SegmentRectSeparator:
+	case common.SegmentFullyParsedServerMessage:
 	case common.SegmentBytes:
 		_, err := p.Writer.Write(seg.Bytes)
 		if err != nil {
@@ -79,6 +79,8 @@ func (enct EncodingType) String() string {
 		return "EncDesktopSizePseudo"
 	case EncLastRectPseudo:
 		return "EncLastRectPseudo"
+	case EncDesktopNamePseudo:
+		return "EncDesktopNamePseudo"
 	case EncPointerPosPseudo:
 		return "EncPointerPosPseudo"
 	case EncCompressionLevel10:
@@ -143,6 +145,18 @@ func (enct EncodingType) String() string {
 	return ""
 }
 
+// Stateful reports whether the rectangles of the encoding depend on the
+// previous ones, through zlib streams kept for the whole connection. Such
+// a rectangle can only be decoded by whoever decoded all the previous
+// rectangles of the encoding.
+func (enct EncodingType) Stateful() bool {
+	switch enct {
+	case EncZlib, EncTight, EncZlibHex, EncZRLE:
+		return true
+	}
+	return false
+}
+
 const (
 	EncRaw                           EncodingType = 0
 	EncCopyRect                      EncodingType = 1
@@ -186,6 +200,7 @@ const (
 	EncQEMUExtendedKeyEventPseudo    EncodingType = -258
 	EncTightPng                      EncodingType = -260
 	EncLedStatePseudo                EncodingType = -261
+	EncDesktopNamePseudo             EncodingType = -307
 	EncExtendedDesktopSizePseudo     EncodingType = -308
 	EncXvpPseudo                     EncodingType = -309
 	EncFencePseudo                   EncodingType = -312
@@ -0,0 +1,122 @@
+package common
+
+// A ClientMessageInterceptor inspects a client message before it is
+// delivered. It returns the message to deliver in its place (the same
+// message, a rewritten one, or nil to drop it), or an error to abort
+// the connection.
+type ClientMessageInterceptor interface {
+	InterceptClientMessage(msg ClientMessage) (ClientMessage, error)
+}
+
+// ClientMessageInterceptorFunc adapts an ordinary function to a
+// ClientMessageInterceptor.
+type ClientMessageInterceptorFunc func(msg ClientMessage) (ClientMessage, error)
+
+func (f ClientMessageInterceptorFunc) InterceptClientMessage(msg ClientMessage) (ClientMessage, error) {
+	return f(msg)
+}
+
+// ClientInterceptorChain runs client messages through a sequence of
+// interceptors, in the order they were added.
+type ClientInterceptorChain struct {
+	interceptors []ClientMessageInterceptor
+}
+
+func (c *ClientInterceptorChain) AddInterceptor(interceptor ClientMessageInterceptor) {
+	c.interceptors = append(c.interceptors, interceptor)
+}
+
+// Intercept passes msg through the chain, and returns the message to
+// deliver, or nil if an interceptor dropped it. A nil chain returns msg
+// unchanged.
+func (c *ClientInterceptorChain) Intercept(msg ClientMessage) (ClientMessage, error) {
+	if c == nil {
+		return msg, nil
+	}
+	for _, interceptor := range c.interceptors {
+		var err error
+		if msg, err = interceptor.InterceptClientMessage(msg); err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			return nil, nil
+		}
+	}
+	return msg, nil
+}
+
+// A ServerMessageInterceptor inspects a server message before it is
+// delivered. It returns the message to deliver in its place (the same
+// message, a rewritten one, or nil to drop it), or an error to abort
+// the connection.
+type ServerMessageInterceptor interface {
+	InterceptServerMessage(msg ServerMessage) (ServerMessage, error)
+}
+
+// ServerMessageInterceptorFunc adapts an ordinary function to a
+// ServerMessageInterceptor.
+type ServerMessageInterceptorFunc func(msg ServerMessage) (ServerMessage, error)
+
+func (f ServerMessageInterceptorFunc) InterceptServerMessage(msg ServerMessage) (ServerMessage, error) {
+	return f(msg)
+}
+
+// A ServerInitInterceptor is a ServerMessageInterceptor that can also
+// rewrite the ServerInit message, e.g. to change the desktop name.
+type ServerInitInterceptor interface {
+	ServerMessageInterceptor
+	InterceptServerInit(init *ServerInit) error
+}
+
+// ServerInterceptorChain runs server messages through a sequence of
+// interceptors, in the order they were added.
+type ServerInterceptorChain struct {
+	interceptors []ServerMessageInterceptor
+}
+
+func (c *ServerInterceptorChain) AddInterceptor(interceptor ServerMessageInterceptor) {
+	c.interceptors = append(c.interceptors, interceptor)
+}
+
+// Len returns the number of interceptors in the chain.
+func (c *ServerInterceptorChain) Len() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.interceptors)
+}
+
+// Intercept passes msg through the chain, and returns the message to
+// deliver, or nil if an interceptor dropped it. A nil chain returns msg
+// unchanged.
+func (c *ServerInterceptorChain) Intercept(msg ServerMessage) (ServerMessage, error) {
+	if c == nil {
+		return msg, nil
+	}
+	for _, interceptor := range c.interceptors {
+		var err error
+		if msg, err = interceptor.InterceptServerMessage(msg); err != nil {
+			return nil, err
+		}
+		if msg == nil {
+			return nil, nil
+		}
+	}
+	return msg, nil
+}
+
+// InterceptServerInit lets the interceptors that implement
+// ServerInitInterceptor rewrite init in place.
+func (c *ServerInterceptorChain) InterceptServerInit(init *ServerInit) error {
+	if c == nil {
+		return nil
+	}
+	for _, interceptor := range c.interceptors {
+		if initInterceptor, ok := interceptor.(ServerInitInterceptor); ok {
+			if err := initInterceptor.InterceptServerInit(init); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
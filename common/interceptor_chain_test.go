@@ -0,0 +1,176 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+// testClientMessage is a client message carrying text.
+type testClientMessage struct {
+	text string
+}
+
+func (*testClientMessage) Type() ClientMessageType {
+	return ClientCutTextMsgType
+}
+
+func (m *testClientMessage) Read(io.Reader) (ClientMessage, error) {
+	return m, nil
+}
+
+func (m *testClientMessage) Write(w io.Writer) error {
+	_, err := io.WriteString(w, m.text)
+	return err
+}
+
+// appendText returns an interceptor rewriting messages, appending suffix
+// to their text.
+func appendText(suffix string) ClientMessageInterceptor {
+	return ClientMessageInterceptorFunc(func(msg ClientMessage) (ClientMessage, error) {
+		return &testClientMessage{text: msg.(*testClientMessage).text + suffix}, nil
+	})
+}
+
+func TestClientInterceptorChain(t *testing.T) {
+	var calls int
+	counter := ClientMessageInterceptorFunc(func(msg ClientMessage) (ClientMessage, error) {
+		calls++
+		return msg, nil
+	})
+	drop := ClientMessageInterceptorFunc(func(msg ClientMessage) (ClientMessage, error) {
+		return nil, nil
+	})
+	errRefused := errors.New("refused")
+	refuse := ClientMessageInterceptorFunc(func(msg ClientMessage) (ClientMessage, error) {
+		return nil, errRefused
+	})
+
+	tests := []struct {
+		name         string
+		interceptors []ClientMessageInterceptor
+		want         string
+		dropped      bool
+		err          error
+		calls        int
+	}{
+		{name: "empty", want: "msg"},
+		{name: "in order", interceptors: []ClientMessageInterceptor{appendText("-a"), appendText("-b")}, want: "msg-a-b"},
+		{name: "dropped", interceptors: []ClientMessageInterceptor{drop, counter}, dropped: true},
+		{name: "rewritten then dropped", interceptors: []ClientMessageInterceptor{counter, appendText("-a"), drop}, dropped: true, calls: 1},
+		{name: "error", interceptors: []ClientMessageInterceptor{refuse, counter}, err: errRefused},
+	}
+
+	for _, tt := range tests {
+		calls = 0
+		chain := &ClientInterceptorChain{}
+		for _, interceptor := range tt.interceptors {
+			chain.AddInterceptor(interceptor)
+		}
+		msg, err := chain.Intercept(&testClientMessage{text: "msg"})
+		switch {
+		case err != tt.err:
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+		case tt.err != nil || tt.dropped:
+			if msg != nil {
+				t.Errorf("%s: expected no message, got %+v", tt.name, msg)
+			}
+		case msg == nil || msg.(*testClientMessage).text != tt.want:
+			t.Errorf("%s: expected %q, got %+v", tt.name, tt.want, msg)
+		}
+		if calls != tt.calls {
+			t.Errorf("%s: counter called %d times, want %d", tt.name, calls, tt.calls)
+		}
+	}
+}
+
+func TestClientInterceptorChain_Nil(t *testing.T) {
+	var chain *ClientInterceptorChain
+	msg := &testClientMessage{text: "msg"}
+	got, err := chain.Intercept(msg)
+	if err != nil || got != msg {
+		t.Fatalf("expected the message unchanged, got %+v, %v", got, err)
+	}
+}
+
+// testServerMessage is a server message carrying text.
+type testServerMessage struct {
+	text string
+}
+
+func (*testServerMessage) Type() uint8 {
+	return uint8(ServerCutText)
+}
+
+func (m *testServerMessage) String() string {
+	return m.text
+}
+
+func (*testServerMessage) CopyTo(io.Reader, io.Writer, IClientConn) error {
+	return nil
+}
+
+func (m *testServerMessage) Read(IClientConn, *RfbReadHelper) (ServerMessage, error) {
+	return m, nil
+}
+
+func (m *testServerMessage) Write(w io.Writer) error {
+	_, err := io.WriteString(w, m.text)
+	return err
+}
+
+// desktopRenamer renames the desktop, and drops the server messages.
+type desktopRenamer struct {
+	name string
+}
+
+func (r *desktopRenamer) InterceptServerMessage(ServerMessage) (ServerMessage, error) {
+	return nil, nil
+}
+
+func (r *desktopRenamer) InterceptServerInit(init *ServerInit) error {
+	init.NameText = []byte(r.name)
+	init.NameLength = uint32(len(r.name))
+	return nil
+}
+
+func TestServerInterceptorChain(t *testing.T) {
+	rewrite := ServerMessageInterceptorFunc(func(msg ServerMessage) (ServerMessage, error) {
+		return &testServerMessage{text: msg.String() + "-a"}, nil
+	})
+	chain := &ServerInterceptorChain{}
+	chain.AddInterceptor(rewrite)
+	chain.AddInterceptor(rewrite)
+	if chain.Len() != 2 {
+		t.Fatalf("expected 2 interceptors, got %d", chain.Len())
+	}
+	msg, err := chain.Intercept(&testServerMessage{text: "msg"})
+	if err != nil || msg == nil || msg.String() != "msg-a-a" {
+		t.Fatalf("expected msg-a-a, got %v, %v", msg, err)
+	}
+
+	chain.AddInterceptor(&desktopRenamer{name: "renamed"})
+	if msg, err := chain.Intercept(&testServerMessage{text: "msg"}); err != nil || msg != nil {
+		t.Fatalf("expected the message to be dropped, got %v, %v", msg, err)
+	}
+	// only the interceptors implementing ServerInitInterceptor see the
+	// ServerInit
+	srvInit := &ServerInit{NameText: []byte("desktop"), NameLength: 7}
+	if err := chain.InterceptServerInit(srvInit); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(srvInit.NameText) != "renamed" || srvInit.NameLength != uint32(len("renamed")) {
+		t.Fatalf("unexpected ServerInit %+v", srvInit)
+	}
+}
+
+func TestServerInterceptorChain_Nil(t *testing.T) {
+	var chain *ServerInterceptorChain
+	msg := &testServerMessage{text: "msg"}
+	if got, err := chain.Intercept(msg); err != nil || got != msg {
+		t.Fatalf("expected the message unchanged, got %v, %v", got, err)
+	}
+	if chain.Len() != 0 || chain.InterceptServerInit(&ServerInit{}) != nil {
+		t.Fatal("expected a nil chain to do nothing")
+	}
+}
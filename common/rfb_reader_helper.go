@@ -106,7 +106,7 @@ func (r *RfbReadHelper) Read(p []byte) (n int, err error) {
 		return 0, fmt.Errorf("failed to read RFB bytes onto buffer")
 	}
 	if r.savedBytes != nil {
-		_, err := r.savedBytes.Write(p)
+		_, err := r.savedBytes.Write(p[:readLen])
 		if err != nil {
 			return 0, fmt.Errorf("failed to save bytes in memory buffer: %v", err)
 		}
@@ -9,6 +9,9 @@ type ServerMessage interface {
 	String() string
 	CopyTo(r io.Reader, w io.Writer, c IClientConn) error
 	Read(IClientConn, *RfbReadHelper) (ServerMessage, error)
+	// Write serializes the message in its wire format, including
+	// the message type.
+	Write(io.Writer) error
 }
 type ServerMessageType int8
 
@@ -2,8 +2,11 @@ package encodings
 
 import (
 	"encoding/binary"
-	"github.com/borderzero/vncproxy/common"
+	"image"
+	"image/draw"
 	"io"
+
+	"github.com/borderzero/vncproxy/common"
 )
 
 type CopyRectEncoding struct {
@@ -16,21 +19,34 @@ func (z *CopyRectEncoding) Type() int32 {
 	return 1
 }
 func (z *CopyRectEncoding) WriteTo(w io.Writer) (n int, err error) {
-	binary.Write(w, binary.BigEndian, z.copyRectSrcX)
-	if err != nil {
+	if err = binary.Write(w, binary.BigEndian, z.copyRectSrcX); err != nil {
 		return 0, err
 	}
-	binary.Write(w, binary.BigEndian, z.copyRectSrcY)
-	if err != nil {
-		return 0, err
+	if err = binary.Write(w, binary.BigEndian, z.copyRectSrcY); err != nil {
+		return 2, err
 	}
 	return 4, nil
 }
 
 func (z *CopyRectEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
-	z.copyRectSrcX, _ = r.ReadUint16()
-	z.copyRectSrcY, _ = r.ReadUint16()
-	return z, nil
+	srcX, err := r.ReadUint16()
+	if err != nil {
+		return nil, err
+	}
+	srcY, err := r.ReadUint16()
+	if err != nil {
+		return nil, err
+	}
+	return &CopyRectEncoding{copyRectSrcX: srcX, copyRectSrcY: srcY}, nil
+}
+
+func (z *CopyRectEncoding) decode(fb *Framebuffer, rect *common.Rectangle) error {
+	src := image.Rect(int(z.copyRectSrcX), int(z.copyRectSrcY), int(z.copyRectSrcX)+int(rect.Width), int(z.copyRectSrcY)+int(rect.Height))
+	// copy through a temporary image, the source and destination may overlap
+	tmp := image.NewRGBA(image.Rect(0, 0, src.Dx(), src.Dy()))
+	draw.Draw(tmp, tmp.Bounds(), fb.img, src.Min, draw.Src)
+	fb.drawImage(int(rect.X), int(rect.Y), tmp)
+	return nil
 }
 
 //////////
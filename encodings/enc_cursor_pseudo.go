@@ -7,22 +7,31 @@ import (
 )
 
 type EncCursorPseudo struct {
+	bytes []byte
 }
 
 func (pe *EncCursorPseudo) Type() int32 {
 	return int32(common.EncCursorPseudo)
 }
 func (z *EncCursorPseudo) WriteTo(w io.Writer) (n int, err error) {
-	return 0, nil
+	return w.Write(z.bytes)
 }
 func (pe *EncCursorPseudo) Read(pf *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
+	enc := &EncCursorPseudo{}
 	if rect.Width*rect.Height == 0 {
-		return pe, nil
+		return enc, nil
 	}
 
 	bytesPixel := int(pf.BPP / 8) //calcTightBytePerPixel(pf)
-	r.ReadBytes(int(rect.Width*rect.Height) * bytesPixel)
-	mask := ((rect.Width + 7) / 8) * rect.Height
-	r.ReadBytes(int(math.Floor(float64(mask))))
-	return pe, nil
+	pixels, err := r.ReadBytes(int(rect.Width) * int(rect.Height) * bytesPixel)
+	if err != nil {
+		return nil, err
+	}
+	mask := ((int(rect.Width) + 7) / 8) * int(rect.Height)
+	bitmask, err := r.ReadBytes(int(math.Floor(float64(mask))))
+	if err != nil {
+		return nil, err
+	}
+	enc.bytes = append(pixels, bitmask...)
+	return enc, nil
 }
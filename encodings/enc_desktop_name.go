@@ -0,0 +1,38 @@
+package encodings
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/borderzero/vncproxy/common"
+)
+
+// EncDesktopNamePseudo carries a new desktop name sent by the server.
+type EncDesktopNamePseudo struct {
+	Name []byte
+}
+
+func (*EncDesktopNamePseudo) Type() int32 {
+	return int32(common.EncDesktopNamePseudo)
+}
+
+func (pe *EncDesktopNamePseudo) WriteTo(w io.Writer) (n int, err error) {
+	if err = binary.Write(w, binary.BigEndian, uint32(len(pe.Name))); err != nil {
+		return 0, err
+	}
+	n, err = w.Write(pe.Name)
+	return n + 4, err
+}
+
+func (*EncDesktopNamePseudo) Read(pf *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
+	length, err := r.ReadUint32()
+	if err != nil {
+		return nil, fmt.Errorf("error while reading desktop name length: %v", err)
+	}
+	name, err := r.ReadBytes(int(length))
+	if err != nil {
+		return nil, fmt.Errorf("error while reading desktop name: %v", err)
+	}
+	return &EncDesktopNamePseudo{Name: name}, nil
+}
@@ -1,7 +1,9 @@
 package encodings
 
 import (
+	"bytes"
 	"fmt"
+	"image/color"
 	"io"
 
 	"github.com/borderzero/vncproxy/common"
@@ -29,9 +31,10 @@ func (z *HextileEncoding) WriteTo(w io.Writer) (n int, err error) {
 func (z *HextileEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
 	bytesPerPixel := int(pixelFmt.BPP) / 8
 
+	enc := &HextileEncoding{}
 	r.StartByteCollection()
 	defer func() {
-		z.bytes = r.EndByteCollection()
+		enc.bytes = r.EndByteCollection()
 	}()
 
 	for ty := rect.Y; ty < rect.Y+rect.Height; ty += 16 {
@@ -78,5 +81,75 @@ func (z *HextileEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectan
 		}
 	}
 
-	return z, nil
+	return enc, nil
+}
+
+func (z *HextileEncoding) decode(fb *Framebuffer, rect *common.Rectangle) error {
+	bpp := fb.bytesPerPixel()
+	r := bytes.NewReader(z.bytes)
+	var bg, fg color.RGBA
+
+	for ty := 0; ty < int(rect.Height); ty += 16 {
+		th := min(16, int(rect.Height)-ty)
+		for tx := 0; tx < int(rect.Width); tx += 16 {
+			tw := min(16, int(rect.Width)-tx)
+			x, y := int(rect.X)+tx, int(rect.Y)+ty
+
+			subencoding, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if (subencoding & HextileRaw) != 0 {
+				data, err := readFull(r, tw*th*bpp)
+				if err != nil {
+					return err
+				}
+				if err := fb.drawPixels(x, y, tw, th, bpp, data, fb.pixel); err != nil {
+					return err
+				}
+				continue
+			}
+			if (subencoding & HextileBackgroundSpecified) != 0 {
+				px, err := readFull(r, bpp)
+				if err != nil {
+					return err
+				}
+				bg = fb.pixel(px)
+			}
+			fb.fill(x, y, tw, th, bg)
+			if (subencoding & HextileForegroundSpecified) != 0 {
+				px, err := readFull(r, bpp)
+				if err != nil {
+					return err
+				}
+				fg = fb.pixel(px)
+			}
+			if (subencoding & HextileAnySubrects) == 0 {
+				continue
+			}
+
+			nSubrects, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			for i := 0; i < int(nSubrects); i++ {
+				c := fg
+				if (subencoding & HextileSubrectsColoured) != 0 {
+					px, err := readFull(r, bpp)
+					if err != nil {
+						return err
+					}
+					c = fb.pixel(px)
+				}
+				xywh, err := readFull(r, 2)
+				if err != nil {
+					return err
+				}
+				sx, sy := int(xywh[0]>>4), int(xywh[0]&0x0f)
+				sw, sh := int(xywh[1]>>4)+1, int(xywh[1]&0x0f)+1
+				fb.fill(x+sx, y+sy, sw, sh, c)
+			}
+		}
+	}
+	return nil
 }
@@ -1,9 +1,12 @@
 package encodings
 
 import (
-	"bytes"
-	"github.com/borderzero/vncproxy/common"
+	"errors"
+	"fmt"
+	"image"
 	"io"
+
+	"github.com/borderzero/vncproxy/common"
 )
 
 // RawEncoding is raw pixel data sent by the server.
@@ -21,15 +24,35 @@ func (*RawEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle, r
 
 	bytesPerPixel := int(pixelFmt.BPP / 8)
 
-	bytes := &bytes.Buffer{}
-	for y := uint16(0); y < rect.Height; y++ {
-		for x := uint16(0); x < rect.Width; x++ {
-			if bts, err := r.ReadBytes(bytesPerPixel); err != nil {
-				StoreBytes(bytes, bts)
-				return nil, err
-			}
-		}
+	bts, err := r.ReadBytes(int(rect.Width) * int(rect.Height) * bytesPerPixel)
+	if err != nil {
+		return nil, err
 	}
 
-	return &RawEncoding{bytes.Bytes()}, nil
+	return &RawEncoding{bts}, nil
+}
+
+func (z *RawEncoding) decode(fb *Framebuffer, rect *common.Rectangle) error {
+	return fb.drawPixels(int(rect.X), int(rect.Y), int(rect.Width), int(rect.Height), fb.bytesPerPixel(), z.bytes, fb.pixel)
+}
+
+// EncodeRaw returns the pixels of r, a rectangle of the framebuffer, as
+// a Raw encoded rectangle in the current pixel format. It fails for pixel
+// formats using a color map.
+func (fb *Framebuffer) EncodeRaw(r image.Rectangle) (*RawEncoding, error) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if fb.pf.TrueColor == 0 {
+		return nil, errors.New("Framebuffer.EncodeRaw: pixel format is not true color")
+	}
+	if !r.In(fb.img.Bounds()) {
+		return nil, fmt.Errorf("Framebuffer.EncodeRaw: rectangle %v is outside of the framebuffer %v", r, fb.img.Bounds())
+	}
+	bts := make([]byte, 0, r.Dx()*r.Dy()*fb.bytesPerPixel())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			bts = fb.appendPixel(bts, fb.img.RGBAAt(x, y))
+		}
+	}
+	return &RawEncoding{bts}, nil
 }
@@ -2,8 +2,10 @@ package encodings
 
 import (
 	"encoding/binary"
-	"github.com/borderzero/vncproxy/common"
+	"fmt"
 	"io"
+
+	"github.com/borderzero/vncproxy/common"
 )
 
 type RREEncoding struct {
@@ -14,20 +16,14 @@ type RREEncoding struct {
 }
 
 func (z *RREEncoding) WriteTo(w io.Writer) (n int, err error) {
-	binary.Write(w, binary.BigEndian, z.numSubRects)
-	if err != nil {
+	if err = binary.Write(w, binary.BigEndian, z.numSubRects); err != nil {
 		return 0, err
 	}
-
-	w.Write(z.backgroundColor)
-	if err != nil {
-		return 0, err
+	if _, err = w.Write(z.backgroundColor); err != nil {
+		return 4, err
 	}
-
-	w.Write(z.subRectData)
-
-	if err != nil {
-		return 0, err
+	if _, err = w.Write(z.subRectData); err != nil {
+		return 4 + len(z.backgroundColor), err
 	}
 	b := len(z.backgroundColor) + len(z.subRectData) + 4
 	return b, nil
@@ -42,18 +38,38 @@ func (z *RREEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle,
 	if err != nil {
 		return nil, err
 	}
-	z.numSubRects = numOfSubrectangles
+	enc := &RREEncoding{numSubRects: numOfSubrectangles}
 
 	//read whole-rect background color
-	z.backgroundColor, err = r.ReadBytes(bytesPerPixel)
+	enc.backgroundColor, err = r.ReadBytes(bytesPerPixel)
 	if err != nil {
 		return nil, err
 	}
 
 	//read all individual rects (color=bytesPerPixel + x=16b + y=16b + w=16b + h=16b)
-	z.subRectData, err = r.ReadBytes(int(numOfSubrectangles) * (bytesPerPixel + 8)) // x+y+w+h=8 bytes
+	enc.subRectData, err = r.ReadBytes(int(numOfSubrectangles) * (bytesPerPixel + 8)) // x+y+w+h=8 bytes
 	if err != nil {
 		return nil, err
 	}
-	return z, nil
+	return enc, nil
+}
+
+func (z *RREEncoding) decode(fb *Framebuffer, rect *common.Rectangle) error {
+	bpp := fb.bytesPerPixel()
+	size := bpp + 8
+	if len(z.backgroundColor) != bpp || len(z.subRectData) < int(z.numSubRects)*size {
+		return fmt.Errorf("short subrectangle data")
+	}
+	fb.fill(int(rect.X), int(rect.Y), int(rect.Width), int(rect.Height), fb.pixel(z.backgroundColor))
+	for i := 0; i < int(z.numSubRects); i++ {
+		sub := z.subRectData[i*size:]
+		c := fb.pixel(sub[:bpp])
+		off := bpp
+		x := int(binary.BigEndian.Uint16(sub[off:]))
+		y := int(binary.BigEndian.Uint16(sub[off+2:]))
+		w := int(binary.BigEndian.Uint16(sub[off+4:]))
+		h := int(binary.BigEndian.Uint16(sub[off+6:]))
+		fb.fill(int(rect.X)+x, int(rect.Y)+y, w, h, c)
+	}
+	return nil
 }
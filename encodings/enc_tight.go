@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
 	"io"
 
 	"github.com/borderzero/vncproxy/common"
@@ -15,7 +19,7 @@ const (
 	TightExplicitFilter = 0x04
 	TightFill           = 0x08
 	TightJpeg           = 0x09
-	TightPNG            = 0x10
+	TightPNG            = 0x0A
 
 	TightFilterCopy     = 0x00
 	TightFilterPalette  = 0x01
@@ -54,9 +58,10 @@ func StoreBytes(bytes *bytes.Buffer, data []byte) error {
 func (t *TightEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
 	bytesPixel := calcTightBytePerPixel(pixelFmt)
 
+	enc := &TightEncoding{}
 	r.StartByteCollection()
 	defer func() {
-		t.bytes = r.EndByteCollection()
+		enc.bytes = r.EndByteCollection()
 	}()
 
 	compctl, err := r.ReadUint8()
@@ -75,7 +80,7 @@ func (t *TightEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangl
 			return nil, fmt.Errorf("error in handling tight encoding: %v", err)
 		}
 
-		return t, nil
+		return enc, nil
 	case TightJpeg:
 		if pixelFmt.BPP == 8 {
 			return nil, errors.New("Tight encoding: JPEG is not supported in 8 bpp mode")
@@ -91,7 +96,7 @@ func (t *TightEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangl
 			return nil, err
 		}
 
-		return t, nil
+		return enc, nil
 	default:
 
 		if compType > TightJpeg {
@@ -102,7 +107,7 @@ func (t *TightEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangl
 			return nil, err
 		}
 
-		return t, nil
+		return enc, nil
 	}
 }
 
@@ -170,3 +175,220 @@ func handleTightFilters(subencoding uint8, pixelFmt *common.PixelFormat, rect *c
 
 	return nil
 }
+
+func (z *TightEncoding) decode(fb *Framebuffer, rect *common.Rectangle) error {
+	r := bytes.NewReader(z.bytes)
+	compctl, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	// the low bits ask to reset the zlib streams
+	for id := 0; id < 4; id++ {
+		if compctl&(1<<id) != 0 {
+			fb.resetStream(common.EncTight, id)
+		}
+	}
+
+	compType := compctl >> 4 & 0x0F
+	switch compType {
+	case TightFill, TightJpeg:
+		return decodeTightImage(fb, rect, compType, r)
+	}
+	if compType > TightJpeg {
+		return fmt.Errorf("bad tight compression control: %d", compctl)
+	}
+
+	var filterid uint8
+	if compType&TightExplicitFilter != 0 {
+		if filterid, err = r.ReadByte(); err != nil {
+			return err
+		}
+	}
+	stream := int(compType & 0x03)
+	x, y, w, h := int(rect.X), int(rect.Y), int(rect.Width), int(rect.Height)
+	tbpp := calcTightBytePerPixel(&fb.pf)
+
+	switch filterid {
+	case TightFilterCopy:
+		data, err := readTightData(fb, r, stream, w*h*tbpp)
+		if err != nil {
+			return err
+		}
+		return fb.drawPixels(x, y, w, h, tbpp, data, fb.tightPixel)
+
+	case TightFilterPalette:
+		colorCount, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		palette := make([]color.RGBA, int(colorCount)+1)
+		for i := range palette {
+			px, err := readFull(r, tbpp)
+			if err != nil {
+				return err
+			}
+			palette[i] = fb.tightPixel(px)
+		}
+		if len(palette) == 2 {
+			rowBytes := (w + 7) / 8
+			data, err := readTightData(fb, r, stream, h*rowBytes)
+			if err != nil {
+				return err
+			}
+			for py := 0; py < h; py++ {
+				for px := 0; px < w; px++ {
+					bit := data[py*rowBytes+px/8] >> (7 - px%8) & 1
+					fb.img.SetRGBA(x+px, y+py, palette[bit])
+				}
+			}
+			return nil
+		}
+		data, err := readTightData(fb, r, stream, w*h)
+		if err != nil {
+			return err
+		}
+		for i, idx := range data {
+			if int(idx) >= len(palette) {
+				return fmt.Errorf("tight palette index %d out of range", idx)
+			}
+			fb.img.SetRGBA(x+i%w, y+i/w, palette[idx])
+		}
+		return nil
+
+	case TightFilterGradient:
+		data, err := readTightData(fb, r, stream, w*h*tbpp)
+		if err != nil {
+			return err
+		}
+		decodeTightGradient(fb, rect, tbpp, data)
+		return nil
+	}
+	return fmt.Errorf("bad tight filter id: %d", filterid)
+}
+
+// decodeTightImage decodes the fill and JPEG compressions, shared by
+// Tight and TightPng, and the PNG compression of TightPng.
+func decodeTightImage(fb *Framebuffer, rect *common.Rectangle, compType uint8, r *bytes.Reader) error {
+	if compType == TightFill {
+		px, err := readFull(r, calcTightBytePerPixel(&fb.pf))
+		if err != nil {
+			return err
+		}
+		fb.fill(int(rect.X), int(rect.Y), int(rect.Width), int(rect.Height), fb.tightPixel(px))
+		return nil
+	}
+
+	length, err := readCompactLen(r)
+	if err != nil {
+		return err
+	}
+	data, err := readFull(r, length)
+	if err != nil {
+		return err
+	}
+	var img image.Image
+	if compType == TightJpeg {
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	} else {
+		img, err = png.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return err
+	}
+	fb.drawImage(int(rect.X), int(rect.Y), img)
+	return nil
+}
+
+// readTightData reads size bytes of filtered data, inflating them from
+// the given zlib stream when the server compressed them.
+func readTightData(fb *Framebuffer, r *bytes.Reader, stream, size int) ([]byte, error) {
+	if size < TightMinToCompress {
+		return readFull(r, size)
+	}
+	length, err := readCompactLen(r)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := readFull(r, length)
+	if err != nil {
+		return nil, err
+	}
+	inflated, err := fb.stream(common.EncTight, stream).feed(compressed)
+	if err != nil {
+		return nil, err
+	}
+	return readFull(inflated, size)
+}
+
+// decodeTightGradient reverses the gradient filter, which sends each
+// color component as the difference from its prediction by the left,
+// upper and upper-left pixels.
+func decodeTightGradient(fb *Framebuffer, rect *common.Rectangle, tbpp int, data []byte) {
+	w, h := int(rect.Width), int(rect.Height)
+	pf := &fb.pf
+	maxes := [3]int{int(pf.RedMax), int(pf.GreenMax), int(pf.BlueMax)}
+	shift := [3]uint8{pf.RedShift, pf.GreenShift, pf.BlueShift}
+	if tbpp == 3 {
+		maxes = [3]int{255, 255, 255}
+	}
+
+	prevRow := make([][3]int, w)
+	thisRow := make([][3]int, w)
+	for py := 0; py < h; py++ {
+		for px := 0; px < w; px++ {
+			var diff [3]int
+			off := (py*w + px) * tbpp
+			if tbpp == 3 {
+				diff = [3]int{int(data[off]), int(data[off+1]), int(data[off+2])}
+			} else {
+				v := fb.pixelValue(data[off : off+tbpp])
+				for c := range diff {
+					diff[c] = int(v>>shift[c]) & maxes[c]
+				}
+			}
+			for c := range diff {
+				var left, upper, upperLeft int
+				if px > 0 {
+					left = thisRow[px-1][c]
+					upperLeft = prevRow[px-1][c]
+				}
+				upper = prevRow[px][c]
+				predicted := min(maxes[c], max(0, left+upper-upperLeft))
+				thisRow[px][c] = (predicted + diff[c]) & maxes[c]
+			}
+			p := thisRow[px]
+			var c color.RGBA
+			if tbpp == 3 {
+				c = color.RGBA{uint8(p[0]), uint8(p[1]), uint8(p[2]), 0xff}
+			} else {
+				c = color.RGBA{
+					scaleComponent(uint32(p[0]), pf.RedMax),
+					scaleComponent(uint32(p[1]), pf.GreenMax),
+					scaleComponent(uint32(p[2]), pf.BlueMax),
+					0xff,
+				}
+			}
+			fb.img.SetRGBA(int(rect.X)+px, int(rect.Y)+py, c)
+		}
+		prevRow, thisRow = thisRow, prevRow
+	}
+}
+
+// readCompactLen reads the 1 to 3 byte length used by Tight.
+func readCompactLen(r io.ByteReader) (int, error) {
+	length := 0
+	for i := 0; i < 3; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if i == 2 {
+			return length | int(b)<<14, nil
+		}
+		length |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return length, nil
+}
@@ -1,6 +1,7 @@
 package encodings
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 
@@ -19,9 +20,10 @@ func (*TightPngEncoding) Type() int32 { return int32(common.EncTightPng) }
 
 func (t *TightPngEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle, r *common.RfbReadHelper) (common.IEncoding, error) {
 	bytesPixel := calcTightBytePerPixel(pixelFmt)
+	enc := &TightPngEncoding{}
 	r.StartByteCollection()
 	defer func() {
-		t.bytes = r.EndByteCollection()
+		enc.bytes = r.EndByteCollection()
 	}()
 
 	//var subencoding uint8
@@ -34,20 +36,36 @@ func (t *TightPngEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Recta
 	compType := compctl >> 4 & 0x0F
 
 	switch compType {
-	case TightPNG:
+	case TightPNG, TightJpeg:
 		len, err := r.ReadCompactLen()
 		if err != nil {
 			return nil, fmt.Errorf("failed to read compact length: %v", err)
 		}
 		_, err = r.ReadBytes(len)
 		if err != nil {
-			return t, err
+			return nil, err
 		}
 
 	case TightFill:
-		r.ReadBytes(int(bytesPixel))
+		if _, err := r.ReadBytes(int(bytesPixel)); err != nil {
+			return nil, err
+		}
 	default:
 		return nil, fmt.Errorf("unknown tight compression %d", compType)
 	}
-	return t, nil
+	return enc, nil
+}
+
+func (z *TightPngEncoding) decode(fb *Framebuffer, rect *common.Rectangle) error {
+	r := bytes.NewReader(z.bytes)
+	compctl, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	compType := compctl >> 4 & 0x0F
+	switch compType {
+	case TightPNG, TightJpeg, TightFill:
+		return decodeTightImage(fb, rect, compType, r)
+	}
+	return fmt.Errorf("unknown tight compression %d", compType)
 }
@@ -3,8 +3,10 @@ package encodings
 import (
 	"bytes"
 	"encoding/binary"
-	"github.com/borderzero/vncproxy/common"
+	"fmt"
 	"io"
+
+	"github.com/borderzero/vncproxy/common"
 )
 
 type ZLibEncoding struct {
@@ -33,6 +35,21 @@ func (z *ZLibEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle
 		return nil, err
 	}
 	StoreBytes(bytes, bts)
-	z.bytes = bytes.Bytes()
-	return z, nil
+	return &ZLibEncoding{bytes: bytes.Bytes()}, nil
+}
+
+func (z *ZLibEncoding) decode(fb *Framebuffer, rect *common.Rectangle) error {
+	if len(z.bytes) < 4 {
+		return fmt.Errorf("short zlib data")
+	}
+	inflated, err := fb.stream(common.EncZlib, 0).feed(z.bytes[4:])
+	if err != nil {
+		return err
+	}
+	bpp := fb.bytesPerPixel()
+	data, err := readFull(inflated, int(rect.Width)*int(rect.Height)*bpp)
+	if err != nil {
+		return err
+	}
+	return fb.drawPixels(int(rect.X), int(rect.Y), int(rect.Width), int(rect.Height), bpp, data, fb.pixel)
 }
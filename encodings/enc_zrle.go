@@ -3,8 +3,11 @@ package encodings
 import (
 	"bytes"
 	"encoding/binary"
-	"github.com/borderzero/vncproxy/common"
+	"fmt"
+	"image/color"
 	"io"
+
+	"github.com/borderzero/vncproxy/common"
 )
 
 type ZRLEEncoding struct {
@@ -33,6 +36,141 @@ func (z *ZRLEEncoding) Read(pixelFmt *common.PixelFormat, rect *common.Rectangle
 		return nil, err
 	}
 	StoreBytes(bytes, bts)
-	z.bytes = bytes.Bytes()
-	return z, nil
+	return &ZRLEEncoding{bytes: bytes.Bytes()}, nil
+}
+
+func (z *ZRLEEncoding) decode(fb *Framebuffer, rect *common.Rectangle) error {
+	if len(z.bytes) < 4 {
+		return fmt.Errorf("short zrle data")
+	}
+	r, err := fb.stream(common.EncZRLE, 0).feed(z.bytes[4:])
+	if err != nil {
+		return err
+	}
+
+	bpp, convert := fb.bytesPerPixel(), fb.pixel
+	if fb.compactPixels() {
+		bpp, convert = 3, fb.compactPixel
+	}
+	readPixel := func() (color.RGBA, error) {
+		px, err := readFull(r, bpp)
+		if err != nil {
+			return color.RGBA{}, err
+		}
+		return convert(px), nil
+	}
+	readByte := func() (int, error) {
+		b, err := readFull(r, 1)
+		if err != nil {
+			return 0, err
+		}
+		return int(b[0]), nil
+	}
+	readRunLength := func() (int, error) {
+		length := 1
+		for {
+			b, err := readByte()
+			if err != nil {
+				return 0, err
+			}
+			length += b
+			if b != 255 {
+				return length, nil
+			}
+		}
+	}
+
+	for ty := 0; ty < int(rect.Height); ty += 64 {
+		th := min(64, int(rect.Height)-ty)
+		for tx := 0; tx < int(rect.Width); tx += 64 {
+			tw := min(64, int(rect.Width)-tx)
+			x, y := int(rect.X)+tx, int(rect.Y)+ty
+
+			subencoding, err := readByte()
+			if err != nil {
+				return err
+			}
+			rle := subencoding&128 != 0
+			paletteSize := subencoding & 127
+			palette := make([]color.RGBA, paletteSize)
+			for i := range palette {
+				if palette[i], err = readPixel(); err != nil {
+					return err
+				}
+			}
+
+			switch {
+			case subencoding == 0: // raw
+				data, err := readFull(r, tw*th*bpp)
+				if err != nil {
+					return err
+				}
+				if err := fb.drawPixels(x, y, tw, th, bpp, data, convert); err != nil {
+					return err
+				}
+
+			case subencoding == 1: // solid
+				fb.fill(x, y, tw, th, palette[0])
+
+			case !rle && paletteSize <= 16: // packed palette
+				bits := 4
+				if paletteSize == 2 {
+					bits = 1
+				} else if paletteSize <= 4 {
+					bits = 2
+				}
+				rowBytes := (tw*bits + 7) / 8
+				for py := 0; py < th; py++ {
+					row, err := readFull(r, rowBytes)
+					if err != nil {
+						return err
+					}
+					for px := 0; px < tw; px++ {
+						bit := px * bits
+						idx := int(row[bit/8]>>(8-bits-bit%8)) & (1<<bits - 1)
+						if idx >= paletteSize {
+							return fmt.Errorf("zrle palette index %d out of range", idx)
+						}
+						fb.img.SetRGBA(x+px, y+py, palette[idx])
+					}
+				}
+
+			case rle && paletteSize == 0: // plain RLE
+				for i := 0; i < tw*th; {
+					c, err := readPixel()
+					if err != nil {
+						return err
+					}
+					length, err := readRunLength()
+					if err != nil {
+						return err
+					}
+					i = fb.drawRun(x, y, tw, th, i, length, c)
+				}
+
+			case rle && paletteSize >= 2: // palette RLE
+				for i := 0; i < tw*th; {
+					idx, err := readByte()
+					if err != nil {
+						return err
+					}
+					length := 1
+					if idx&128 != 0 {
+						idx &= 127
+						if length, err = readRunLength(); err != nil {
+							return err
+						}
+					}
+					if idx >= paletteSize {
+						return fmt.Errorf("zrle palette index %d out of range", idx)
+					}
+					i = fb.drawRun(x, y, tw, th, i, length, palette[idx])
+				}
+
+			default:
+				return fmt.Errorf("bad zrle subencoding: %d", subencoding)
+			}
+		}
+	}
+	return nil
 }
@@ -0,0 +1,397 @@
+package encodings
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"sync"
+
+	"github.com/borderzero/vncproxy/common"
+)
+
+// A pixelDecoder is an encoding that can draw its rectangle into a Framebuffer.
+type pixelDecoder interface {
+	decode(fb *Framebuffer, rect *common.Rectangle) error
+}
+
+// Framebuffer is an in-memory RGBA copy of a remote desktop, kept up to
+// date by decoding the rectangles of framebuffer updates.
+//
+// The zlib streams of the ZLib, ZRLE and Tight encodings span the whole
+// connection, so a Framebuffer must see every rectangle of those
+// encodings, in order, to decode them.
+type Framebuffer struct {
+	mu       sync.Mutex
+	img      *image.RGBA
+	pf       common.PixelFormat
+	colorMap [256]color.RGBA
+	streams  map[zlibStreamId]*zlibStream
+}
+
+// NewFramebuffer returns a black framebuffer of the given size, for
+// pixels in format pf.
+func NewFramebuffer(width, height uint16, pf *common.PixelFormat) *Framebuffer {
+	return &Framebuffer{
+		img:     image.NewRGBA(image.Rect(0, 0, int(width), int(height))),
+		pf:      *pf,
+		streams: make(map[zlibStreamId]*zlibStream),
+	}
+}
+
+// NewFramebufferFromServerInit returns a framebuffer sized and formatted
+// as announced by the server.
+func NewFramebufferFromServerInit(init *common.ServerInit) *Framebuffer {
+	return NewFramebuffer(init.FBWidth, init.FBHeight, &init.PixelFormat)
+}
+
+// SetPixelFormat changes the format of the pixels in later rectangles.
+func (fb *Framebuffer) SetPixelFormat(pf *common.PixelFormat) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.pf = *pf
+}
+
+// SetColorMapEntries updates the color map used for pixels of a
+// non true-color format.
+func (fb *Framebuffer) SetColorMapEntries(firstColor uint16, colors []common.Color) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	for i, c := range colors {
+		idx := int(firstColor) + i
+		if idx >= len(fb.colorMap) {
+			break
+		}
+		fb.colorMap[idx] = color.RGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), 0xff}
+	}
+}
+
+// Resize changes the size of the framebuffer, keeping the pixels of the
+// area common to the old and new sizes.
+func (fb *Framebuffer) Resize(width, height uint16) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.resize(width, height)
+}
+
+func (fb *Framebuffer) resize(width, height uint16) {
+	img := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	draw.Draw(img, img.Bounds(), fb.img, image.Point{}, draw.Src)
+	fb.img = img
+}
+
+// Bounds returns the current size of the framebuffer.
+func (fb *Framebuffer) Bounds() image.Rectangle {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	return fb.img.Bounds()
+}
+
+// Image returns a copy of the current framebuffer contents.
+func (fb *Framebuffer) Image() *image.RGBA {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	img := image.NewRGBA(fb.img.Bounds())
+	copy(img.Pix, fb.img.Pix)
+	return img
+}
+
+// Update decodes the rectangles of a framebuffer update.
+func (fb *Framebuffer) Update(rects []common.Rectangle) error {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	for i := range rects {
+		if err := fb.apply(&rects[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fb *Framebuffer) apply(rect *common.Rectangle) error {
+	if rect.Enc == nil {
+		return errors.New("Framebuffer.apply: rectangle without encoding")
+	}
+	if dec, ok := rect.Enc.(pixelDecoder); ok {
+		if err := dec.decode(fb, rect); err != nil {
+			return fmt.Errorf("Framebuffer.apply: error decoding %s rectangle: %v", common.EncodingType(rect.Enc.Type()), err)
+		}
+		return nil
+	}
+	encType := common.EncodingType(rect.Enc.Type())
+	switch {
+	case encType == common.EncDesktopSizePseudo:
+		fb.resize(rect.Width, rect.Height)
+		return nil
+	case encType < 0:
+		// the other pseudo-encodings (cursor, led state, ...) carry no pixels
+		return nil
+	}
+	return fmt.Errorf("Framebuffer.apply: unsupported encoding %s", encType)
+}
+
+// color converts a pixel value of the current pixel format.
+func (fb *Framebuffer) color(v uint32) color.RGBA {
+	pf := &fb.pf
+	if pf.TrueColor == 0 {
+		return fb.colorMap[v&0xff]
+	}
+	return color.RGBA{
+		R: scaleComponent(v>>pf.RedShift, pf.RedMax),
+		G: scaleComponent(v>>pf.GreenShift, pf.GreenMax),
+		B: scaleComponent(v>>pf.BlueShift, pf.BlueMax),
+		A: 0xff,
+	}
+}
+
+func scaleComponent(v uint32, max uint16) uint8 {
+	if max == 0 {
+		return 0
+	}
+	return uint8((v & uint32(max)) * 255 / uint32(max))
+}
+
+// bytesPerPixel is the size of a PIXEL in the current pixel format.
+func (fb *Framebuffer) bytesPerPixel() int {
+	return int(fb.pf.BPP / 8)
+}
+
+// pixelValue reads a PIXEL in the current pixel format.
+func (fb *Framebuffer) pixelValue(b []byte) uint32 {
+	switch len(b) {
+	case 1:
+		return uint32(b[0])
+	case 2:
+		if fb.pf.BigEndian != 0 {
+			return uint32(b[0])<<8 | uint32(b[1])
+		}
+		return uint32(b[1])<<8 | uint32(b[0])
+	case 4:
+		if fb.pf.BigEndian != 0 {
+			return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+		}
+		return uint32(b[3])<<24 | uint32(b[2])<<16 | uint32(b[1])<<8 | uint32(b[0])
+	}
+	return 0
+}
+
+// appendPixel appends c as a PIXEL of the current pixel format, which
+// must be true color.
+func (fb *Framebuffer) appendPixel(b []byte, c color.RGBA) []byte {
+	pf := &fb.pf
+	v := uint32(c.R)*uint32(pf.RedMax)/255<<pf.RedShift |
+		uint32(c.G)*uint32(pf.GreenMax)/255<<pf.GreenShift |
+		uint32(c.B)*uint32(pf.BlueMax)/255<<pf.BlueShift
+	switch pf.BPP {
+	case 8:
+		return append(b, uint8(v))
+	case 16:
+		if pf.BigEndian != 0 {
+			return binary.BigEndian.AppendUint16(b, uint16(v))
+		}
+		return binary.LittleEndian.AppendUint16(b, uint16(v))
+	}
+	if pf.BigEndian != 0 {
+		return binary.BigEndian.AppendUint32(b, v)
+	}
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+// pixel converts a PIXEL in the current pixel format.
+func (fb *Framebuffer) pixel(b []byte) color.RGBA {
+	return fb.color(fb.pixelValue(b))
+}
+
+// compactPixels reports whether 32bpp pixels are sent as 3 bytes, as
+// with the CPIXEL of ZRLE and the TPIXEL of Tight.
+func (fb *Framebuffer) compactPixels() bool {
+	pf := &fb.pf
+	return pf.TrueColor != 0 && pf.BPP == 32 && pf.Depth <= 24
+}
+
+// compactPixel converts a CPIXEL of ZRLE: a 32bpp pixel without the byte
+// its value does not use.
+func (fb *Framebuffer) compactPixel(b []byte) color.RGBA {
+	pf := &fb.pf
+	fitsLow := uint32(pf.RedMax)<<pf.RedShift < 1<<24 &&
+		uint32(pf.GreenMax)<<pf.GreenShift < 1<<24 &&
+		uint32(pf.BlueMax)<<pf.BlueShift < 1<<24
+	var px [4]byte
+	if fitsLow == (pf.BigEndian != 0) {
+		copy(px[1:], b)
+	} else {
+		copy(px[:3], b)
+	}
+	return fb.pixel(px[:])
+}
+
+// tightPixel converts a TPIXEL of Tight: the red, green and blue bytes
+// of a 24 bit depth pixel, or a PIXEL otherwise.
+func (fb *Framebuffer) tightPixel(b []byte) color.RGBA {
+	if len(b) == 3 {
+		return color.RGBA{b[0], b[1], b[2], 0xff}
+	}
+	return fb.pixel(b)
+}
+
+// fill paints a rectangle, clipped to the framebuffer, in a single color.
+func (fb *Framebuffer) fill(x, y, w, h int, c color.RGBA) {
+	r := image.Rect(x, y, x+w, y+h).Intersect(fb.img.Bounds())
+	for py := r.Min.Y; py < r.Max.Y; py++ {
+		for px := r.Min.X; px < r.Max.X; px++ {
+			fb.img.SetRGBA(px, py, c)
+		}
+	}
+}
+
+// drawPixels paints w*h pixels of size bpp, read from data by convert.
+func (fb *Framebuffer) drawPixels(x, y, w, h, bpp int, data []byte, convert func([]byte) color.RGBA) error {
+	if len(data) < w*h*bpp {
+		return fmt.Errorf("short pixel data: %d bytes for %dx%d pixels", len(data), w, h)
+	}
+	for py := 0; py < h; py++ {
+		for px := 0; px < w; px++ {
+			off := (py*w + px) * bpp
+			fb.img.SetRGBA(x+px, y+py, convert(data[off:off+bpp]))
+		}
+	}
+	return nil
+}
+
+// drawRun paints a run of length pixels of the w*h tile at x, y, starting
+// at pixel index i of the tile, and returns the index following it.
+func (fb *Framebuffer) drawRun(x, y, w, h, i, length int, c color.RGBA) int {
+	for end := min(i+length, w*h); i < end; i++ {
+		fb.img.SetRGBA(x+i%w, y+i/w, c)
+	}
+	return i
+}
+
+// drawImage paints a decoded image (JPEG, PNG) at x, y.
+func (fb *Framebuffer) drawImage(x, y int, img image.Image) {
+	b := img.Bounds()
+	draw.Draw(fb.img, image.Rect(x, y, x+b.Dx(), y+b.Dy()), img, b.Min, draw.Src)
+}
+
+// zlibStreamId identifies one of the zlib streams of a connection.
+type zlibStreamId struct {
+	enc common.EncodingType
+	id  int
+}
+
+// zlibWindowSize is the size of the deflate window: the most data a
+// deflate stream refers back to.
+const zlibWindowSize = 32 * 1024
+
+// zlibStream inflates a zlib stream whose compressed data arrives in
+// chunks, one per rectangle, each ending on a sync flush.
+type zlibStream struct {
+	in     bytes.Buffer
+	header bool
+	r      io.ReadCloser
+
+	// window holds at least the last zlibWindowSize bytes inflated
+	window []byte
+}
+
+// Write appends inflated data to the window of the stream.
+func (z *zlibStream) Write(p []byte) (int, error) {
+	z.window = append(z.window, p...)
+	if len(z.window) > 2*zlibWindowSize {
+		z.window = append(z.window[:0], z.window[len(z.window)-zlibWindowSize:]...)
+	}
+	return len(p), nil
+}
+
+// feed appends the compressed data of a rectangle to the stream, and
+// returns the reader of the inflated data.
+func (z *zlibStream) feed(compressed []byte) (io.Reader, error) {
+	z.in.Write(compressed)
+	if !z.header {
+		// the 2 byte zlib header precedes the deflate data
+		if z.in.Len() < 2 {
+			return nil, errors.New("zlib stream: truncated header")
+		}
+		z.in.Next(2)
+		z.header = true
+		z.r = flate.NewReader(&z.in)
+	}
+	return io.TeeReader(z.r, z), nil
+}
+
+// stream returns the zlib stream of the given encoding and id.
+func (fb *Framebuffer) stream(enc common.EncodingType, id int) *zlibStream {
+	key := zlibStreamId{enc, id}
+	z, ok := fb.streams[key]
+	if !ok {
+		z = &zlibStream{}
+		fb.streams[key] = z
+	}
+	return z
+}
+
+// resetStream discards the state of a zlib stream, as requested by the
+// server for Tight streams.
+func (fb *Framebuffer) resetStream(enc common.EncodingType, id int) {
+	delete(fb.streams, zlibStreamId{enc, id})
+}
+
+// ZlibWindow is the deflate window of one of the zlib streams of a
+// Framebuffer: the data needed to inflate the rest of the stream.
+type ZlibWindow struct {
+	Encoding common.EncodingType
+	Id       int
+	Data     []byte
+}
+
+// ZlibWindows returns the windows of the zlib streams in use. Taken
+// between two updates, they let another Framebuffer decode the updates
+// that follow with SetZlibWindows, without the updates before.
+func (fb *Framebuffer) ZlibWindows() []ZlibWindow {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	var windows []ZlibWindow
+	for key, z := range fb.streams {
+		if !z.header {
+			continue
+		}
+		data := z.window
+		if len(data) > zlibWindowSize {
+			data = data[len(data)-zlibWindowSize:]
+		}
+		windows = append(windows, ZlibWindow{
+			Encoding: key.enc,
+			Id:       key.id,
+			Data:     append([]byte(nil), data...),
+		})
+	}
+	return windows
+}
+
+// SetZlibWindows replaces the zlib streams with streams continuing from
+// the given windows, as returned by ZlibWindows.
+func (fb *Framebuffer) SetZlibWindows(windows []ZlibWindow) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.streams = make(map[zlibStreamId]*zlibStream)
+	for _, w := range windows {
+		// the zlib header was part of the updates before the window
+		z := &zlibStream{header: true, window: append([]byte(nil), w.Data...)}
+		z.r = flate.NewReaderDict(&z.in, z.window)
+		fb.streams[zlibStreamId{w.Encoding, w.Id}] = z
+	}
+}
+
+// readFull reads exactly n bytes from r.
+func readFull(r io.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,250 @@
+package encodings
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image/color"
+	"testing"
+
+	"github.com/borderzero/vncproxy/common"
+)
+
+// testPixelFormat is the 32bpp, 24 bit depth format of most servers.
+var testPixelFormat = common.PixelFormat{
+	BPP: 32, Depth: 24, TrueColor: 1,
+	RedMax: 255, GreenMax: 255, BlueMax: 255,
+	RedShift: 16, GreenShift: 8, BlueShift: 0,
+}
+
+var (
+	red   = color.RGBA{255, 0, 0, 255}
+	green = color.RGBA{0, 255, 0, 255}
+	blue  = color.RGBA{0, 0, 255, 255}
+	white = color.RGBA{255, 255, 255, 255}
+	unset = color.RGBA{}
+)
+
+// pixel returns c as a PIXEL of testPixelFormat.
+func pixel(c color.RGBA) []byte {
+	return []byte{c.B, c.G, c.R, 0}
+}
+
+// cpixel returns c as a CPIXEL of ZRLE in testPixelFormat.
+func cpixel(c color.RGBA) []byte {
+	return []byte{c.B, c.G, c.R}
+}
+
+// tpixel returns c as a TPIXEL of Tight.
+func tpixel(c color.RGBA) []byte {
+	return []byte{c.R, c.G, c.B}
+}
+
+// wire concatenates the parts of the data of a rectangle.
+func wire(parts ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, p := range parts {
+		binary.Write(&buf, binary.BigEndian, p)
+	}
+	return buf.Bytes()
+}
+
+// zlibChunks compresses each chunk as a part of the same zlib stream,
+// ending on a sync flush, as servers do for each rectangle.
+func zlibChunks(t *testing.T, chunks ...[]byte) [][]byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	var compressed [][]byte
+	for _, chunk := range chunks {
+		w.Write(chunk)
+		if err := w.Flush(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		compressed = append(compressed, append([]byte(nil), buf.Bytes()...))
+		buf.Reset()
+	}
+	return compressed
+}
+
+// compactLen returns the 1 to 3 byte length of Tight.
+func compactLen(n int) []byte {
+	switch {
+	case n < 1<<7:
+		return []byte{byte(n)}
+	case n < 1<<14:
+		return []byte{byte(n) | 0x80, byte(n >> 7)}
+	}
+	return []byte{byte(n) | 0x80, byte(n>>7) | 0x80, byte(n >> 14)}
+}
+
+// update reads a rectangle of encoding enc from its wire data, and
+// decodes it into fb.
+func update(t *testing.T, fb *Framebuffer, enc common.IEncoding, x, y, w, h uint16, data []byte) {
+	t.Helper()
+	rect := common.Rectangle{X: x, Y: y, Width: w, Height: h}
+	r := common.NewRfbReadHelper(bytes.NewReader(data))
+	decoded, err := enc.Read(&testPixelFormat, &rect, r)
+	if err != nil {
+		t.Fatalf("error reading the %T rectangle: %s", enc, err)
+	}
+	rect.Enc = decoded
+	if err := fb.Update([]common.Rectangle{rect}); err != nil {
+		t.Fatalf("error decoding the %T rectangle: %s", enc, err)
+	}
+}
+
+// checkPixels compares the framebuffer to rows of colors.
+func checkPixels(t *testing.T, fb *Framebuffer, rows ...[]color.RGBA) {
+	t.Helper()
+	img := fb.Image()
+	for y, row := range rows {
+		for x, want := range row {
+			if got := img.RGBAAt(x, y); got != want {
+				t.Errorf("pixel %d,%d: expected %v, got %v", x, y, want, got)
+			}
+		}
+	}
+}
+
+func TestDecodeRaw(t *testing.T) {
+	fb := NewFramebuffer(2, 2, &testPixelFormat)
+	update(t, fb, &RawEncoding{}, 0, 0, 2, 2, bytes.Join([][]byte{pixel(red), pixel(green), pixel(blue), pixel(white)}, nil))
+	checkPixels(t, fb,
+		[]color.RGBA{red, green},
+		[]color.RGBA{blue, white},
+	)
+}
+
+func TestDecodeRRE(t *testing.T) {
+	fb := NewFramebuffer(4, 3, &testPixelFormat)
+	// a red background with a blue 2x2 subrectangle at 1,1 of a
+	// rectangle at 0,1
+	update(t, fb, &RREEncoding{}, 0, 1, 4, 2, wire(
+		uint32(1), pixel(red),
+		pixel(blue), uint16(1), uint16(0), uint16(2), uint16(2),
+	))
+	checkPixels(t, fb,
+		[]color.RGBA{unset, unset, unset, unset},
+		[]color.RGBA{red, blue, blue, red},
+		[]color.RGBA{red, blue, blue, red},
+	)
+}
+
+func TestDecodeCoRRE(t *testing.T) {
+	fb := NewFramebuffer(4, 2, &testPixelFormat)
+	update(t, fb, &CoRREEncoding{}, 0, 0, 4, 2, wire(
+		uint32(2), pixel(white),
+		pixel(green), uint8(0), uint8(0), uint8(1), uint8(2),
+		pixel(blue), uint8(3), uint8(1), uint8(1), uint8(1),
+	))
+	checkPixels(t, fb,
+		[]color.RGBA{green, white, white, white},
+		[]color.RGBA{green, white, white, blue},
+	)
+}
+
+func TestDecodeHextile(t *testing.T) {
+	fb := NewFramebuffer(18, 2, &testPixelFormat)
+	// a 16x2 tile with a red background and a subrectangle in
+	// the foreground color, then a raw 2x2 tile
+	update(t, fb, &HextileEncoding{}, 0, 0, 18, 2, wire(
+		uint8(HextileBackgroundSpecified|HextileForegroundSpecified|HextileAnySubrects),
+		pixel(red), pixel(blue), uint8(1),
+		uint8(1<<4|0), uint8(1<<4|1),
+		uint8(HextileRaw), pixel(green), pixel(white), pixel(white), pixel(green),
+	))
+	checkPixels(t, fb,
+		[]color.RGBA{red, blue, blue, red},
+		[]color.RGBA{red, blue, blue, red},
+	)
+	img := fb.Image()
+	for _, p := range []struct {
+		x, y int
+		want color.RGBA
+	}{{15, 1, red}, {16, 0, green}, {17, 0, white}, {16, 1, white}, {17, 1, green}} {
+		if got := img.RGBAAt(p.x, p.y); got != p.want {
+			t.Errorf("pixel %d,%d: expected %v, got %v", p.x, p.y, p.want, got)
+		}
+	}
+
+	// tiles without a background reuse the one of the previous tile
+	update(t, fb, &HextileEncoding{}, 0, 0, 18, 1, wire(uint8(HextileBackgroundSpecified), pixel(white), uint8(0)))
+	checkPixels(t, fb, []color.RGBA{white, white}, []color.RGBA{red, blue})
+	if got := fb.Image().RGBAAt(17, 0); got != white {
+		t.Errorf("pixel 17,0: expected %v, got %v", white, got)
+	}
+}
+
+func TestDecodeZRLE(t *testing.T) {
+	fb := NewFramebuffer(4, 2, &testPixelFormat)
+	chunks := zlibChunks(t,
+		// plain RLE: a run of 3 red pixels and 5 blue ones
+		wire(uint8(128), cpixel(red), uint8(2), cpixel(blue), uint8(4)),
+		// solid
+		wire(uint8(1), cpixel(green)),
+		// palette RLE: white, then a run of 2 red pixels
+		wire(uint8(128|2), cpixel(white), cpixel(red), uint8(0), uint8(128|1), uint8(1)),
+	)
+	update(t, fb, &ZRLEEncoding{}, 0, 0, 4, 2, wire(uint32(len(chunks[0])), chunks[0]))
+	checkPixels(t, fb,
+		[]color.RGBA{red, red, red, blue},
+		[]color.RGBA{blue, blue, blue, blue},
+	)
+
+	// the zlib stream goes on in the next rectangles
+	update(t, fb, &ZRLEEncoding{}, 2, 0, 2, 2, wire(uint32(len(chunks[1])), chunks[1]))
+	update(t, fb, &ZRLEEncoding{}, 0, 1, 3, 1, wire(uint32(len(chunks[2])), chunks[2]))
+	checkPixels(t, fb,
+		[]color.RGBA{red, red, green, green},
+		[]color.RGBA{white, red, red, green},
+	)
+}
+
+func TestDecodeTight(t *testing.T) {
+	fb := NewFramebuffer(4, 2, &testPixelFormat)
+
+	// fill
+	update(t, fb, &TightEncoding{}, 0, 0, 4, 2, wire(uint8(TightFill<<4), tpixel(green)))
+	checkPixels(t, fb,
+		[]color.RGBA{green, green, green, green},
+		[]color.RGBA{green, green, green, green},
+	)
+
+	// two color palette on stream 1, too short to be compressed
+	update(t, fb, &TightEncoding{}, 0, 0, 4, 2, wire(
+		uint8((TightExplicitFilter|1)<<4), uint8(TightFilterPalette), uint8(1), tpixel(red), tpixel(blue),
+		uint8(0b1010_0000), uint8(0b0101_0000),
+	))
+	checkPixels(t, fb,
+		[]color.RGBA{blue, red, blue, red},
+		[]color.RGBA{red, blue, red, blue},
+	)
+
+	// basic filter on stream 0, compressed
+	pixels := bytes.Join([][]byte{
+		tpixel(white), tpixel(red), tpixel(green), tpixel(blue),
+		tpixel(blue), tpixel(green), tpixel(red), tpixel(white),
+	}, nil)
+	chunks := zlibChunks(t, pixels)
+	update(t, fb, &TightEncoding{}, 0, 0, 4, 2, wire(uint8(0), compactLen(len(chunks[0])), chunks[0]))
+	checkPixels(t, fb,
+		[]color.RGBA{white, red, green, blue},
+		[]color.RGBA{blue, green, red, white},
+	)
+
+	// the server resets stream 0, and starts a new zlib stream
+	chunks = zlibChunks(t, bytes.Repeat(tpixel(red), 8))
+	update(t, fb, &TightEncoding{}, 0, 0, 4, 2, wire(uint8(0x01), compactLen(len(chunks[0])), chunks[0]))
+	checkPixels(t, fb,
+		[]color.RGBA{red, red, red, red},
+		[]color.RGBA{red, red, red, red},
+	)
+}
+
+func TestDecodeShortData(t *testing.T) {
+	fb := NewFramebuffer(4, 2, &testPixelFormat)
+	rect := common.Rectangle{Width: 4, Height: 2, Enc: &RawEncoding{bytes: pixel(red)}}
+	if err := fb.Update([]common.Rectangle{rect}); err == nil {
+		t.Fatal("error expected")
+	}
+}
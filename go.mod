@@ -2,9 +2,11 @@ module github.com/borderzero/vncproxy
 
 go 1.22.0
 
-require golang.org/x/net v0.22.0
-
 require (
-	go.uber.org/multierr v1.11.0 // indirect
-	go.uber.org/zap v1.27.0 // indirect
+	go.uber.org/zap v1.27.0
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.22.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require go.uber.org/multierr v1.11.0 // indirect
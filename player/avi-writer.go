@@ -0,0 +1,184 @@
+package player
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+)
+
+// aviHeaderSize is the size of the RIFF, hdrl and movi list headers
+// that precede the frames of the file.
+const aviHeaderSize = 12 + 8 + 192 + 12
+
+// aviWriter writes the frames to a Motion JPEG AVI file. The headers
+// need the frame count, so they are written last, over the space left
+// for them at the start of the file.
+type aviWriter struct {
+	f       *os.File
+	size    image.Rectangle
+	fps     float64
+	quality int
+
+	// encoded is the last frame, written again for unchanged frames
+	encoded  []byte
+	index    bytes.Buffer
+	frames   uint32
+	moviSize uint32
+	maxFrame uint32
+}
+
+func newAviWriter(path string, size image.Rectangle, fps float64, quality int) (*aviWriter, error) {
+	if quality == 0 {
+		quality = jpeg.DefaultQuality
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create avi: %v", err)
+	}
+	if _, err := f.Seek(aviHeaderSize, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write avi: %v", err)
+	}
+	return &aviWriter{f: f, size: size, fps: fps, quality: quality, moviSize: 4}, nil
+}
+
+func (w *aviWriter) WriteFrame(img *image.RGBA, changed bool) error {
+	if changed || w.encoded == nil {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: w.quality}); err != nil {
+			return fmt.Errorf("failed to encode avi frame: %v", err)
+		}
+		w.encoded = buf.Bytes()
+	}
+
+	size := uint32(len(w.encoded))
+	chunk := make([]byte, 8, 8+len(w.encoded)+1)
+	copy(chunk, "00dc")
+	binary.LittleEndian.PutUint32(chunk[4:], size)
+	chunk = append(chunk, w.encoded...)
+	if len(chunk)%2 != 0 {
+		// chunks are word aligned
+		chunk = append(chunk, 0)
+	}
+	if _, err := w.f.Write(chunk); err != nil {
+		return fmt.Errorf("failed to write avi frame: %v", err)
+	}
+
+	// index offsets are relative to the "movi" list type
+	w.index.WriteString("00dc")
+	binary.Write(&w.index, binary.LittleEndian, []uint32{0x10, w.moviSize, size})
+	w.moviSize += uint32(len(chunk))
+	w.frames++
+	w.maxFrame = max(w.maxFrame, size)
+	return nil
+}
+
+func (w *aviWriter) Close() error {
+	err := w.finish()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write avi: %v", err)
+	}
+	return nil
+}
+
+func (w *aviWriter) Remove() error {
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+func (w *aviWriter) finish() error {
+	var idx bytes.Buffer
+	idx.WriteString("idx1")
+	binary.Write(&idx, binary.LittleEndian, uint32(w.index.Len()))
+	idx.Write(w.index.Bytes())
+	if _, err := w.f.Write(idx.Bytes()); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.f.Write(w.header(uint32(idx.Len())))
+	return err
+}
+
+// header returns the RIFF header, the hdrl list and the start of the
+// movi list.
+func (w *aviWriter) header(indexSize uint32) []byte {
+	width, height := uint32(w.size.Dx()), uint32(w.size.Dy())
+	le := func(buf *bytes.Buffer, values ...any) {
+		for _, v := range values {
+			binary.Write(buf, binary.LittleEndian, v)
+		}
+	}
+
+	var h bytes.Buffer
+	h.WriteString("RIFF")
+	le(&h, uint32(aviHeaderSize-8+w.moviSize-4+indexSize))
+	h.WriteString("AVI ")
+
+	h.WriteString("LIST")
+	le(&h, uint32(192))
+	h.WriteString("hdrl")
+
+	// MainAVIHeader
+	h.WriteString("avih")
+	le(&h, uint32(56),
+		uint32(math.Round(1e6/w.fps)), // microseconds per frame
+		uint32(float64(w.maxFrame)*w.fps),
+		uint32(0),    // padding granularity
+		uint32(0x10), // AVIF_HASINDEX
+		w.frames,
+		uint32(0), // initial frames
+		uint32(1), // streams
+		w.maxFrame,
+		width, height,
+		[4]uint32{},
+	)
+
+	h.WriteString("LIST")
+	le(&h, uint32(116))
+	h.WriteString("strl")
+
+	// AVIStreamHeader
+	h.WriteString("strh")
+	le(&h, uint32(56))
+	h.WriteString("vidsMJPG")
+	le(&h,
+		uint32(0), // flags
+		uint16(0), // priority
+		uint16(0), // language
+		uint32(0), // initial frames
+		uint32(1000),
+		uint32(math.Round(w.fps*1000)), // rate / scale is the frame rate
+		uint32(0),                      // start
+		w.frames,
+		w.maxFrame,
+		uint32(math.MaxUint32), // default quality
+		uint32(0),              // sample size
+		[4]int16{0, 0, int16(width), int16(height)},
+	)
+
+	// BITMAPINFOHEADER
+	h.WriteString("strf")
+	le(&h, uint32(40),
+		uint32(40),
+		int32(width), int32(height),
+		uint16(1),  // planes
+		uint16(24), // bit count
+	)
+	h.WriteString("MJPG")
+	le(&h, width*height*3, [4]uint32{})
+
+	h.WriteString("LIST")
+	le(&h, w.moviSize)
+	h.WriteString("movi")
+	return h.Bytes()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/borderzero/vncproxy/player"
+	"go.uber.org/zap"
+)
+
+var VERSION = "dev"
+
+func main() {
+	listen := flag.String("listen", ":5900", "address to serve the recording on")
+	file := flag.String("file", "", "path of the .rbs recording to play")
+	password := flag.String("password", "", "password required of vnc-clients (none if empty)")
+	speed := flag.Float64("speed", 1, "playback speed, 1 being the original speed")
+	start := flag.Duration("start", 0, "time into the recording to start the playback at")
+	export := flag.String("export", "", "export the recording to this path instead of serving it")
+	format := flag.String("format", "", "export format: avi, gif or png (a directory of frames), guessed from -export if empty")
+	pointer := flag.Bool("pointer", false, "draw the pointer trail over the export, from the recorded input events")
+	fps := flag.Float64("fps", player.DefaultExportFPS, "frames per second of the export")
+	version := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(VERSION)
+		return
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "missing -file")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create logger: %v\n", err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+
+	if *export != "" {
+		opts := &player.ExportOptions{FPS: *fps, ShowPointer: *pointer, Logger: logger}
+		if opts.Format, err = exportFormat(*format, *export); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err := player.Export(*file, *export, opts); err != nil {
+			logger.Fatal("export failed", zap.Error(err))
+		}
+		logger.Info("exported recording", zap.String("file", *file), zap.String("export", *export), zap.Stringer("format", opts.Format))
+		return
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		logger.Fatal("failed to listen", zap.String("address", *listen), zap.Error(err))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	p := &player.Player{
+		Listener:      ln,
+		RecordingPath: *file,
+		Speed:         *speed,
+		Password:      *password,
+		Start:         *start,
+	}
+	logger.Info("serving recording", zap.String("file", *file), zap.String("address", ln.Addr().String()))
+	if err := p.Serve(ctx, logger); err != nil && ctx.Err() == nil {
+		logger.Fatal("player stopped", zap.Error(err))
+	}
+}
+
+// exportFormat parses the -format flag, or guesses the format from the
+// extension of the export path.
+func exportFormat(format, path string) (player.ExportFormat, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".avi":
+			return player.ExportAVI, nil
+		case ".gif":
+			return player.ExportGIF, nil
+		}
+		return player.ExportPNG, nil
+	}
+	for _, f := range []player.ExportFormat{player.ExportAVI, player.ExportGIF, player.ExportPNG} {
+		if strings.EqualFold(format, f.String()) {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown export format %q", format)
+}
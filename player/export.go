@@ -0,0 +1,308 @@
+package player
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+	"time"
+
+	"github.com/borderzero/vncproxy/client"
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/encodings"
+	"go.uber.org/zap"
+)
+
+// ExportFormat is the output format of Export.
+type ExportFormat int
+
+const (
+	// ExportAVI writes a Motion JPEG AVI file.
+	ExportAVI ExportFormat = iota
+	// ExportGIF writes an animated GIF file. Its frames are kept in
+	// memory until the export ends, so long exports fail once they hold
+	// 1 GiB of frames.
+	ExportGIF
+	// ExportPNG writes a numbered sequence of PNG files to a directory.
+	ExportPNG
+)
+
+func (f ExportFormat) String() string {
+	switch f {
+	case ExportAVI:
+		return "avi"
+	case ExportGIF:
+		return "gif"
+	case ExportPNG:
+		return "png"
+	}
+	return fmt.Sprintf("ExportFormat(%d)", int(f))
+}
+
+// DefaultExportFPS is the frame rate of exports without ExportOptions.FPS.
+const DefaultExportFPS = 10
+
+// ExportOptions configures Export.
+type ExportOptions struct {
+	Format ExportFormat
+
+	// FPS is the number of frames sampled per second of recording;
+	// zero means DefaultExportFPS. GIF frame delays are in hundredths of
+	// a second, so GIF exports are limited to 100 frames per second.
+	FPS float64
+
+	// JPEGQuality is the quality of the frames of ExportAVI, from 1 to
+	// 100; zero means jpeg.DefaultQuality.
+	JPEGQuality int
+
+	// ShowPointer draws the pointer and its recent trail over the
+	// frames. It requires the input events of the recording, see
+	// recorder.RecorderOptions.RecordInput.
+	ShowPointer bool
+
+	// Logger, if set, gets the desktop resizes, which the frames are
+	// cropped or padded to hide.
+	Logger *zap.Logger
+}
+
+// frameWriter writes the sampled frames of an export. changed reports
+// whether img differs from the previous frame. Remove closes the writer,
+// if it is not yet, and removes what it wrote.
+type frameWriter interface {
+	WriteFrame(img *image.RGBA, changed bool) error
+	Close() error
+	Remove() error
+}
+
+// Export replays the recording at recordingPath through a decoded
+// framebuffer, and writes the desktop sampled at opts.FPS to out: a file
+// for ExportAVI and ExportGIF, a directory for ExportPNG.
+//
+// Frames are sized as the desktop at the start of the recording; later
+// desktop resizes are cropped or padded with black. The partial output
+// is removed if the export fails.
+func Export(recordingPath, out string, opts *ExportOptions) (err error) {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	fps := opts.FPS
+	if fps == 0 {
+		fps = DefaultExportFPS
+	}
+	if fps < 0 || (opts.Format == ExportGIF && fps > 100) {
+		return fmt.Errorf("invalid frame rate %v for a %s export", fps, opts.Format)
+	}
+	interval := time.Duration(float64(time.Second) / fps)
+
+	f, err := os.Open(recordingPath)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %v", err)
+	}
+	defer f.Close()
+	dec, err := newRecordingDecoder(f)
+	if err != nil {
+		return err
+	}
+	canvas := image.NewRGBA(dec.fb.Bounds())
+
+	var pointer *pointerTrail
+	frame := canvas
+	if opts.ShowPointer {
+		if pointer, err = newPointerTrail(recordingPath, dec.base); err != nil {
+			return err
+		}
+		frame = image.NewRGBA(canvas.Bounds())
+	}
+
+	var w frameWriter
+	switch opts.Format {
+	case ExportAVI:
+		w, err = newAviWriter(out, canvas.Bounds(), fps, opts.JPEGQuality)
+	case ExportGIF:
+		w, err = newGifWriter(out, interval)
+	case ExportPNG:
+		w, err = newPngWriter(out)
+	default:
+		err = fmt.Errorf("unknown export format %d", opts.Format)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			w.Remove()
+		}
+	}()
+
+	// frames at time t show the desktop once the messages received up
+	// to t are applied
+	size := canvas.Bounds()
+	changed := true
+	var next time.Duration
+	writeFrame := func() error {
+		if changed {
+			draw.Draw(canvas, canvas.Bounds(), image.Black, image.Point{}, draw.Src)
+			draw.Draw(canvas, canvas.Bounds(), dec.fb.Image(), image.Point{}, draw.Src)
+		}
+		if pointer != nil && (pointer.advance(next) || changed) {
+			copy(frame.Pix, canvas.Pix)
+			pointer.draw(frame)
+			changed = true
+		}
+		err := w.WriteFrame(frame, changed)
+		changed = false
+		return err
+	}
+
+	for {
+		msg, at, err := dec.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		for ; next < at; next += interval {
+			if err := writeFrame(); err != nil {
+				return err
+			}
+		}
+		updated, err := dec.apply(msg)
+		if err != nil {
+			return fmt.Errorf("failed to decode the recording at %v: %v", at, err)
+		}
+		changed = changed || updated
+		if bounds := dec.fb.Bounds(); bounds != size {
+			size = bounds
+			logger.Warn("desktop resized, the exported frames are cropped or padded",
+				zap.Duration("at", at), zap.Int("width", size.Dx()), zap.Int("height", size.Dy()),
+				zap.Int("frame_width", canvas.Bounds().Dx()), zap.Int("frame_height", canvas.Bounds().Dy()))
+		}
+	}
+	if err := writeFrame(); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// recordingConn stands for the connection a recording was made on, to
+// parse its server messages.
+type recordingConn struct {
+	pf common.PixelFormat
+}
+
+func (c *recordingConn) CurrentPixelFormat() *common.PixelFormat {
+	return &c.pf
+}
+
+func (c *recordingConn) Encodings() []common.IEncoding {
+	return recordingEncodings
+}
+
+// recordingEncodings are the encodings a recording may contain.
+var recordingEncodings = []common.IEncoding{
+	&encodings.RawEncoding{},
+	&encodings.TightEncoding{},
+	&encodings.EncCursorPseudo{},
+	&encodings.EncLedStatePseudo{},
+	&encodings.TightPngEncoding{},
+	&encodings.RREEncoding{},
+	&encodings.ZLibEncoding{},
+	&encodings.ZRLEEncoding{},
+	&encodings.CopyRectEncoding{},
+	&encodings.CoRREEncoding{},
+	&encodings.HextileEncoding{},
+	&encodings.EncDesktopNamePseudo{},
+	&encodings.PseudoEncoding{Typ: int32(common.EncDesktopSizePseudo)},
+}
+
+// recordingDecoder parses the server messages of a recording, and keeps
+// the framebuffer they draw.
+type recordingDecoder struct {
+	fbs    *FbsReader
+	reader *common.RfbReadHelper
+	conn   *recordingConn
+	fb     *encodings.Framebuffer
+	base   time.Duration
+	types  map[uint8]common.ServerMessage
+
+	// pending is a message read ahead by seek
+	pending   common.ServerMessage
+	pendingAt time.Duration
+}
+
+func newRecordingDecoder(r io.Reader) (*recordingDecoder, error) {
+	fbs, err := NewFbsReader(r)
+	if err != nil {
+		return nil, err
+	}
+	init, err := fbs.ReadStartSession()
+	if err != nil {
+		return nil, err
+	}
+	d := &recordingDecoder{
+		fbs:    fbs,
+		reader: common.NewRfbReadHelper(fbs),
+		conn:   &recordingConn{pf: init.PixelFormat},
+		fb:     encodings.NewFramebufferFromServerInit(init),
+		// the recording starts with the handshake, not when the recorder was created
+		base:  fbs.Timestamp(),
+		types: make(map[uint8]common.ServerMessage),
+	}
+	for _, msg := range []common.ServerMessage{
+		new(client.MsgFramebufferUpdate),
+		new(client.MsgSetColorMapEntries),
+		new(client.MsgBell),
+		new(client.MsgServerCutText),
+		new(client.MsgServerFence),
+	} {
+		d.types[msg.Type()] = msg
+	}
+	return d, nil
+}
+
+// next parses the next server message, and returns it with the time it
+// was received at, relative to the start of the recording. It returns
+// io.EOF at the end of the recording.
+func (d *recordingDecoder) next() (common.ServerMessage, time.Duration, error) {
+	if d.pending != nil {
+		msg := d.pending
+		d.pending = nil
+		return msg, d.pendingAt, nil
+	}
+	var messageType [1]byte
+	if _, err := io.ReadFull(d.fbs, messageType[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, fmt.Errorf("failed to read message type: %v", err)
+	}
+	msg, ok := d.types[messageType[0]]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown server message type %d in recording", messageType[0])
+	}
+	parsed, err := msg.Read(d.conn, d.reader)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to parse %T: %v", msg, err)
+	}
+	return parsed, d.fbs.Timestamp() - d.base, nil
+}
+
+// apply draws a server message into the framebuffer, and reports
+// whether it changed the desktop.
+func (d *recordingDecoder) apply(msg common.ServerMessage) (bool, error) {
+	switch msg := msg.(type) {
+	case *client.MsgFramebufferUpdate:
+		return true, d.fb.Update(msg.Rectangles)
+	case *client.MsgSetColorMapEntries:
+		d.fb.SetColorMapEntries(msg.FirstColor, msg.Colors)
+		return true, nil
+	}
+	return false, nil
+}
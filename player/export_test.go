@@ -0,0 +1,91 @@
+package player
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// desktopSize returns a framebuffer update resizing the desktop.
+func desktopSize(width, height byte) []byte {
+	return []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, width, 0, height, 0xff, 0xff, 0xff, 0x21}
+}
+
+func TestExport_RemovesPartialOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "corrupt.rbs")
+	msgs := updates(4)
+	record(t, path, msgs)
+
+	// the third message is of an unknown type
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	i := bytes.Index(data, msgs[2])
+	if i < 0 {
+		t.Fatal("message not found in the recording")
+	}
+	data[i] = 0x7f
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// the png directory already holds another file, which is kept
+	pngDir := filepath.Join(dir, "frames")
+	other := filepath.Join(pngDir, "notes.txt")
+	if err := os.Mkdir(pngDir, 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := os.WriteFile(other, nil, 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for _, tt := range []struct {
+		format ExportFormat
+		out    string
+	}{
+		{ExportAVI, filepath.Join(dir, "out.avi")},
+		{ExportGIF, filepath.Join(dir, "out.gif")},
+		{ExportPNG, pngDir},
+	} {
+		if err := Export(path, tt.out, &ExportOptions{Format: tt.format, FPS: 1000}); err == nil {
+			t.Fatalf("%s: expected an error", tt.format)
+		}
+		if tt.format == ExportPNG {
+			entries, err := os.ReadDir(pngDir)
+			if err != nil || len(entries) != 1 || entries[0].Name() != "notes.txt" {
+				t.Errorf("%s: expected only the frames to be removed, got %v, %v", tt.format, entries, err)
+			}
+			continue
+		}
+		if _, err := os.Stat(tt.out); !os.IsNotExist(err) {
+			t.Errorf("%s: expected the output to be removed, got %v", tt.format, err)
+		}
+	}
+}
+
+func TestExport_LogsResizes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "resized.rbs")
+	record(t, path, append(updates(1), desktopSize(16, 4), desktopSize(16, 4)))
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	out := filepath.Join(dir, "frames")
+	if err := Export(path, out, &ExportOptions{Format: ExportPNG, Logger: zap.New(core)}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the second message keeps the size, and is not logged
+	entries := logs.All()
+	if len(entries) != 1 || entries[0].ContextMap()["width"] != int64(16) || entries[0].ContextMap()["frame_width"] != int64(8) {
+		t.Fatalf("unexpected logs %+v", entries)
+	}
+	if frames, err := os.ReadDir(out); err != nil || len(frames) == 0 {
+		t.Fatalf("expected the frames to be exported, got %v, %v", frames, err)
+	}
+}
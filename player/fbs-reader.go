@@ -0,0 +1,148 @@
+package player
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/recorder"
+	"github.com/borderzero/vncproxy/server"
+)
+
+const fbsHeader = "FBS 001.000\n"
+
+// FbsBlock is a block of server data of a FBS file, stamped with the
+// time it was received, relative to the start of the recording.
+type FbsBlock struct {
+	Data      []byte
+	Timestamp time.Duration
+}
+
+// FbsReader reads the FBS 001.000 files written by recorder.Recorder:
+// a header line, followed by blocks of
+// [data length uint32][data, padded to 4 bytes][timestamp in ms uint32].
+//
+// It can be used block by block with ReadBlock, or as an io.Reader of
+// the recorded server data.
+type FbsReader struct {
+	r       *bufio.Reader
+	current FbsBlock
+}
+
+// NewFbsReader checks the FBS header of r and returns a reader for its blocks.
+func NewFbsReader(r io.Reader) (*FbsReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(fbsHeader))
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("failed to read fbs header: %v", err)
+	}
+	if recorder.IsEncrypted(header) {
+		return nil, fmt.Errorf("recording: %w", recorder.ErrEncrypted)
+	}
+	if string(header) != fbsHeader {
+		return nil, fmt.Errorf("not a fbs file, bad header: %q", header)
+	}
+	return &FbsReader{r: br}, nil
+}
+
+// newFbsBlockReader returns a reader for the blocks of r, positioned at
+// the start of a block of a FBS file.
+func newFbsBlockReader(r io.Reader) *FbsReader {
+	return &FbsReader{r: bufio.NewReader(r)}
+}
+
+// ReadBlock returns the rest of the current block, or the next block if
+// the current one was consumed. It returns io.EOF at the end of the file.
+func (f *FbsReader) ReadBlock() (*FbsBlock, error) {
+	if len(f.current.Data) > 0 {
+		block := f.current
+		f.current.Data = nil
+		return &block, nil
+	}
+
+	var length uint32
+	if err := binary.Read(f.r, binary.BigEndian, &length); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to read fbs block length: %v", err)
+	}
+	padded := (length + 3) &^ 3
+	data := make([]byte, padded)
+	if _, err := io.ReadFull(f.r, data); err != nil {
+		return nil, fmt.Errorf("failed to read fbs block data: %v", err)
+	}
+	var timestamp uint32
+	if err := binary.Read(f.r, binary.BigEndian, &timestamp); err != nil {
+		return nil, fmt.Errorf("failed to read fbs block timestamp: %v", err)
+	}
+	block := FbsBlock{Data: data[:length], Timestamp: time.Duration(timestamp) * time.Millisecond}
+	f.current.Timestamp = block.Timestamp
+	return &block, nil
+}
+
+// Read reads the recorded server data, across block boundaries.
+func (f *FbsReader) Read(p []byte) (int, error) {
+	for len(f.current.Data) == 0 {
+		block, err := f.ReadBlock()
+		if err != nil {
+			return 0, err
+		}
+		f.current = *block
+	}
+	n := copy(p, f.current.Data)
+	f.current.Data = f.current.Data[n:]
+	return n, nil
+}
+
+// Timestamp returns the timestamp of the block last read from.
+func (f *FbsReader) Timestamp() time.Duration {
+	return f.current.Timestamp
+}
+
+// ReadStartSession reads the server side of the RFB 3.3 handshake that
+// opens a recording, and returns its ServerInit message.
+func (f *FbsReader) ReadStartSession() (*common.ServerInit, error) {
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(f, version); err != nil {
+		return nil, fmt.Errorf("failed to read rfb version: %v", err)
+	}
+	if string(version) != "RFB 003.003\n" {
+		return nil, fmt.Errorf("unsupported rfb version in recording: %q", version)
+	}
+
+	var secType uint32
+	if err := binary.Read(f, binary.BigEndian, &secType); err != nil {
+		return nil, fmt.Errorf("failed to read security type: %v", err)
+	}
+	if secType != uint32(server.SecTypeNone) {
+		return nil, fmt.Errorf("unsupported security type in recording: %d", secType)
+	}
+
+	init := &common.ServerInit{}
+	if err := binary.Read(f, binary.BigEndian, &init.FBWidth); err != nil {
+		return nil, fmt.Errorf("failed to read framebuffer width: %v", err)
+	}
+	if err := binary.Read(f, binary.BigEndian, &init.FBHeight); err != nil {
+		return nil, fmt.Errorf("failed to read framebuffer height: %v", err)
+	}
+	if err := binary.Read(f, binary.BigEndian, &init.PixelFormat); err != nil {
+		return nil, fmt.Errorf("failed to read pixel format: %v", err)
+	}
+	var padding [3]byte
+	if _, err := io.ReadFull(f, padding[:]); err != nil {
+		return nil, fmt.Errorf("failed to read pixel format: %v", err)
+	}
+	if err := binary.Read(f, binary.BigEndian, &init.NameLength); err != nil {
+		return nil, fmt.Errorf("failed to read desktop name: %v", err)
+	}
+	init.NameText = make([]byte, init.NameLength)
+	if _, err := io.ReadFull(f, init.NameText); err != nil {
+		return nil, fmt.Errorf("failed to read desktop name: %v", err)
+	}
+	return init, nil
+}
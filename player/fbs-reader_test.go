@@ -0,0 +1,50 @@
+package player
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/borderzero/vncproxy/recorder"
+)
+
+func TestFbsReader(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(fbsHeader)
+	for i, data := range []string{"first", "second"} {
+		binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+		buf.WriteString(data)
+		buf.Write(make([]byte, (len(data)+3)&^3-len(data)))
+		binary.Write(&buf, binary.BigEndian, uint32(1000*(i+1)))
+	}
+
+	r, err := NewFbsReader(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	block, err := r.ReadBlock()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(block.Data) != "first" || block.Timestamp != time.Second {
+		t.Fatalf("unexpected block %q at %v", block.Data, block.Timestamp)
+	}
+	// the blocks are also read as a stream of server data
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(rest) != "second" {
+		t.Fatalf("unexpected data %q", rest)
+	}
+}
+
+func TestFbsReader_Encrypted(t *testing.T) {
+	_, err := NewFbsReader(bytes.NewReader([]byte("RBSENC01\x00\x01\x00\x00\x00")))
+	if !errors.Is(err, recorder.ErrEncrypted) {
+		t.Fatalf("expected %v, got %v", recorder.ErrEncrypted, err)
+	}
+}
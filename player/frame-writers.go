@@ -0,0 +1,136 @@
+package player
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pngWriter writes each frame to a numbered PNG file of a directory.
+type pngWriter struct {
+	dir     string
+	n       int
+	encoded []byte
+}
+
+func newPngWriter(dir string) (*pngWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create png directory: %v", err)
+	}
+	return &pngWriter{dir: dir}, nil
+}
+
+// frameName returns the path of the n-th frame, from 1.
+func (w *pngWriter) frameName(n int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("frame%06d.png", n))
+}
+
+func (w *pngWriter) WriteFrame(img *image.RGBA, changed bool) error {
+	if changed || w.encoded == nil {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return fmt.Errorf("failed to encode png frame: %v", err)
+		}
+		w.encoded = buf.Bytes()
+	}
+	w.n++
+	if err := os.WriteFile(w.frameName(w.n), w.encoded, 0644); err != nil {
+		return fmt.Errorf("failed to write png frame: %v", err)
+	}
+	return nil
+}
+
+func (w *pngWriter) Close() error {
+	return nil
+}
+
+// Remove removes the frames, and the directory unless it holds other
+// files.
+func (w *pngWriter) Remove() error {
+	for n := 1; n <= w.n; n++ {
+		if err := os.Remove(w.frameName(n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	os.Remove(w.dir)
+	return nil
+}
+
+// maxGifFrameBytes bounds the memory held by the frames of a GIF, which
+// are all encoded when the export ends.
+const maxGifFrameBytes = 1 << 30
+
+// errGifTooLarge fails GIF exports with too many changed frames.
+var errGifTooLarge = fmt.Errorf("the gif export holds its frames in memory and exceeds %d MiB, lower the frame rate or export to avi or png", maxGifFrameBytes>>20)
+
+// gifWriter writes the frames to an animated GIF. Unchanged frames
+// extend the delay of the previous one instead of being repeated. The
+// frames are kept in memory, up to maxGifFrameBytes, the file being
+// removed if they exceed it.
+type gifWriter struct {
+	f        *os.File
+	interval time.Duration
+	anim     gif.GIF
+	// size is the memory held by the frames, limit its bound
+	size    int
+	limit   int
+	failed  bool
+	elapsed time.Duration
+}
+
+func newGifWriter(path string, interval time.Duration) (*gifWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gif: %v", err)
+	}
+	return &gifWriter{f: f, interval: interval, limit: maxGifFrameBytes}, nil
+}
+
+func (w *gifWriter) WriteFrame(img *image.RGBA, changed bool) error {
+	if changed || len(w.anim.Image) == 0 {
+		if w.size += len(img.Pix) / 4; w.size > w.limit {
+			w.failed = true
+			return errGifTooLarge
+		}
+		frame := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(frame, img.Bounds(), img, img.Bounds().Min)
+		w.anim.Image = append(w.anim.Image, frame)
+		w.anim.Delay = append(w.anim.Delay, 0)
+	}
+	// delays are in hundredths of a second, rounded so they do not drift
+	last := len(w.anim.Delay) - 1
+	before := w.elapsed.Round(10 * time.Millisecond)
+	w.elapsed += w.interval
+	w.anim.Delay[last] += int((w.elapsed.Round(10*time.Millisecond) - before) / (10 * time.Millisecond))
+	return nil
+}
+
+func (w *gifWriter) Remove() error {
+	w.f.Close()
+	if err := os.Remove(w.f.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (w *gifWriter) Close() error {
+	if w.failed {
+		w.f.Close()
+		return os.Remove(w.f.Name())
+	}
+	err := gif.EncodeAll(w.f, &w.anim)
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write gif: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package player
+
+import (
+	"errors"
+	"image"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGifWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.gif")
+	w, err := newGifWriter(path, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for _, changed := range []bool{true, false, false, true} {
+		if err := w.WriteFrame(img, changed); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer f.Close()
+	anim, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// unchanged frames extend the delay of the previous one
+	if len(anim.Image) != 2 || anim.Delay[0] != 30 || anim.Delay[1] != 10 {
+		t.Fatalf("unexpected frames %d, delays %v", len(anim.Image), anim.Delay)
+	}
+}
+
+func TestGifWriter_TooLarge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.gif")
+	w, err := newGifWriter(path, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	w.limit = 20
+	img := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	if err := w.WriteFrame(img, true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := w.WriteFrame(img, false); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := w.WriteFrame(img, true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := w.WriteFrame(img, true); !errors.Is(err, errGifTooLarge) {
+		t.Fatalf("expected %v, got %v", errGifTooLarge, err)
+	}
+	w.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the gif to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package player
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/borderzero/vncproxy/client"
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/encodings"
+	"github.com/borderzero/vncproxy/server"
+	"go.uber.org/zap"
+)
+
+// Player serves a recording as a VNC server: every vnc-client that
+// connects watches the recorded session from its start, with its
+// original timing.
+type Player struct {
+	Listener      net.Listener
+	RecordingPath string
+
+	// Speed scales the playback speed, 1 (or 0) being the original speed.
+	Speed float64
+
+	// Password, if set, is required of the vnc-clients.
+	Password string
+
+	// Start, if not zero, is the time into the recording the playback
+	// starts at. Seeking is fast for recordings with a keyframe index
+	// (see recorder.RecorderOptions); the updates played after a seek
+	// are re-encoded as raw rectangles. Encrypted recordings and
+	// indexes are refused with recorder.ErrEncrypted: both must be
+	// decrypted first, the index to the recorder.IndexPath of the
+	// decrypted recording.
+	Start time.Duration
+}
+
+func (p *Player) Serve(ctx context.Context, logger *zap.Logger) error {
+	// the vnc-clients are initialized from the recorded ServerInit
+	srvInit, err := p.readServerInit()
+	if err != nil {
+		return err
+	}
+
+	secHandlers := []server.SecurityHandler{&server.ServerAuthNone{}}
+	if p.Password != "" {
+		secHandlers = []server.SecurityHandler{&server.ServerAuthVNC{Pass: p.Password}}
+	}
+	cfg := &server.ServerConfig{
+		SecurityHandlers: secHandlers,
+		Encodings:        []common.IEncoding{&encodings.RawEncoding{}, &encodings.TightEncoding{}, &encodings.CopyRectEncoding{}},
+		PixelFormat:      &srvInit.PixelFormat,
+		ClientMessages:   server.DefaultClientMessages,
+		DesktopName:      srvInit.NameText,
+		Height:           srvInit.FBHeight,
+		Width:            srvInit.FBWidth,
+		NewConnHandler:   p.newServerConnHandler,
+	}
+	if err := server.Serve(ctx, logger, p.Listener, cfg); err != nil {
+		return fmt.Errorf("failed to serve vnc player: %v", err)
+	}
+	return nil
+}
+
+func (p *Player) readServerInit() (*common.ServerInit, error) {
+	f, err := os.Open(p.RecordingPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %v", err)
+	}
+	defer f.Close()
+	fbs, err := NewFbsReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return fbs.ReadStartSession()
+}
+
+func (p *Player) newServerConnHandler(
+	ctx context.Context,
+	logger *zap.Logger,
+	cfg *server.ServerConfig,
+	sconn *server.ServerConn,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	sconn.Listeners.AddListener(&playListener{
+		player: p,
+		ctx:    ctx,
+		cancel: cancel,
+		logger: logger.With(zap.String("session_id", sconn.SessionId)),
+		conn:   sconn,
+		pf:     *cfg.PixelFormat,
+	})
+	return nil
+}
+
+// playListener starts the playback once the vnc-client sent its first
+// message, and stops it when the vnc-client disconnects.
+type playListener struct {
+	player *Player
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger *zap.Logger
+	conn   *server.ServerConn
+	pf     common.PixelFormat
+	once   sync.Once
+}
+
+func (l *playListener) Consume(seg *common.RfbSegment) error {
+	switch seg.SegmentType {
+	case common.SegmentFullyParsedClientMessage:
+		if msg, ok := seg.Message.(*server.MsgSetPixelFormat); ok && msg.PF != l.pf {
+			// recorded updates can only be replayed as they were received
+			l.logger.Warn("vnc-client asked for a pixel format other than the recorded one, ignoring it")
+		}
+		l.once.Do(func() {
+			go func() {
+				if err := l.player.play(l.ctx, l.conn); err != nil && !errors.Is(err, context.Canceled) {
+					l.logger.Error("playback failed", zap.Error(err))
+				}
+			}()
+		})
+	case common.SegmentConnectionClosed:
+		l.cancel()
+	}
+	return nil
+}
+
+// play writes the recorded server messages to w, at the pace they were
+// recorded.
+func (p *Player) play(ctx context.Context, w io.Writer) error {
+	if p.Start > 0 {
+		return p.playFrom(ctx, w)
+	}
+
+	f, err := os.Open(p.RecordingPath)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %v", err)
+	}
+	defer f.Close()
+	fbs, err := NewFbsReader(f)
+	if err != nil {
+		return err
+	}
+	if _, err := fbs.ReadStartSession(); err != nil {
+		return err
+	}
+	// the recording starts with the handshake, not when the recorder was created
+	base := fbs.Timestamp()
+
+	start := time.Now()
+	for {
+		block, err := fbs.ReadBlock()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := waitUntil(ctx, start.Add(time.Duration(float64(block.Timestamp-base)/p.speed()))); err != nil {
+			return err
+		}
+		if _, err := w.Write(block.Data); err != nil {
+			return fmt.Errorf("failed to write to vnc-client: %v", err)
+		}
+	}
+}
+
+// playFrom writes the recorded server messages from p.Start on to w, at
+// the pace they were recorded. The vnc-client gets the whole desktop
+// first, and the updates after it as raw rectangles, since it cannot
+// inflate zlib streams it did not see from their start.
+func (p *Player) playFrom(ctx context.Context, w io.Writer) error {
+	f, err := os.Open(p.RecordingPath)
+	if err != nil {
+		return fmt.Errorf("failed to open recording: %v", err)
+	}
+	defer f.Close()
+	dec, err := newRecordingDecoder(f)
+	if err != nil {
+		return err
+	}
+	if err := dec.seek(f, p.RecordingPath, p.Start); err != nil {
+		return err
+	}
+
+	full, err := dec.fullUpdate()
+	if err != nil {
+		return err
+	}
+	if err := full.Write(w); err != nil {
+		return fmt.Errorf("failed to write to vnc-client: %v", err)
+	}
+
+	start := time.Now()
+	for {
+		msg, at, err := dec.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := waitUntil(ctx, start.Add(time.Duration(float64(at-p.Start)/p.speed()))); err != nil {
+			return err
+		}
+		if _, err := dec.apply(msg); err != nil {
+			return fmt.Errorf("failed to decode the recording at %v: %v", at, err)
+		}
+		if fbu, ok := msg.(*client.MsgFramebufferUpdate); ok {
+			if msg, err = dec.rawUpdate(fbu); err != nil {
+				return err
+			}
+		}
+		if err := msg.Write(w); err != nil {
+			return fmt.Errorf("failed to write to vnc-client: %v", err)
+		}
+	}
+}
+
+func (p *Player) speed() float64 {
+	if p.Speed <= 0 {
+		return 1
+	}
+	return p.Speed
+}
+
+// waitUntil waits for t, or for ctx to be done.
+func waitUntil(ctx context.Context, t time.Time) error {
+	wait := time.Until(t)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
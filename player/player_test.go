@@ -0,0 +1,173 @@
+package player
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/borderzero/vncproxy/common"
+	"go.uber.org/zap"
+)
+
+// pipeListener accepts the server ends of net.Pipe connections.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// dial returns the client end of a connection accepted by the listener.
+func (l *pipeListener) dial() net.Conn {
+	c, s := net.Pipe()
+	l.conns <- s
+	return c
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	close(l.closed)
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// expect reads len(want) bytes from c, and fails if they differ.
+func expect(t *testing.T, c net.Conn, what string, want []byte) {
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatalf("%s: unexpected error: %s", what, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s: expected %v, got %v", what, want, got)
+	}
+}
+
+// watch connects a vnc-client to a player serving the recording at
+// path from start, checks the handshake and asks for an update, and
+// returns the connection.
+func watch(t *testing.T, path string, start time.Duration) net.Conn {
+	ln := newPipeListener()
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Player{Listener: ln, RecordingPath: path, Speed: 100, Start: start}
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(ctx, zap.NewNop()) }()
+	c := ln.dial()
+	t.Cleanup(func() {
+		c.Close()
+		cancel()
+		ln.Close()
+		<-served
+	})
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+
+	expect(t, c, "version", []byte("RFB 003.008\n"))
+	c.Write([]byte("RFB 003.008\n"))
+	// the None security type, then the security result
+	expect(t, c, "security types", []byte{1, 1})
+	c.Write([]byte{1})
+	expect(t, c, "security result", []byte{0, 0, 0, 0})
+	// a shared ClientInit, and the recorded ServerInit
+	c.Write([]byte{1})
+	var serverInit bytes.Buffer
+	serverInit.Write([]byte{0, 8, 0, 4})
+	testPixelFormat.WriteTo(&serverInit)
+	serverInit.Write([]byte{0, 0, 0, 0})
+	expect(t, c, "server init", serverInit.Bytes())
+	// the empty desktop name is still a write, which a pipe blocks on
+	c.Read(nil)
+
+	// the playback starts with the first message of the vnc-client
+	c.Write([]byte{3, 0, 0, 0, 0, 0, 0, 8, 0, 4})
+	return c
+}
+
+// rawUpdate returns a framebuffer update of raw rectangles of img, in
+// testPixelFormat.
+func rawUpdate(img *image.RGBA, rects ...image.Rectangle) []byte {
+	msg := binary.BigEndian.AppendUint16([]byte{0, 0}, uint16(len(rects)))
+	for _, r := range rects {
+		for _, v := range []uint16{uint16(r.Min.X), uint16(r.Min.Y), uint16(r.Dx()), uint16(r.Dy())} {
+			msg = binary.BigEndian.AppendUint16(msg, v)
+		}
+		msg = binary.BigEndian.AppendUint32(msg, uint32(common.EncRaw))
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				c := img.RGBAAt(x, y)
+				msg = append(msg, c.B, c.G, c.R, 0)
+			}
+		}
+	}
+	return msg
+}
+
+func TestPlayer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "played.rbs")
+	msgs := updates(6)
+	record(t, path, msgs)
+
+	// the messages are played as recorded
+	c := watch(t, path, 0)
+	expect(t, c, "messages", bytes.Join(msgs, nil))
+}
+
+func TestPlayer_Start(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "played.rbs")
+	record(t, path, updates(6))
+
+	// the desktop after each message, from a linear replay
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer f.Close()
+	linear, err := newRecordingDecoder(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var times []time.Duration
+	var frames []*image.RGBA
+	for {
+		msg, at, err := linear.next()
+		if err != nil {
+			break
+		}
+		if _, err := linear.apply(msg); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		times = append(times, at)
+		frame := image.NewRGBA(linear.fb.Bounds())
+		copy(frame.Pix, linear.fb.Image().Pix)
+		frames = append(frames, frame)
+	}
+	if len(times) != 6 {
+		t.Fatalf("expected the 6 recorded messages, got %d", len(times))
+	}
+
+	// the vnc-client gets the desktop before message 3, then messages 3
+	// to 5 re-encoded as raw rectangles
+	c := watch(t, path, times[3])
+	expect(t, c, "desktop", rawUpdate(frames[2], image.Rect(0, 0, 8, 4)))
+	for i := 3; i < 6; i++ {
+		expect(t, c, "message", rawUpdate(frames[i], image.Rect(0, 0, 4, 4), image.Rect(4, 0, 8, 4)))
+	}
+}
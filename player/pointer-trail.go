@@ -0,0 +1,86 @@
+package player
+
+import (
+	"image"
+	"image/color"
+	"sort"
+	"time"
+
+	"github.com/borderzero/vncproxy/recorder"
+)
+
+// pointerTrailLength is how long the past pointer positions stay drawn.
+const pointerTrailLength = time.Second
+
+var (
+	pointerColor = color.RGBA{0xff, 0x20, 0x20, 0xff}
+	trailColor   = color.RGBA{0xff, 0x90, 0x20, 0xff}
+)
+
+type pointerPosition struct {
+	at   time.Duration
+	x, y int
+}
+
+// pointerTrail draws the recorded pointer positions over the frames of
+// an export.
+type pointerTrail struct {
+	positions []pointerPosition
+
+	// first and end delimit the positions drawn on the last frame
+	first, end int
+}
+
+// newPointerTrail reads the pointer events of a recording. base is the
+// timestamp the times of the export are relative to.
+func newPointerTrail(recordingPath string, base time.Duration) (*pointerTrail, error) {
+	events, err := recorder.ReadInputEvents(recordingPath)
+	if err != nil {
+		return nil, err
+	}
+	p := &pointerTrail{}
+	for _, ev := range events {
+		if ev.Pointer == nil {
+			continue
+		}
+		p.positions = append(p.positions, pointerPosition{
+			at: time.Duration(ev.Timestamp)*time.Millisecond - base,
+			x:  int(ev.Pointer.X),
+			y:  int(ev.Pointer.Y),
+		})
+	}
+	return p, nil
+}
+
+// advance moves the trail to time t, and reports whether it changed.
+func (p *pointerTrail) advance(t time.Duration) bool {
+	end := sort.Search(len(p.positions), func(i int) bool { return p.positions[i].at > t })
+	first := sort.Search(end, func(i int) bool { return p.positions[i].at > t-pointerTrailLength })
+	// the pointer stays where it was last seen
+	first = min(first, max(end-1, 0))
+	changed := first != p.first || end != p.end
+	p.first, p.end = first, end
+	return changed
+}
+
+// draw paints the trail and the pointer at the time of the last advance.
+func (p *pointerTrail) draw(img *image.RGBA) {
+	if p.end == 0 {
+		return
+	}
+	for _, pos := range p.positions[p.first : p.end-1] {
+		fillRect(img, image.Rect(pos.x-1, pos.y-1, pos.x+1, pos.y+1), trailColor)
+	}
+	pos := p.positions[p.end-1]
+	fillRect(img, image.Rect(pos.x-4, pos.y, pos.x+5, pos.y+1), pointerColor)
+	fillRect(img, image.Rect(pos.x, pos.y-4, pos.x+1, pos.y+5), pointerColor)
+}
+
+func fillRect(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	r = r.Intersect(img.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package player
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"time"
+
+	"github.com/borderzero/vncproxy/client"
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/recorder"
+)
+
+// seek skips the messages of the recording received before start. If
+// the recording has a keyframe index, decoding resumes from the last
+// keyframe before start instead of from the start of the recording.
+// The offsets of the keyframes are the ones of the decrypted recording,
+// so an encrypted index is refused rather than ignored.
+func (d *recordingDecoder) seek(f io.ReadSeeker, recordingPath string, start time.Duration) error {
+	var idx *recorder.Index
+	if start > 0 {
+		var err error
+		idx, err = recorder.OpenIndex(recordingPath)
+		if errors.Is(err, recorder.ErrEncrypted) {
+			return fmt.Errorf("cannot seek with %v, decrypt it next to the recording, or remove it", err)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if idx != nil {
+		if k := idx.Find(d.base + start); k != nil {
+			fb, err := idx.Framebuffer(k)
+			if err != nil {
+				return err
+			}
+			if _, err := f.Seek(k.Offset, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to seek to keyframe: %v", err)
+			}
+			d.fbs = newFbsBlockReader(f)
+			d.reader = common.NewRfbReadHelper(d.fbs)
+			d.conn.pf = k.PixelFormat
+			d.fb = fb
+		}
+	}
+
+	for {
+		msg, at, err := d.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if at >= start {
+			d.pending, d.pendingAt = msg, at
+			return nil
+		}
+		if _, err := d.apply(msg); err != nil {
+			return fmt.Errorf("failed to decode the recording at %v: %v", at, err)
+		}
+	}
+}
+
+// rawUpdate re-encodes the rectangles of an update applied to the
+// framebuffer as raw rectangles, for vnc-clients that did not see the
+// zlib streams from their start.
+func (d *recordingDecoder) rawUpdate(msg *client.MsgFramebufferUpdate) (*client.MsgFramebufferUpdate, error) {
+	raw := &client.MsgFramebufferUpdate{Rectangles: make([]common.Rectangle, len(msg.Rectangles))}
+	for i, rect := range msg.Rectangles {
+		if rect.Enc.Type() < 0 {
+			// pseudo-encodings carry no pixels of the framebuffer
+			raw.Rectangles[i] = rect
+			continue
+		}
+		r := image.Rect(int(rect.X), int(rect.Y), int(rect.X)+int(rect.Width), int(rect.Y)+int(rect.Height))
+		r = r.Intersect(d.fb.Bounds())
+		enc, err := d.fb.EncodeRaw(r)
+		if err != nil {
+			return nil, err
+		}
+		rect.X, rect.Y = uint16(r.Min.X), uint16(r.Min.Y)
+		rect.Width, rect.Height = uint16(r.Dx()), uint16(r.Dy())
+		rect.Enc = enc
+		raw.Rectangles[i] = rect
+	}
+	return raw, nil
+}
+
+// fullUpdate returns an update of the whole framebuffer.
+func (d *recordingDecoder) fullUpdate() (*client.MsgFramebufferUpdate, error) {
+	bounds := d.fb.Bounds()
+	enc, err := d.fb.EncodeRaw(bounds)
+	if err != nil {
+		return nil, err
+	}
+	return &client.MsgFramebufferUpdate{Rectangles: []common.Rectangle{{
+		Width:  uint16(bounds.Dx()),
+		Height: uint16(bounds.Dy()),
+		Enc:    enc,
+	}}}, nil
+}
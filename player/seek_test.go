@@ -0,0 +1,179 @@
+package player
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/borderzero/vncproxy/client"
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/recorder"
+)
+
+// testPixelFormat is the 32bpp, 24 bit depth format of most servers.
+var testPixelFormat = common.PixelFormat{
+	BPP: 32, Depth: 24, TrueColor: 1,
+	RedMax: 255, GreenMax: 255, BlueMax: 255,
+	RedShift: 16, GreenShift: 8, BlueShift: 0,
+}
+
+// zlibStream compresses data as parts of a single zlib stream, as
+// servers do across the rectangles of an encoding.
+type zlibStream struct {
+	buf bytes.Buffer
+	w   *zlib.Writer
+}
+
+func (z *zlibStream) compress(data []byte) []byte {
+	if z.w == nil {
+		z.w = zlib.NewWriter(&z.buf)
+	}
+	z.w.Write(data)
+	z.w.Flush()
+	compressed := append([]byte(nil), z.buf.Bytes()...)
+	z.buf.Reset()
+	return compressed
+}
+
+// updates returns n framebuffer updates of an 8x4 desktop, each with a
+// ZRLE rectangle on its left half and a Tight one on its right half,
+// both continuing the zlib streams of the updates before.
+func updates(n int) [][]byte {
+	var zrle, tight zlibStream
+	var msgs [][]byte
+	for i := 0; i < n; i++ {
+		msg := []byte{0, 0, 0, 2}
+
+		// a raw ZRLE tile of CPIXELs
+		tile := []byte{0}
+		for j := 0; j < 16; j++ {
+			tile = append(tile, byte(i*16+j), byte(i), byte(j))
+		}
+		data := zrle.compress(tile)
+		msg = binary.BigEndian.AppendUint16(msg, 0)
+		msg = binary.BigEndian.AppendUint16(msg, 0)
+		msg = binary.BigEndian.AppendUint16(msg, 4)
+		msg = binary.BigEndian.AppendUint16(msg, 4)
+		msg = binary.BigEndian.AppendUint32(msg, uint32(common.EncZRLE))
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(data)))
+		msg = append(msg, data...)
+
+		// a Tight rectangle of the basic filter on stream 0
+		var pixels []byte
+		for j := 0; j < 16; j++ {
+			pixels = append(pixels, byte(j), byte(i*16+j), 0x80)
+		}
+		data = tight.compress(pixels)
+		msg = binary.BigEndian.AppendUint16(msg, 4)
+		msg = binary.BigEndian.AppendUint16(msg, 0)
+		msg = binary.BigEndian.AppendUint16(msg, 4)
+		msg = binary.BigEndian.AppendUint16(msg, 4)
+		msg = binary.BigEndian.AppendUint32(msg, uint32(common.EncTight))
+		msg = append(msg, 0, byte(len(data))|0x80, byte(len(data)>>7))
+		msg = append(msg, data...)
+
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// record records the messages, as received from a vnc-server, with a
+// keyframe after each of them.
+func record(t *testing.T, path string, msgs [][]byte) {
+	rec, err := recorder.NewRecorderWithOptions(path, recorder.RecorderOptions{KeyframeInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{
+		FBWidth: 8, FBHeight: 4, PixelFormat: testPixelFormat,
+	}})
+	conn := &recordingConn{pf: testPixelFormat}
+	for _, msg := range msgs {
+		// the timestamps of the recording are in milliseconds
+		time.Sleep(3 * time.Millisecond)
+		parsed, err := new(client.MsgFramebufferUpdate).Read(conn, common.NewRfbReadHelper(bytes.NewReader(msg[1:])))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		for _, seg := range []*common.RfbSegment{
+			{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.FramebufferUpdate)},
+			{SegmentType: common.SegmentBytes, Bytes: msg},
+			{SegmentType: common.SegmentMessageEnd, UpcomingObjectType: int(common.FramebufferUpdate)},
+			{SegmentType: common.SegmentFullyParsedServerMessage, Message: parsed},
+		} {
+			rec.Consume(seg)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestSeek(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zlib.rbs")
+	record(t, path, updates(6))
+
+	idx, err := recorder.OpenIndex(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(idx.Keyframes) != 6 {
+		t.Fatalf("expected 6 keyframes, got %d", len(idx.Keyframes))
+	}
+
+	// a linear replay, which also checks that the recording only holds
+	// the recorded messages
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer f.Close()
+	linear, err := newRecordingDecoder(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var times []time.Duration
+	var frames [][]byte
+	for {
+		msg, at, err := linear.next()
+		if err != nil {
+			break
+		}
+		times = append(times, at)
+		frames = append(frames, append([]byte(nil), linear.fb.Image().Pix...))
+		if _, err := linear.apply(msg); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if len(times) != 6 {
+		t.Fatalf("expected the 6 recorded messages, got %d", len(times))
+	}
+
+	for _, i := range []int{1, 3, 5} {
+		if _, err := f.Seek(0, 0); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		dec, err := newRecordingDecoder(f)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := dec.seek(f, path, times[i]); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// the desktop is the one before message i, which comes next
+		if !bytes.Equal(dec.fb.Image().Pix, frames[i]) {
+			t.Errorf("message %d: the desktop differs from the linear replay", i)
+		}
+		msg, at, err := dec.next()
+		if err != nil || at != times[i] {
+			t.Fatalf("message %d: expected it next, got %v at %v", i, err, at)
+		}
+		if _, err := dec.apply(msg); err != nil {
+			t.Fatalf("message %d: unexpected error: %s", i, err)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/borderzero/vncproxy/client"
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/server"
+	"go.uber.org/zap"
+)
+
+// ClipboardDirection tells which way clipboard text is travelling.
+type ClipboardDirection int
+
+const (
+	// ClipboardClientToServer is viewer to desktop (ClientCutText).
+	ClipboardClientToServer ClipboardDirection = iota
+	// ClipboardServerToClient is desktop to viewer (ServerCutText).
+	ClipboardServerToClient
+)
+
+func (d ClipboardDirection) String() string {
+	switch d {
+	case ClipboardClientToServer:
+		return "client-to-server"
+	case ClipboardServerToClient:
+		return "server-to-client"
+	}
+	return fmt.Sprintf("ClipboardDirection(%d)", int(d))
+}
+
+// ClipboardAction is what a ClipboardRule does with the text it matches.
+type ClipboardAction int
+
+const (
+	// ClipboardAllow delivers the text, skipping the remaining rules.
+	ClipboardAllow ClipboardAction = iota
+	// ClipboardDeny drops the text, skipping the remaining rules.
+	ClipboardDeny
+	// ClipboardMaxSize drops text longer than the rule's MaxSize.
+	ClipboardMaxSize
+	// ClipboardRedact replaces every match of the rule's Pattern with
+	// its Replacement, and goes on with the remaining rules.
+	ClipboardRedact
+)
+
+func (a ClipboardAction) String() string {
+	switch a {
+	case ClipboardAllow:
+		return "allow"
+	case ClipboardDeny:
+		return "deny"
+	case ClipboardMaxSize:
+		return "max-size"
+	case ClipboardRedact:
+		return "redact"
+	}
+	return fmt.Sprintf("ClipboardAction(%d)", int(a))
+}
+
+// ClipboardRule is a single clipboard policy rule.
+type ClipboardRule struct {
+	// Name identifies the rule in audit events.
+	Name string
+
+	Action ClipboardAction
+
+	// MaxSize is the largest text, in bytes, a ClipboardMaxSize rule lets through.
+	MaxSize int
+
+	// Pattern restricts ClipboardAllow and ClipboardDeny rules to the
+	// texts it matches. ClipboardRedact rules require it.
+	Pattern *regexp.Regexp
+
+	// Replacement is the text ClipboardRedact substitutes for each match,
+	// as in regexp.Regexp.ReplaceAll.
+	Replacement string
+}
+
+// matches reports whether the rule applies to text.
+func (r *ClipboardRule) matches(text []byte) bool {
+	switch r.Action {
+	case ClipboardMaxSize:
+		return len(text) > r.MaxSize
+	case ClipboardRedact:
+		return r.Pattern.Match(text)
+	}
+	return r.Pattern == nil || r.Pattern.Match(text)
+}
+
+// ClipboardEvent is the audit record of a clipboard policy decision.
+type ClipboardEvent struct {
+	// SessionId identifies the upstream session the text went through.
+	SessionId string
+	Direction ClipboardDirection
+
+	// Action is the outcome: ClipboardAllow, ClipboardDeny (also used
+	// when a ClipboardMaxSize rule dropped the text), or ClipboardRedact
+	// when the text was delivered after redaction.
+	Action ClipboardAction
+
+	// Rule is the name of the rule that decided the outcome, or empty
+	// when no rule matched and the text was allowed by default.
+	Rule string
+
+	// Rules are the names of every rule that matched, in order, such as
+	// the redactions applied before the rule deciding the outcome.
+	Rules []string
+
+	// Size is the length of the text as received, and DeliveredSize the
+	// length of what was passed on (0 when dropped).
+	Size          int
+	DeliveredSize int
+}
+
+// ClipboardPolicy filters the clipboard traffic of proxied sessions.
+// The rules of each direction are evaluated in order; text no
+// ClipboardAllow, ClipboardDeny or ClipboardMaxSize rule matched is
+// delivered, with any redactions applied.
+type ClipboardPolicy struct {
+	ClientToServer []ClipboardRule
+	ServerToClient []ClipboardRule
+
+	// Audit receives an event for every clipboard message. If nil,
+	// events are written to the proxy log.
+	Audit func(ClipboardEvent)
+}
+
+// Validate checks the rules are well-formed.
+func (p *ClipboardPolicy) Validate() error {
+	for _, rules := range [][]ClipboardRule{p.ClientToServer, p.ServerToClient} {
+		for i := range rules {
+			r := &rules[i]
+			switch r.Action {
+			case ClipboardAllow, ClipboardDeny:
+			case ClipboardMaxSize:
+				if r.MaxSize < 0 {
+					return fmt.Errorf("clipboard rule %s: negative max size", ruleName(r, i))
+				}
+			case ClipboardRedact:
+				if r.Pattern == nil {
+					return fmt.Errorf("clipboard rule %s: redact requires a pattern", ruleName(r, i))
+				}
+			default:
+				return fmt.Errorf("clipboard rule %s: unknown action %v", ruleName(r, i), r.Action)
+			}
+		}
+	}
+	return nil
+}
+
+func ruleName(r *ClipboardRule, i int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("#%d", i)
+}
+
+// apply runs text through the rules of direction, and returns the text
+// to deliver along with the decision; text is to be dropped when the
+// event action is ClipboardDeny.
+func (p *ClipboardPolicy) apply(direction ClipboardDirection, text []byte) ([]byte, ClipboardEvent) {
+	rules := p.ClientToServer
+	if direction == ClipboardServerToClient {
+		rules = p.ServerToClient
+	}
+	event := ClipboardEvent{Direction: direction, Action: ClipboardAllow, Size: len(text)}
+	for i := range rules {
+		r := &rules[i]
+		if !r.matches(text) {
+			continue
+		}
+		event.Rule = ruleName(r, i)
+		event.Rules = append(event.Rules, event.Rule)
+		switch r.Action {
+		case ClipboardRedact:
+			text = r.Pattern.ReplaceAll(text, []byte(r.Replacement))
+			event.Action = ClipboardRedact
+		case ClipboardDeny, ClipboardMaxSize:
+			event.Action = ClipboardDeny
+			return nil, event
+		default:
+			event.DeliveredSize = len(text)
+			return text, event
+		}
+	}
+	event.DeliveredSize = len(text)
+	return text, event
+}
+
+func (p *ClipboardPolicy) audit(logger *zap.Logger, event ClipboardEvent) {
+	if p.Audit != nil {
+		p.Audit(event)
+		return
+	}
+	logger.Info("clipboard policy decision",
+		zap.String("session_id", event.SessionId),
+		zap.Stringer("direction", event.Direction),
+		zap.Stringer("action", event.Action),
+		zap.String("rule", event.Rule),
+		zap.Strings("rules", event.Rules),
+		zap.Int("size", event.Size),
+		zap.Int("delivered_size", event.DeliveredSize),
+	)
+}
+
+// clipboardInterceptor applies a ClipboardPolicy to the messages of a
+// single session or vnc-client.
+type clipboardInterceptor struct {
+	policy    *ClipboardPolicy
+	sessionId string
+	logger    *zap.Logger
+}
+
+func (c *clipboardInterceptor) InterceptClientMessage(msg common.ClientMessage) (common.ClientMessage, error) {
+	cutText, ok := msg.(*server.MsgClientCutText)
+	if !ok {
+		return msg, nil
+	}
+	text, event := c.policy.apply(ClipboardClientToServer, cutText.Text)
+	event.SessionId = c.sessionId
+	c.policy.audit(c.logger, event)
+	if event.Action == ClipboardDeny {
+		return nil, nil
+	}
+	if event.Action != ClipboardRedact {
+		return msg, nil
+	}
+	return &server.MsgClientCutText{Length: uint32(len(text)), Text: text}, nil
+}
+
+func (c *clipboardInterceptor) InterceptServerMessage(msg common.ServerMessage) (common.ServerMessage, error) {
+	cutText, ok := msg.(*client.MsgServerCutText)
+	if !ok {
+		return msg, nil
+	}
+	text, event := c.policy.apply(ClipboardServerToClient, []byte(cutText.Text))
+	event.SessionId = c.sessionId
+	c.policy.audit(c.logger, event)
+	if event.Action == ClipboardDeny {
+		return nil, nil
+	}
+	if event.Action != ClipboardRedact {
+		return msg, nil
+	}
+	return &client.MsgServerCutText{Text: string(text)}, nil
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/borderzero/vncproxy/client"
+	"github.com/borderzero/vncproxy/server"
+	"go.uber.org/zap"
+)
+
+func TestClipboardPolicy_Apply(t *testing.T) {
+	policy := &ClipboardPolicy{
+		ClientToServer: []ClipboardRule{
+			{Name: "cards", Action: ClipboardRedact, Pattern: regexp.MustCompile(`\d{4}-\d{4}`), Replacement: "XXXX"},
+			{Name: "size", Action: ClipboardMaxSize, MaxSize: 10},
+			{Name: "passwords", Action: ClipboardDeny, Pattern: regexp.MustCompile(`(?i)password`)},
+			{Name: "rest", Action: ClipboardAllow},
+			{Name: "never", Action: ClipboardDeny},
+		},
+		ServerToClient: []ClipboardRule{
+			{Action: ClipboardDeny},
+		},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	tests := []struct {
+		direction ClipboardDirection
+		text      string
+		want      string
+		action    ClipboardAction
+		rule      string
+	}{
+		// redacted texts are reported as such, even once allowed
+		{ClipboardClientToServer, "1234-5678", "XXXX", ClipboardRedact, "rest"},
+		{ClipboardClientToServer, "hello", "hello", ClipboardAllow, "rest"},
+		// the size is checked after the redactions
+		{ClipboardClientToServer, "a long text 1234-5678", "", ClipboardDeny, "size"},
+		{ClipboardClientToServer, "Password", "", ClipboardDeny, "passwords"},
+		{ClipboardServerToClient, "hello", "", ClipboardDeny, "#0"},
+	}
+	for _, tt := range tests {
+		text, event := policy.apply(tt.direction, []byte(tt.text))
+		if string(text) != tt.want || event.Action != tt.action || event.Rule != tt.rule {
+			t.Errorf("%s %q: got %q, %v by %q; want %q, %v by %q",
+				tt.direction, tt.text, text, event.Action, event.Rule, tt.want, tt.action, tt.rule)
+		}
+		if event.Size != len(tt.text) || event.DeliveredSize != len(tt.want) {
+			t.Errorf("%s %q: unexpected sizes %d, %d", tt.direction, tt.text, event.Size, event.DeliveredSize)
+		}
+	}
+}
+
+func TestClipboardPolicy_ApplyRedactOnly(t *testing.T) {
+	policy := &ClipboardPolicy{ServerToClient: []ClipboardRule{
+		{Name: "tokens", Action: ClipboardRedact, Pattern: regexp.MustCompile(`tok_\w+`), Replacement: "tok_***"},
+	}}
+	text, event := policy.apply(ClipboardServerToClient, []byte("key tok_abc and tok_def"))
+	if string(text) != "key tok_*** and tok_***" || event.Action != ClipboardRedact || event.Rule != "tokens" {
+		t.Fatalf("unexpected redaction %q, %+v", text, event)
+	}
+	// text no rule matched is allowed by default
+	text, event = policy.apply(ClipboardServerToClient, []byte("hello"))
+	if string(text) != "hello" || event.Action != ClipboardAllow || event.Rule != "" {
+		t.Fatalf("unexpected decision %q, %+v", text, event)
+	}
+}
+
+func TestClipboardPolicy_ApplyMatchedRules(t *testing.T) {
+	policy := &ClipboardPolicy{ClientToServer: []ClipboardRule{
+		{Name: "cards", Action: ClipboardRedact, Pattern: regexp.MustCompile(`\d{4}-\d{4}`), Replacement: "XXXX"},
+		{Name: "tokens", Action: ClipboardRedact, Pattern: regexp.MustCompile(`tok_\w+`), Replacement: "tok_***"},
+		{Name: "short", Action: ClipboardAllow, Pattern: regexp.MustCompile(`^.{0,20}$`)},
+		{Name: "rest", Action: ClipboardDeny},
+	}}
+
+	tests := []struct {
+		text   string
+		action ClipboardAction
+		rule   string
+		rules  []string
+	}{
+		// the redaction is kept as evidence once a later rule allows the text
+		{"1234-5678", ClipboardRedact, "short", []string{"cards", "short"}},
+		{"1234-5678 tok_abc", ClipboardRedact, "short", []string{"cards", "tokens", "short"}},
+		{"hello", ClipboardAllow, "short", []string{"short"}},
+		{"tok_abc in a text longer than allowed", ClipboardDeny, "rest", []string{"tokens", "rest"}},
+	}
+	for _, tt := range tests {
+		_, event := policy.apply(ClipboardClientToServer, []byte(tt.text))
+		if event.Action != tt.action || event.Rule != tt.rule || !reflect.DeepEqual(event.Rules, tt.rules) {
+			t.Errorf("%q: got %v by %q after %q; want %v by %q after %q",
+				tt.text, event.Action, event.Rule, event.Rules, tt.action, tt.rule, tt.rules)
+		}
+	}
+}
+
+func TestClipboardPolicy_Validate(t *testing.T) {
+	tests := []ClipboardRule{
+		{Action: ClipboardMaxSize, MaxSize: -1},
+		{Action: ClipboardRedact},
+		{Action: ClipboardAction(42)},
+	}
+	for _, rule := range tests {
+		policy := &ClipboardPolicy{ClientToServer: []ClipboardRule{rule}}
+		if err := policy.Validate(); err == nil {
+			t.Errorf("%v: error expected", rule.Action)
+		}
+	}
+}
+
+func TestClipboardInterceptor(t *testing.T) {
+	var events []ClipboardEvent
+	policy := &ClipboardPolicy{
+		ClientToServer: []ClipboardRule{{Action: ClipboardRedact, Pattern: regexp.MustCompile(`secret`), Replacement: "******"}},
+		ServerToClient: []ClipboardRule{{Action: ClipboardDeny}},
+		Audit:          func(e ClipboardEvent) { events = append(events, e) },
+	}
+	interceptor := &clipboardInterceptor{policy: policy, sessionId: "s1", logger: zap.NewNop()}
+
+	msg, err := interceptor.InterceptClientMessage(&server.MsgClientCutText{Length: 9, Text: []byte("my secret")})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cutText, ok := msg.(*server.MsgClientCutText)
+	if !ok || string(cutText.Text) != "my ******" || cutText.Length != 9 {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	pointer := &server.MsgPointerEvent{}
+	if msg, err := interceptor.InterceptClientMessage(pointer); err != nil || msg != pointer {
+		t.Fatalf("expected other messages to pass, got %+v, %v", msg, err)
+	}
+
+	if msg, err := interceptor.InterceptServerMessage(&client.MsgServerCutText{Text: "hello"}); err != nil || msg != nil {
+		t.Fatalf("expected the server cut text to be dropped, got %+v, %v", msg, err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 audit events, got %+v", events)
+	}
+	for _, e := range events {
+		if e.SessionId != "s1" {
+			t.Errorf("unexpected session id in %+v", e)
+		}
+	}
+	if events[0].Action != ClipboardRedact || events[1].Action != ClipboardDeny || events[1].Direction != ClipboardServerToClient {
+		t.Errorf("unexpected audit events %+v", events)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/borderzero/vncproxy/proxy"
+	"github.com/borderzero/vncproxy/recorder"
+	"github.com/borderzero/vncproxy/server"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+// config is the proxy configuration file, in YAML (.yaml, .yml) or JSON.
+type config struct {
+	// Listen is the address the vnc-clients connect to.
+	Listen string `json:"listen" yaml:"listen"`
+
+	// Password is required of the vnc-clients, if set.
+	Password string `json:"password" yaml:"password"`
+
+	// TLSCertFile and TLSKeyFile, if set, are the PEM encoded certificate
+	// and private key the vnc-clients connect with, over VeNCrypt.
+	TLSCertFile string `json:"tls_cert_file" yaml:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file" yaml:"tls_key_file"`
+
+	// HtpasswdFile, if set, is an htpasswd file of bcrypt hashed
+	// passwords the vnc-clients authenticate with, by username, instead
+	// of Password. It requires TLSCertFile.
+	HtpasswdFile string `json:"htpasswd_file" yaml:"htpasswd_file"`
+
+	// Target is the VNC server connections are proxied to, unless
+	// Targets has one for the authenticated username.
+	Target *targetConfig `json:"target" yaml:"target"`
+
+	// Targets maps usernames to the VNC server they are proxied to. It
+	// requires HtpasswdFile, which authenticates the usernames.
+	Targets map[string]*targetConfig `json:"targets" yaml:"targets"`
+
+	SharedSessions bool `json:"shared_sessions" yaml:"shared_sessions"`
+
+	// RecordingDir, if set, enables recording the sessions to this directory.
+	RecordingDir string `json:"recording_dir" yaml:"recording_dir"`
+
+	// RecordingS3, if set, enables recording the sessions to an S3
+	// compatible object store.
+	RecordingS3 *s3Config `json:"recording_s3" yaml:"recording_s3"`
+
+	// RecordingNameTemplate names the recordings, with the {session},
+	// {user}, {target} and {timestamp} placeholders. It must contain
+	// {session}, so sessions started within the same second get distinct
+	// names. Defaults to recorder.DefaultNameTemplate.
+	RecordingNameTemplate string `json:"recording_name_template" yaml:"recording_name_template"`
+
+	// RecordingKeyFile, if set, is a file holding a hex encoded AES key
+	// the recordings are encrypted with, under RecordingKeyId.
+	RecordingKeyFile string `json:"recording_key_file" yaml:"recording_key_file"`
+	RecordingKeyId   string `json:"recording_key_id" yaml:"recording_key_id"`
+
+	// RecordingBackpressure is what the recorder does when the
+	// recordings are not written as fast as the sessions go: block (the
+	// default), drop or spill. With drop, the sessions use none of the
+	// ZLib, Tight and ZRLE encodings.
+	RecordingBackpressure string `json:"recording_backpressure" yaml:"recording_backpressure"`
+
+	// RecordingSpillDir is the directory of the temporary files of the
+	// spill backpressure, the system temporary directory if empty.
+	RecordingSpillDir string `json:"recording_spill_dir" yaml:"recording_spill_dir"`
+
+	// RecordingSigningKeyFile, if set, is a file holding a PEM encoded
+	// Ed25519 private key the recordings are signed with.
+	RecordingSigningKeyFile string `json:"recording_signing_key_file" yaml:"recording_signing_key_file"`
+
+	// LogLevel is one of debug, info, warn, error. Defaults to info.
+	LogLevel string `json:"log_level" yaml:"log_level"`
+}
+
+// s3Config is the object store recordings are uploaded to. The
+// credentials default to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN environment variables.
+type s3Config struct {
+	Endpoint        string `json:"endpoint" yaml:"endpoint"`
+	Region          string `json:"region" yaml:"region"`
+	Bucket          string `json:"bucket" yaml:"bucket"`
+	Prefix          string `json:"prefix" yaml:"prefix"`
+	AccessKeyId     string `json:"access_key_id" yaml:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key" yaml:"secret_access_key"`
+	PathStyle       bool   `json:"path_style" yaml:"path_style"`
+}
+
+type targetConfig struct {
+	Host     string `json:"host" yaml:"host"`
+	Port     uint16 `json:"port" yaml:"port"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+	ViewOnly bool   `json:"view_only" yaml:"view_only"`
+
+	// TLS, if set, connects to the target with VeNCrypt.
+	TLS *targetTLSConfig `json:"tls" yaml:"tls"`
+
+	// tls is TLS, loaded by validate
+	tls *proxy.TargetTLS
+}
+
+// targetTLSConfig holds PEM encoded files: the CA certificates the
+// target is verified with, the system ones if empty, and the client
+// certificate and key presented to it, if any.
+type targetTLSConfig struct {
+	CAFile             string `json:"ca_file" yaml:"ca_file"`
+	CertFile           string `json:"cert_file" yaml:"cert_file"`
+	KeyFile            string `json:"key_file" yaml:"key_file"`
+	ServerName         string `json:"server_name" yaml:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse: %v", err)
+	}
+
+	if cfg.Listen == "" {
+		cfg.Listen = ":5900"
+	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *config) validate() error {
+	if c.Target == nil && len(c.Targets) == 0 {
+		return errors.New("no target configured, set target or targets")
+	}
+	if c.Target != nil {
+		if err := c.Target.validate(); err != nil {
+			return fmt.Errorf("target: %v", err)
+		}
+	}
+	if len(c.Targets) > 0 && c.HtpasswdFile == "" {
+		return errors.New("targets: requires htpasswd_file, the usernames would not be authenticated")
+	}
+	for username, t := range c.Targets {
+		if t == nil {
+			return fmt.Errorf("targets.%s: empty target", username)
+		}
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("targets.%s: %v", username, err)
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tls_cert_file and tls_key_file must be set together")
+	}
+	if c.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile); err != nil {
+			return fmt.Errorf("tls_cert_file: %v", err)
+		}
+	}
+	if c.HtpasswdFile != "" {
+		if c.TLSCertFile == "" {
+			return errors.New("htpasswd_file requires tls_cert_file")
+		}
+		if _, err := server.LoadHtpasswdFile(c.HtpasswdFile); err != nil {
+			return fmt.Errorf("htpasswd_file: %v", err)
+		}
+	}
+	if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("log_level: %v", err)
+	}
+	if c.RecordingDir != "" {
+		info, err := os.Stat(c.RecordingDir)
+		if err != nil {
+			return fmt.Errorf("recording_dir: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("recording_dir: %s is not a directory", c.RecordingDir)
+		}
+	}
+	if c.RecordingS3 != nil {
+		if c.RecordingDir != "" {
+			return errors.New("recording_s3: cannot be used with recording_dir")
+		}
+		if err := c.RecordingS3.validate(); err != nil {
+			return fmt.Errorf("recording_s3: %v", err)
+		}
+	}
+	if c.RecordingNameTemplate != "" {
+		if c.RecordingDir == "" && c.RecordingS3 == nil {
+			return errors.New("recording_name_template: requires recording_dir or recording_s3")
+		}
+		if !strings.Contains(c.RecordingNameTemplate, "{session}") {
+			return errors.New("recording_name_template: must contain {session}")
+		}
+	}
+	if c.RecordingKeyFile != "" {
+		if c.RecordingDir == "" && c.RecordingS3 == nil {
+			return errors.New("recording_key_file: requires recording_dir or recording_s3")
+		}
+		if _, err := recorder.ReadKeyFile(c.RecordingKeyFile, c.RecordingKeyId); err != nil {
+			return fmt.Errorf("recording_key_file: %v", err)
+		}
+	}
+	if _, err := c.backpressure(); err != nil {
+		return fmt.Errorf("recording_backpressure: %v", err)
+	}
+	if c.RecordingSigningKeyFile != "" {
+		if c.RecordingDir == "" && c.RecordingS3 == nil {
+			return errors.New("recording_signing_key_file: requires recording_dir or recording_s3")
+		}
+		if _, err := recorder.ReadSigningKeyFile(c.RecordingSigningKeyFile); err != nil {
+			return fmt.Errorf("recording_signing_key_file: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *config) backpressure() (recorder.Backpressure, error) {
+	switch c.RecordingBackpressure {
+	case "", "block":
+		return recorder.BackpressureBlock, nil
+	case "drop":
+		return recorder.BackpressureDrop, nil
+	case "spill":
+		return recorder.BackpressureSpill, nil
+	}
+	return 0, fmt.Errorf("unknown policy %q, expected block, drop or spill", c.RecordingBackpressure)
+}
+
+func (c *s3Config) validate() error {
+	if c.Endpoint == "" {
+		return errors.New("missing endpoint")
+	}
+	if c.Region == "" {
+		return errors.New("missing region")
+	}
+	if c.Bucket == "" {
+		return errors.New("missing bucket")
+	}
+	if c.AccessKeyId == "" {
+		c.AccessKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if c.SecretAccessKey == "" {
+		c.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if c.AccessKeyId == "" || c.SecretAccessKey == "" {
+		return errors.New("missing credentials, set access_key_id and secret_access_key")
+	}
+	return nil
+}
+
+func (c *s3Config) sink() *recorder.S3Sink {
+	return &recorder.S3Sink{
+		Endpoint:        c.Endpoint,
+		Region:          c.Region,
+		Bucket:          c.Bucket,
+		Prefix:          c.Prefix,
+		AccessKeyId:     c.AccessKeyId,
+		SecretAccessKey: c.SecretAccessKey,
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		PathStyle:       c.PathStyle,
+	}
+}
+
+func (t *targetConfig) validate() error {
+	if t.Host == "" {
+		return errors.New("missing host")
+	}
+	if t.Port == 0 {
+		return errors.New("missing port")
+	}
+	if t.TLS != nil {
+		tlsCfg, err := t.TLS.load()
+		if err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+		t.tls = tlsCfg
+	}
+	return nil
+}
+
+func (c *targetTLSConfig) load() (*proxy.TargetTLS, error) {
+	t := &proxy.TargetTLS{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		data, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %v", err)
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("ca_file: no certificate found in %s", c.CAFile)
+		}
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("cert_file and key_file must be set together")
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cert_file: %v", err)
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+func (t *targetConfig) target() *proxy.Target {
+	if t == nil {
+		return nil
+	}
+	return &proxy.Target{
+		Hostname: t.Host,
+		Port:     t.Port,
+		Username: t.Username,
+		Password: t.Password,
+		ViewOnly: t.ViewOnly,
+		TLS:      t.tls,
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// aliceHash is the bcrypt hash of "secret", with the minimum cost.
+const aliceHash = "$2a$04$m0rI7J0dOkoJg7ADqK9bjO78kruLpl/2VCLCHL96swIX8DmvddXpC"
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return path
+}
+
+// writeCert writes a self-signed certificate and its key to dir, and
+// returns their paths.
+func writeCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vncproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cert := writeFile(t, dir, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile := writeFile(t, dir, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})))
+	return cert, keyFile
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCert(t, dir)
+	htpasswd := writeFile(t, dir, "htpasswd", "alice:"+aliceHash+"\n")
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		// err is a part of the expected error, none if empty
+		err string
+	}{
+		{
+			name: "yaml",
+			file: "config.yaml",
+			content: "listen: :5901\ntls_cert_file: " + cert + "\ntls_key_file: " + key + "\nhtpasswd_file: " + htpasswd + "\n" +
+				"target:\n  host: localhost\n  port: 5900\ntargets:\n  alice:\n    host: 10.0.0.1\n    port: 5900\n    view_only: true\n",
+		},
+		{
+			name:    "json",
+			file:    "config.json",
+			content: `{"target": {"host": "localhost", "port": 5900}, "log_level": "debug"}`,
+		},
+		{
+			name:    "unknown field",
+			file:    "config.yml",
+			content: "target:\n  host: localhost\n  port: 5900\nlisten_port: 5901\n",
+			err:     "failed to parse",
+		},
+		{
+			name:    "no target",
+			file:    "config.json",
+			content: `{}`,
+			err:     "no target configured",
+		},
+		{
+			name:    "certificate without key",
+			file:    "config.json",
+			content: `{"target": {"host": "localhost", "port": 5900}, "tls_cert_file": "` + cert + `"}`,
+			err:     "tls_cert_file and tls_key_file must be set together",
+		},
+		{
+			name:    "mismatched key",
+			file:    "config.json",
+			content: `{"target": {"host": "localhost", "port": 5900}, "tls_cert_file": "` + cert + `", "tls_key_file": "` + cert + `"}`,
+			err:     "tls_cert_file:",
+		},
+		{
+			name:    "targets without htpasswd",
+			file:    "config.yaml",
+			content: "tls_cert_file: " + cert + "\ntls_key_file: " + key + "\ntargets:\n  alice:\n    host: 10.0.0.1\n    port: 5900\n",
+			err:     "targets: requires htpasswd_file",
+		},
+		{
+			name:    "htpasswd without tls",
+			file:    "config.json",
+			content: `{"target": {"host": "localhost", "port": 5900}, "htpasswd_file": "` + htpasswd + `"}`,
+			err:     "htpasswd_file requires tls_cert_file",
+		},
+		{
+			name:    "bad log level",
+			file:    "config.yaml",
+			content: "target:\n  host: localhost\n  port: 5900\nlog_level: verbose\n",
+			err:     "log_level:",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := loadConfig(writeFile(t, t.TempDir(), tt.file, tt.content))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err)
+		}
+	}
+}
+
+func TestLoadConfig_Defaults(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCert(t, dir)
+	htpasswd := writeFile(t, dir, "htpasswd", "alice:"+aliceHash+"\n")
+	cfg, err := loadConfig(writeFile(t, dir, "config.yaml",
+		"tls_cert_file: "+cert+"\ntls_key_file: "+key+"\nhtpasswd_file: "+htpasswd+"\n"+
+			"targets:\n  alice:\n    host: 10.0.0.1\n    port: 5900\n    view_only: true\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cfg.Listen != ":5900" || cfg.LogLevel != "info" {
+		t.Fatalf("unexpected defaults %q, %q", cfg.Listen, cfg.LogLevel)
+	}
+	target := cfg.Targets["alice"].target()
+	if target.Hostname != "10.0.0.1" || target.Port != 5900 || !target.ViewOnly {
+		t.Fatalf("unexpected target %+v", target)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/borderzero/vncproxy/proxy"
+	"github.com/borderzero/vncproxy/recorder"
+	"github.com/borderzero/vncproxy/server"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var VERSION = "dev"
+
+// shutdownTimeout bounds how long the sessions in progress get to end
+// after a SIGTERM.
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	configPath := flag.String("config", "", "path of the YAML or JSON configuration file")
+	version := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(VERSION)
+		return
+	}
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "missing -config")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config %s: %v\n", *configPath, err)
+		os.Exit(1)
+	}
+
+	level, _ := zapcore.ParseLevel(cfg.LogLevel)
+	logCfg := zap.NewProductionConfig()
+	logCfg.Level = zap.NewAtomicLevelAt(level)
+	logger, err := logCfg.Build()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create logger: %v\n", err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+
+	if err := run(cfg, logger); err != nil {
+		logger.Error("proxy stopped", zap.Error(err))
+		logger.Sync()
+		os.Exit(1)
+	}
+}
+
+func run(cfg *config, logger *zap.Logger) error {
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", cfg.Listen, err)
+	}
+
+	vp := &proxy.VncProxy{
+		Listener:            ln,
+		Target:              cfg.Target.target(),
+		SharedSessions:      cfg.SharedSessions,
+		RecordSession:       cfg.RecordingDir != "" || cfg.RecordingS3 != nil,
+		RecordingDir:        cfg.RecordingDir,
+		UpstreamVncPassword: cfg.Password,
+
+		RecordingNameTemplate: cfg.RecordingNameTemplate,
+	}
+	vp.RecordingOptions.Backpressure, _ = cfg.backpressure()
+	vp.RecordingOptions.SpillDir = cfg.RecordingSpillDir
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load the tls certificate: %v", err)
+		}
+		vp.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	if cfg.HtpasswdFile != "" {
+		auth, err := server.LoadHtpasswdFile(cfg.HtpasswdFile)
+		if err != nil {
+			return fmt.Errorf("failed to load the htpasswd file: %v", err)
+		}
+		vp.Authenticator = auth
+	}
+	if cfg.RecordingS3 != nil {
+		vp.RecordingOptions.Sink = cfg.RecordingS3.sink()
+	}
+	if cfg.RecordingKeyFile != "" {
+		key, err := recorder.ReadKeyFile(cfg.RecordingKeyFile, cfg.RecordingKeyId)
+		if err != nil {
+			return err
+		}
+		vp.RecordingOptions.Encryption = key
+	}
+	if cfg.RecordingSigningKeyFile != "" {
+		key, err := recorder.ReadSigningKeyFile(cfg.RecordingSigningKeyFile)
+		if err != nil {
+			return err
+		}
+		vp.RecordingOptions.SigningKey = key
+	}
+	if len(cfg.Targets) > 0 {
+		resolver := &proxy.StaticTargetResolver{
+			Targets: make(map[string]*proxy.Target),
+			Default: cfg.Target.target(),
+		}
+		for username, t := range cfg.Targets {
+			resolver.Targets[username] = t.target()
+		}
+		vp.TargetResolver = resolver
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- vp.Serve(ctx, logger)
+	}()
+	logger.Info("vnc proxy listening", zap.String("address", ln.Addr().String()))
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := vp.Shutdown(shutdownCtx); err != nil {
+		logger.Warn("sessions did not end cleanly", zap.Error(err))
+	}
+	return <-errc
+}
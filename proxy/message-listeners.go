@@ -1,10 +1,12 @@
 package proxy
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 
 	"github.com/borderzero/vncproxy/client"
 	"github.com/borderzero/vncproxy/common"
@@ -13,6 +15,32 @@ import (
 
 type ClientUpdater struct {
 	conn *client.ClientConn
+
+	// writeMu serializes writes of viewers sharing the same connection
+	writeMu *sync.Mutex
+
+	// viewOnly drops the input and clipboard messages of the vnc-client
+	viewOnly bool
+
+	// interceptors can rewrite or drop messages before they are written
+	// to the vnc-server
+	interceptors *common.ClientInterceptorChain
+
+	// forwarded, if set, receives the messages written to the vnc-server
+	forwarded common.SegmentConsumer
+
+	// session, if set, is shared with other vnc-clients, and decides
+	// which pixel format and encodings are requested upstream
+	session *session
+	viewer  *viewer
+}
+
+// viewOnlyMessages are the client messages forwarded for view-only
+// connections: the ones needed to receive the screen, but no input.
+var viewOnlyMessages = map[common.ClientMessageType]bool{
+	common.SetPixelFormatMsgType:           true,
+	common.SetEncodingsMsgType:             true,
+	common.FramebufferUpdateRequestMsgType: true,
 }
 
 // Consume recieves vnc-server-bound messages (Client messages) and updates the server part of the proxy
@@ -21,21 +49,74 @@ func (cc *ClientUpdater) Consume(seg *common.RfbSegment) error {
 
 	case common.SegmentFullyParsedClientMessage:
 		clientMsg := seg.Message.(common.ClientMessage)
+		if cc.viewOnly && !viewOnlyMessages[clientMsg.Type()] {
+			return nil
+		}
+		clientMsg, err := cc.interceptors.Intercept(clientMsg)
+		if err != nil {
+			return fmt.Errorf("ClientUpdater.Consume (vnc-server-bound, SegmentFullyParsedClientMessage): interceptor error: %s", err)
+		}
+		if clientMsg == nil {
+			return nil
+		}
 		switch clientMsg.Type() {
 
 		case common.SetPixelFormatMsgType:
 			// update pixel format
 			pixFmtMsg := clientMsg.(*server.MsgSetPixelFormat)
-			cc.conn.PixelFormat = pixFmtMsg.PF
+			if cc.session == nil {
+				cc.conn.PixelFormat = pixFmtMsg.PF
+				break
+			}
+			forward, err := cc.session.setPixelFormat(cc.viewer, pixFmtMsg.PF)
+			if err != nil {
+				return fmt.Errorf("ClientUpdater.Consume (vnc-server-bound, SetPixelFormat): %s", err)
+			}
+			if !forward {
+				return nil
+			}
+
+		case common.SetEncodingsMsgType:
+			if cc.session == nil {
+				break
+			}
+			encodings, err := cc.session.setEncodings(cc.viewer, clientMsg.(*server.MsgSetEncodings).Encodings)
+			if err != nil {
+				return fmt.Errorf("ClientUpdater.Consume (vnc-server-bound, SetEncodings): %s", err)
+			}
+			if encodings == nil {
+				return nil
+			}
+			clientMsg = &server.MsgSetEncodings{EncNum: uint16(len(encodings)), Encodings: encodings}
+		}
+		// serialize the message first, so it goes out in a single write
+		var buf bytes.Buffer
+		if err := clientMsg.Write(&buf); err != nil {
+			return fmt.Errorf("ClientUpdater.Consume (vnc-server-bound, SegmentFullyParsedClientMessage): problem serializing message: %s", err)
 		}
-		if err := clientMsg.Write(cc.conn); err != nil {
+		if err := cc.write(buf.Bytes()); err != nil {
 			return fmt.Errorf("ClientUpdater.Consume (vnc-server-bound, SegmentFullyParsedClientMessage): problem writing to port: %s", err)
 		}
+		if cc.forwarded != nil {
+			return cc.forwarded.Consume(&common.RfbSegment{
+				SegmentType: common.SegmentFullyParsedClientMessage,
+				Message:     clientMsg,
+			})
+		}
 		return nil
 	}
 	return nil
 }
 
+func (cc *ClientUpdater) write(b []byte) error {
+	if cc.writeMu != nil {
+		cc.writeMu.Lock()
+		defer cc.writeMu.Unlock()
+	}
+	_, err := cc.conn.Write(b)
+	return err
+}
+
 type ServerUpdater struct {
 	conn *server.ServerConn
 }
@@ -43,7 +124,9 @@ type ServerUpdater struct {
 func (p *ServerUpdater) Consume(seg *common.RfbSegment) error {
 	switch seg.SegmentType {
 	case common.SegmentMessageStart:
+	case common.SegmentMessageEnd:
 	case common.SegmentRectSeparator:
+	case common.SegmentFullyParsedServerMessage:
 	case common.SegmentServerInitMessage:
 		serverInitMessage := seg.Message.(*common.ServerInit)
 		p.conn.SetHeight(serverInitMessage.FBHeight)
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/borderzero/vncproxy/client"
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/server"
+)
+
+// testClientUpdater returns a ClientUpdater writing to a pipe, and the
+// other end of the pipe, which gets what is written to the vnc-server.
+func testClientUpdater(t *testing.T) (*ClientUpdater, net.Conn) {
+	upstream, c := net.Pipe()
+	t.Cleanup(func() { upstream.Close(); c.Close() })
+	conn, err := client.NewClientConn(c, &client.ClientConfig{})
+	if err != nil {
+		t.Fatalf("error creating the connection: %s", err)
+	}
+	return &ClientUpdater{conn: conn, interceptors: &common.ClientInterceptorChain{}}, upstream
+}
+
+// forward passes msg through cc, and returns what it wrote upstream.
+func forward(t *testing.T, cc *ClientUpdater, upstream net.Conn, msg common.ClientMessage) []byte {
+	written := make(chan []byte, 1)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, upstream)
+		written <- buf.Bytes()
+	}()
+	err := cc.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: msg})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cc.conn.Close()
+	return <-written
+}
+
+func serialize(t *testing.T, msg common.ClientMessage) []byte {
+	var buf bytes.Buffer
+	if err := msg.Write(&buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestClientUpdater_Interceptors(t *testing.T) {
+	// key events are dropped, and cut texts rewritten
+	interceptor := common.ClientMessageInterceptorFunc(func(msg common.ClientMessage) (common.ClientMessage, error) {
+		switch msg.(type) {
+		case *server.MsgKeyEvent:
+			return nil, nil
+		case *server.MsgClientCutText:
+			return &server.MsgClientCutText{Length: 8, Text: []byte("redacted")}, nil
+		}
+		return msg, nil
+	})
+	pointer := &server.MsgPointerEvent{Mask: 1, X: 10, Y: 20}
+	tests := []struct {
+		msg  common.ClientMessage
+		want []byte
+	}{
+		{&server.MsgKeyEvent{Down: 1, Key: 'a'}, nil},
+		{&server.MsgClientCutText{Length: 6, Text: []byte("secret")}, serialize(t, &server.MsgClientCutText{Length: 8, Text: []byte("redacted")})},
+		{pointer, serialize(t, pointer)},
+	}
+
+	for _, tt := range tests {
+		cc, upstream := testClientUpdater(t)
+		cc.interceptors.AddInterceptor(interceptor)
+		forwarded := &collector{}
+		cc.forwarded = forwarded
+		got := forward(t, cc, upstream, tt.msg)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%T: expected %v upstream, got %v", tt.msg, tt.want, got)
+		}
+		// the forwarded messages are the rewritten ones
+		if (len(forwarded.messages) == 1) != (tt.want != nil) ||
+			(tt.want != nil && !bytes.Equal(serialize(t, forwarded.messages[0]), tt.want)) {
+			t.Errorf("%T: unexpected forwarded messages %+v", tt.msg, forwarded.messages)
+		}
+	}
+}
+
+func TestClientUpdater_ViewOnly(t *testing.T) {
+	update := &server.MsgFramebufferUpdateRequest{Width: 4, Height: 2}
+	tests := []struct {
+		msg  common.ClientMessage
+		want []byte
+	}{
+		{&server.MsgKeyEvent{Down: 1, Key: 'a'}, nil},
+		{&server.MsgPointerEvent{Mask: 1}, nil},
+		{&server.MsgClientCutText{Length: 1, Text: []byte("x")}, nil},
+		{update, serialize(t, update)},
+	}
+	for _, tt := range tests {
+		cc, upstream := testClientUpdater(t)
+		cc.viewOnly = true
+		if got := forward(t, cc, upstream, tt.msg); !bytes.Equal(got, tt.want) {
+			t.Errorf("%T: expected %v upstream, got %v", tt.msg, tt.want, got)
+		}
+	}
+}
+
+// collector keeps the client messages it consumes.
+type collector struct {
+	messages []common.ClientMessage
+}
+
+func (c *collector) Consume(seg *common.RfbSegment) error {
+	if seg.SegmentType == common.SegmentFullyParsedClientMessage {
+		c.messages = append(c.messages, seg.Message.(common.ClientMessage))
+	}
+	return nil
+}
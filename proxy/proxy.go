@@ -2,10 +2,15 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/borderzero/vncproxy/client"
@@ -13,6 +18,7 @@ import (
 	"github.com/borderzero/vncproxy/encodings"
 	listeners "github.com/borderzero/vncproxy/recorder"
 	"github.com/borderzero/vncproxy/server"
+	"github.com/borderzero/vncproxy/transcript"
 	"go.uber.org/zap"
 )
 
@@ -29,6 +35,7 @@ var (
 		&encodings.CopyRectEncoding{},
 		&encodings.CoRREEncoding{},
 		&encodings.HextileEncoding{},
+		&encodings.EncDesktopNamePseudo{},
 	}
 )
 
@@ -36,25 +43,108 @@ type VncProxy struct {
 	Listener net.Listener
 	Target   *Target
 
+	// TargetResolver picks the target of each accepted connection.
+	// If nil, every connection is proxied to Target.
+	TargetResolver TargetResolver
+
+	// SharedSessions makes vnc-clients proxied to the same target, with
+	// the same credentials, share a single upstream connection, instead
+	// of each one opening its own exclusive connection. Shared sessions
+	// do not use the stateful encodings, such as ZRLE and Tight, and
+	// refuse the vnc-clients asking for another pixel format or
+	// encodings than the other vnc-clients of the session.
+	SharedSessions bool
+
+	// ClientInterceptors inspect, rewrite or drop the messages of every
+	// vnc-client before they are written to the target.
+	ClientInterceptors []common.ClientMessageInterceptor
+
+	// ServerInterceptors inspect, rewrite or drop the messages of the
+	// target before they are sent to the vnc-clients.
+	ServerInterceptors []common.ServerMessageInterceptor
+
+	// ClipboardPolicy, if set, filters the clipboard text exchanged
+	// between the vnc-clients and the target. It runs after the
+	// client and server interceptors.
+	ClipboardPolicy *ClipboardPolicy
+
+	// OnTranscriptLine, if set, receives the keystroke transcript of
+	// the sessions, line by line.
+	OnTranscriptLine func(sessionId string, line transcript.Line)
+
+	// EnableScreenshots decodes the screen of every session, so
+	// Screenshot can take pictures of it.
+	EnableScreenshots bool
+
+	// RecordSession records the sessions, to RecordingDir or to the
+	// sink of RecordingOptions if it has one.
 	RecordSession bool
 	RecordingDir  string
 
+	// RecordingNameTemplate names the recordings, see
+	// listeners.RecordingName. It must contain {session}, recordings
+	// never overwriting each other. Defaults to
+	// listeners.DefaultNameTemplate. Shared sessions are named after the
+	// vnc-client that started them.
+	RecordingNameTemplate string
+
+	// RecordingOptions configures the recorder of each session.
+	RecordingOptions listeners.RecorderOptions
+
 	UpstreamVncPassword string // password to require of border0 clients
+
+	// TLSConfig, if set, makes the vnc-clients connect with VeNCrypt:
+	// the connections are upgraded to TLS before the password, if any,
+	// is checked, and the session is proxied over TLS. Vnc-clients
+	// which do not support VeNCrypt are refused.
+	TLSConfig *tls.Config
+
+	// Authenticator, if set, checks the username and password of every
+	// vnc-client, with the VeNCrypt Plain subtypes, instead of
+	// UpstreamVncPassword. The vnc-clients are then identified by the
+	// Identity it returns. It requires TLSConfig.
+	Authenticator server.Authenticator
+
+	hubOnce  sync.Once
+	sessions *sessionHub
+	closing  atomic.Bool
+}
+
+// hub returns the sessions of the proxy.
+func (vp *VncProxy) hub() *sessionHub {
+	vp.hubOnce.Do(func() {
+		vp.sessions = newSessionHub()
+	})
+	return vp.sessions
 }
 
 func (vp *VncProxy) createClientConnection(target *Target, encodings ...common.IEncoding) (*client.ClientConn, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", target.Hostname, target.Port))
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Hostname, strconv.Itoa(int(target.Port))))
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to vnc server: %v", err)
 	}
+	auth := []client.ClientAuth{
+		&client.PasswordAuth{Password: target.Password},
+		&client.ClientAuthNone{},
+	}
+	if target.Username != "" {
+		auth = append([]client.ClientAuth{&client.ARDAuth{
+			Username: target.Username,
+			Password: target.Password,
+		}}, auth...)
+	}
+	if target.TLS != nil {
+		auth = []client.ClientAuth{&client.VeNCryptAuth{
+			TLSConfig: target.clientTLSConfig(),
+			Username:  target.Username,
+			Password:  target.Password,
+		}}
+	}
 	clientConn, err := client.NewClientConn(
 		conn,
 		&client.ClientConfig{
-			Auth: []client.ClientAuth{
-				&client.PasswordAuth{Password: target.Password},
-				&client.ClientAuthNone{},
-			},
-			Exclusive: true,
+			Auth:      auth,
+			Exclusive: !vp.SharedSessions,
 		},
 		encodings...,
 	)
@@ -64,48 +154,205 @@ func (vp *VncProxy) createClientConnection(target *Target, encodings ...common.I
 	return clientConn, nil
 }
 
+func (vp *VncProxy) resolveTarget(ctx context.Context, sconn *server.ServerConn) (*Target, error) {
+	if vp.TargetResolver == nil {
+		if vp.Target == nil {
+			return nil, ErrNoTarget
+		}
+		return vp.Target, nil
+	}
+	meta := &ConnMetadata{
+		SessionId:  sconn.SessionId,
+		Identity:   sconn.Identity,
+		RemoteAddr: sconn.RemoteAddr(),
+		LocalAddr:  sconn.LocalAddr(),
+	}
+	target, err := vp.TargetResolver.ResolveTarget(ctx, meta)
+	if err != nil {
+		return nil, err
+	}
+	if target == nil {
+		return nil, ErrNoTarget
+	}
+	return target, nil
+}
+
 func (vp *VncProxy) newServerConnHandler(
 	ctx context.Context,
 	logger *zap.Logger,
 	cfg *server.ServerConfig,
 	sconn *server.ServerConn,
 ) error {
-	cconn, err := vp.createClientConnection(vp.Target, allEncodings...)
+	target, err := vp.resolveTarget(ctx, sconn)
+	if err != nil {
+		return fmt.Errorf("Proxy.newServerConnHandler error resolving target: %v", err)
+	}
+
+	// each vnc-client gets its own upstream session, unless sessions
+	// are shared, in which case all clients of a target, reaching it with
+	// the same credentials, join the same one
+	key := sconn.SessionId
+	if vp.SharedSessions {
+		key = target.sessionKey()
+	}
+
+	v := newViewer(sconn)
+	sess, err := vp.hub().join(key, v, func(sess *session) error {
+		return vp.startSession(ctx, logger, sess, target, sconn.Identity)
+	})
+	if err != nil {
+		return fmt.Errorf("Proxy.newServerConnHandler error joining session: %v", err)
+	}
+
+	// gets the messages from the server part (from vnc-client),
+	// and write through the client to the actual vnc-server
+	clientUpdater := &ClientUpdater{
+		conn:         sess.conn,
+		writeMu:      &sess.writeMu,
+		viewOnly:     target.ViewOnly,
+		interceptors: &common.ClientInterceptorChain{},
+		forwarded:    sess.Input,
+		session:      sess,
+		viewer:       v,
+	}
+	for _, interceptor := range vp.ClientInterceptors {
+		clientUpdater.interceptors.AddInterceptor(interceptor)
+	}
+	if vp.ClipboardPolicy != nil {
+		clientUpdater.interceptors.AddInterceptor(&clipboardInterceptor{
+			policy:    vp.ClipboardPolicy,
+			sessionId: sess.Id,
+			logger:    logger,
+		})
+	}
+	sconn.Listeners.AddListener(&viewerListener{session: sess, viewer: v})
+	sconn.Listeners.AddListener(clientUpdater)
+	return nil
+}
+
+// startSession connects sess to the target VNC server.
+func (vp *VncProxy) startSession(ctx context.Context, logger *zap.Logger, sess *session, target *Target, identity *server.Identity) error {
+	cconn, err := vp.createClientConnection(target, allEncodings...)
 	if err != nil {
-		return fmt.Errorf("Proxy.newServerConnHandler error creating connection: %v", err)
+		return fmt.Errorf("error creating connection: %v", err)
 	}
+	sess.Target = target
+	sess.logger = logger
+	sess.stateless = vp.SharedSessions ||
+		(vp.RecordSession && vp.RecordingOptions.Backpressure == listeners.BackpressureDrop)
+
 	if vp.RecordSession {
-		recFile := "recording" + strconv.FormatInt(time.Now().Unix(), 10) + ".rbs"
+		opts := vp.RecordingOptions
+		opts.Session = listeners.SessionInfo{
+			Id:     sess.Id,
+			Target: net.JoinHostPort(target.Hostname, strconv.Itoa(int(target.Port))),
+		}
+		if identity != nil {
+			opts.Session.User = identity.Username
+		}
+		if opts.Logger == nil {
+			opts.Logger = logger.With(zap.String("session_id", sess.Id))
+		}
+		template := vp.RecordingNameTemplate
+		if template == "" {
+			template = listeners.DefaultNameTemplate
+		}
+		recFile := listeners.RecordingName(template, opts.Session, time.Now())
 		recPath := path.Join(vp.RecordingDir, recFile)
-		rec, err := listeners.NewRecorder(recPath)
+		if opts.Sink != nil {
+			// the sink decides where its files are stored
+			recPath = recFile
+		}
+		rec, err := listeners.NewRecorderWithOptions(recPath, opts)
 		if err != nil {
+			cconn.Close()
 			return fmt.Errorf("failed to open recorder save path %s: %v", recPath, err)
 		}
-		sconn.Listeners.AddListener(rec)
+		sess.recorder = rec
+		sess.Input.AddListener(rec)
 		cconn.Listeners.AddListener(rec)
 	}
 
-	// gets the bytes from the actual vnc server on the env (client part of the proxy)
-	// and writes them through the server socket to the vnc-client
-	serverUpdater := &ServerUpdater{sconn}
-	cconn.Listeners.AddListener(serverUpdater)
+	for _, interceptor := range vp.ServerInterceptors {
+		cconn.Interceptors.AddInterceptor(interceptor)
+	}
+	if vp.ClipboardPolicy != nil {
+		cconn.Interceptors.AddInterceptor(&clipboardInterceptor{
+			policy:    vp.ClipboardPolicy,
+			sessionId: sess.Id,
+			logger:    logger,
+		})
+	}
 
-	// gets the messages from the server part (from vnc-client),
-	// and write through the client to the actual vnc-server
-	clientUpdater := &ClientUpdater{cconn}
-	sconn.Listeners.AddListener(clientUpdater)
+	if vp.OnTranscriptLine != nil {
+		sessionId := sess.Id
+		transcriber := &transcript.Transcriber{OnLine: func(line transcript.Line) {
+			vp.OnTranscriptLine(sessionId, line)
+		}}
+		sess.Input.AddListener(transcriber)
+		// flushes the last line when the session ends
+		cconn.Listeners.AddListener(transcriber)
+	}
 
+	if vp.EnableScreenshots {
+		sess.framebuffer = client.NewFramebufferListener(cconn)
+		cconn.Listeners.AddListener(sess.framebuffer)
+	}
+
+	// gets the bytes from the actual vnc server on the env (client part of the proxy)
+	// and broadcasts them through the server sockets to the vnc-clients
+	cconn.Listeners.AddListener(sess)
+
+	if !sess.attach(cconn) {
+		// the proxy is shutting down
+		cconn.Close()
+		if sess.recorder != nil {
+			sess.recorder.SetCloseReason(closeReasonShutdown)
+			if err := sess.recorder.Close(); err != nil {
+				logger.Warn("session recording failed",
+					zap.String("session_id", sess.Id), zap.String("recording", sess.recorder.RBSFileName), zap.Error(err))
+			}
+		}
+		return errProxyClosing
+	}
 	if err = cconn.Connect(ctx, logger); err != nil {
+		// the connection never started, so the recorder was not closed
+		// with it
+		if sess.recorder != nil {
+			sess.recorder.SetCloseReason(closeReasonConnectFailed)
+			if err := sess.recorder.Close(); err != nil {
+				logger.Warn("session recording failed",
+					zap.String("session_id", sess.Id), zap.String("recording", sess.recorder.RBSFileName), zap.Error(err))
+			}
+		}
 		return fmt.Errorf("failed to connect to vnc target: %v", err)
 	}
 	return nil
 }
 
 func (vp *VncProxy) Serve(ctx context.Context, logger *zap.Logger) error {
+	if vp.ClipboardPolicy != nil {
+		if err := vp.ClipboardPolicy.Validate(); err != nil {
+			return fmt.Errorf("invalid clipboard policy: %v", err)
+		}
+	}
+	if vp.Authenticator != nil && vp.TLSConfig == nil {
+		return errors.New("an authenticator requires a tls configuration")
+	}
+	if vp.RecordingNameTemplate != "" && !strings.Contains(vp.RecordingNameTemplate, "{session}") {
+		return errors.New("the recording name template must contain {session}")
+	}
 	secHandlers := []server.SecurityHandler{&server.ServerAuthNone{}}
 	if vp.UpstreamVncPassword != "" {
 		secHandlers = []server.SecurityHandler{&server.ServerAuthVNC{Pass: vp.UpstreamVncPassword}}
 	}
+	if vp.TLSConfig != nil {
+		secHandlers = []server.SecurityHandler{&server.ServerAuthVeNCrypt{
+			TLSConfig:     vp.TLSConfig,
+			Password:      vp.UpstreamVncPassword,
+			Authenticator: vp.Authenticator,
+		}}
+	}
 	cfg := &server.ServerConfig{
 		SecurityHandlers: secHandlers,
 		Encodings:        []common.IEncoding{&encodings.RawEncoding{}, &encodings.TightEncoding{}, &encodings.CopyRectEncoding{}},
@@ -115,11 +362,37 @@ func (vp *VncProxy) Serve(ctx context.Context, logger *zap.Logger) error {
 		Height:           uint16(768),
 		Width:            uint16(1024),
 		NewConnHandler:   vp.newServerConnHandler,
-		UseDummySession:  true,
+		UseDummySession:  false,
 	}
 
 	if err := server.Serve(ctx, logger, vp.Listener, cfg); err != nil {
+		if vp.closing.Load() {
+			return nil
+		}
 		return fmt.Errorf("failed to serve vnc proxy: %v", err)
 	}
 	return nil
 }
+
+// Shutdown stops accepting vnc-clients, disconnects the sessions in
+// progress, including the ones still connecting, and waits for them to
+// end, or for ctx to be done. Serve returns nil once Shutdown was called.
+func (vp *VncProxy) Shutdown(ctx context.Context) error {
+	vp.closing.Store(true)
+	err := vp.Listener.Close()
+	hub := vp.hub()
+	for _, s := range hub.close() {
+		s.disconnect(closeReasonShutdown)
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for hub.len() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/borderzero/vncproxy/server"
+)
+
+// ErrNoTarget is returned by a TargetResolver that has no target
+// for a connection.
+var ErrNoTarget = errors.New("no vnc target for connection")
+
+// ConnMetadata describes an accepted vnc-client connection, as seen
+// by a TargetResolver.
+type ConnMetadata struct {
+	// SessionId identifies the vnc-client connection.
+	SessionId string
+
+	// Identity is the authenticated principal behind the connection,
+	// or nil when the security handler used does not establish one.
+	Identity *server.Identity
+
+	// RemoteAddr is the address of the vnc-client.
+	RemoteAddr net.Addr
+
+	// LocalAddr is the proxy address the vnc-client connected to.
+	LocalAddr net.Addr
+}
+
+// Username returns the authenticated username, or an empty string
+// for anonymous connections.
+func (m *ConnMetadata) Username() string {
+	if m.Identity == nil {
+		return ""
+	}
+	return m.Identity.Username
+}
+
+// A TargetResolver picks the VNC server a vnc-client connection
+// is proxied to.
+type TargetResolver interface {
+	ResolveTarget(ctx context.Context, meta *ConnMetadata) (*Target, error)
+}
+
+// TargetResolverFunc adapts an ordinary function to a TargetResolver.
+type TargetResolverFunc func(ctx context.Context, meta *ConnMetadata) (*Target, error)
+
+func (f TargetResolverFunc) ResolveTarget(ctx context.Context, meta *ConnMetadata) (*Target, error) {
+	return f(ctx, meta)
+}
+
+// StaticTargetResolver routes connections using a fixed map keyed by
+// the authenticated username.
+type StaticTargetResolver struct {
+	// Targets maps usernames to the target they are proxied to.
+	Targets map[string]*Target
+
+	// Default is used for usernames missing from Targets and for
+	// anonymous connections. If nil, such connections are rejected.
+	Default *Target
+}
+
+func (r *StaticTargetResolver) ResolveTarget(ctx context.Context, meta *ConnMetadata) (*Target, error) {
+	if target, ok := r.Targets[meta.Username()]; ok {
+		return target, nil
+	}
+	if r.Default != nil {
+		return r.Default, nil
+	}
+	return nil, ErrNoTarget
+}
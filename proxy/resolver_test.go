@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/borderzero/vncproxy/server"
+)
+
+func TestStaticTargetResolver(t *testing.T) {
+	alice := &Target{Hostname: "10.0.0.1", Port: 5900}
+	fallback := &Target{Hostname: "10.0.0.2", Port: 5900}
+
+	tests := []struct {
+		name     string
+		resolver *StaticTargetResolver
+		identity *server.Identity
+		want     *Target
+		err      error
+	}{
+		{"by username", &StaticTargetResolver{Targets: map[string]*Target{"alice": alice}, Default: fallback}, &server.Identity{Username: "alice"}, alice, nil},
+		{"unknown username", &StaticTargetResolver{Targets: map[string]*Target{"alice": alice}, Default: fallback}, &server.Identity{Username: "bob"}, fallback, nil},
+		{"anonymous", &StaticTargetResolver{Targets: map[string]*Target{"alice": alice}, Default: fallback}, nil, fallback, nil},
+		{"no default", &StaticTargetResolver{Targets: map[string]*Target{"alice": alice}}, &server.Identity{Username: "bob"}, nil, ErrNoTarget},
+		{"anonymous without default", &StaticTargetResolver{Targets: map[string]*Target{"alice": alice}}, nil, nil, ErrNoTarget},
+	}
+	for _, tt := range tests {
+		got, err := tt.resolver.ResolveTarget(context.Background(), &ConnMetadata{Identity: tt.identity})
+		if got != tt.want || err != tt.err {
+			t.Errorf("%s: expected %v, %v, got %v, %v", tt.name, tt.want, tt.err, got, err)
+		}
+	}
+}
+
+// testServerConn returns a vnc-client connection of the given identity.
+func testServerConn(t *testing.T, identity *server.Identity) *server.ServerConn {
+	c, sc := net.Pipe()
+	t.Cleanup(func() { c.Close() })
+	conn, err := server.NewServerConn(sc, &server.ServerConfig{ClientMessages: server.DefaultClientMessages})
+	if err != nil {
+		t.Fatalf("error creating the connection: %s", err)
+	}
+	conn.SessionId = "session-1"
+	conn.Identity = identity
+	return conn
+}
+
+func TestResolveTarget(t *testing.T) {
+	target := &Target{Hostname: "10.0.0.1", Port: 5900}
+	errResolver := errors.New("directory unavailable")
+
+	var meta *ConnMetadata
+	tests := []struct {
+		name string
+		vp   *VncProxy
+		want *Target
+		err  error
+	}{
+		{"no resolver", &VncProxy{Target: target}, target, nil},
+		{"no resolver nor target", &VncProxy{}, nil, ErrNoTarget},
+		{
+			name: "resolver",
+			vp: &VncProxy{Target: &Target{Hostname: "ignored"}, TargetResolver: TargetResolverFunc(func(ctx context.Context, m *ConnMetadata) (*Target, error) {
+				meta = m
+				return target, nil
+			})},
+			want: target,
+		},
+		{
+			name: "resolver error",
+			vp: &VncProxy{TargetResolver: TargetResolverFunc(func(ctx context.Context, m *ConnMetadata) (*Target, error) {
+				return nil, errResolver
+			})},
+			err: errResolver,
+		},
+		{
+			name: "resolver without target",
+			vp: &VncProxy{TargetResolver: TargetResolverFunc(func(ctx context.Context, m *ConnMetadata) (*Target, error) {
+				return nil, nil
+			})},
+			err: ErrNoTarget,
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.vp.resolveTarget(context.Background(), testServerConn(t, &server.Identity{Username: "alice"}))
+		if got != tt.want || err != tt.err {
+			t.Errorf("%s: expected %v, %v, got %v, %v", tt.name, tt.want, tt.err, got, err)
+		}
+	}
+
+	// the resolver is given the metadata of the connection
+	if meta == nil || meta.SessionId != "session-1" || meta.Username() != "alice" || meta.RemoteAddr == nil {
+		t.Fatalf("unexpected connection metadata %+v", meta)
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+var (
+	// ErrSessionNotFound is returned for a session id that is not connected.
+	ErrSessionNotFound = errors.New("vnc session not found")
+
+	// ErrScreenshotsDisabled is returned by Screenshot when the proxy
+	// does not decode the sessions it proxies.
+	ErrScreenshotsDisabled = errors.New("screenshots are not enabled")
+)
+
+// ImageFormat is the encoding of a screenshot.
+type ImageFormat int
+
+const (
+	ImagePNG ImageFormat = iota
+	ImageJPEG
+)
+
+// ScreenshotOptions configures a screenshot.
+type ScreenshotOptions struct {
+	Format ImageFormat
+
+	// Crop, if not empty, restricts the screenshot to a rectangle of
+	// the desktop.
+	Crop image.Rectangle
+
+	// JPEGQuality is the quality of ImageJPEG screenshots, from 1 to
+	// 100; zero means jpeg.DefaultQuality.
+	JPEGQuality int
+}
+
+// SessionInfo describes an upstream session of the proxy.
+type SessionInfo struct {
+	Id      string
+	Target  *Target
+	Viewers int
+	// ViewerSessionIds are the SessionId of the vnc-clients viewing the
+	// session.
+	ViewerSessionIds []string
+	DesktopName      string
+}
+
+// Sessions returns the sessions currently connected upstream.
+func (vp *VncProxy) Sessions() []SessionInfo {
+	var infos []SessionInfo
+	for _, s := range vp.hub().list() {
+		infos = append(infos, s.info())
+	}
+	return infos
+}
+
+// Screenshot writes an image of the desktop of the session sessionId
+// to w: the id of an upstream session, or the SessionId of one of its
+// vnc-clients. It requires EnableScreenshots.
+func (vp *VncProxy) Screenshot(w io.Writer, sessionId string, opts *ScreenshotOptions) error {
+	if !vp.EnableScreenshots {
+		return ErrScreenshotsDisabled
+	}
+	if opts == nil {
+		opts = &ScreenshotOptions{}
+	}
+	sess := vp.hub().find(sessionId)
+	if sess == nil {
+		return ErrSessionNotFound
+	}
+
+	fb := sess.framebuffer.Framebuffer()
+	if fb == nil {
+		return errors.New("session desktop is not initialized yet")
+	}
+	if err := sess.framebuffer.Err(); err != nil {
+		return fmt.Errorf("session desktop could not be decoded: %v", err)
+	}
+	var img image.Image = fb.Image()
+	if !opts.Crop.Empty() {
+		crop := opts.Crop.Intersect(img.Bounds())
+		if crop.Empty() {
+			return fmt.Errorf("crop rectangle %v is outside of the desktop %v", opts.Crop, img.Bounds())
+		}
+		img = img.(*image.RGBA).SubImage(crop)
+	}
+
+	switch opts.Format {
+	case ImagePNG:
+		return png.Encode(w, img)
+	case ImageJPEG:
+		quality := opts.JPEGQuality
+		if quality == 0 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+	return fmt.Errorf("unknown image format %d", opts.Format)
+}
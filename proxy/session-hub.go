@@ -0,0 +1,562 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/borderzero/vncproxy/client"
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/encodings"
+	listeners "github.com/borderzero/vncproxy/recorder"
+	"github.com/borderzero/vncproxy/server"
+	"go.uber.org/zap"
+)
+
+// Reasons a session ended, as written in the metadata of its recording,
+// besides the ones of the recorder.
+const (
+	closeReasonViewersLeft   = "viewers_left"
+	closeReasonShutdown      = "proxy_shutdown"
+	closeReasonConnectFailed = "connect_failed"
+)
+
+// sessionHub tracks the upstream sessions of a VncProxy, keyed so that
+// vnc-clients resolving to the same session share one upstream connection.
+type sessionHub struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	closed   bool
+}
+
+// errProxyClosing refuses the vnc-clients connecting while the proxy
+// shuts down.
+var errProxyClosing = errors.New("the proxy is shutting down")
+
+func newSessionHub() *sessionHub {
+	return &sessionHub{sessions: make(map[string]*session)}
+}
+
+// join attaches a vnc-client to the session stored under key, calling start
+// to connect a new session if there is none yet.
+func (h *sessionHub) join(key string, v *viewer, start func(*session) error) (*session, error) {
+	for {
+		h.mu.Lock()
+		if h.closed {
+			h.mu.Unlock()
+			return nil, errProxyClosing
+		}
+		s, ok := h.sessions[key]
+		if !ok {
+			s = newSession(h, key)
+			h.sessions[key] = s
+		}
+		h.mu.Unlock()
+
+		if !ok {
+			s.err = start(s)
+			close(s.ready)
+			if s.err != nil {
+				h.remove(s)
+				return nil, s.err
+			}
+		}
+		<-s.ready
+		if s.err != nil {
+			return nil, s.err
+		}
+		if s.addViewer(v) {
+			return s, nil
+		}
+		// the session is shutting down, make sure it is gone and retry
+		h.remove(s)
+	}
+}
+
+// remove forgets s, unless it has already been replaced by a newer session.
+func (h *sessionHub) remove(s *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions[s.key] == s {
+		delete(h.sessions, s.key)
+	}
+}
+
+// find returns the session connected upstream with the id of the session
+// or of one of its viewers, nil if there is none.
+func (h *sessionHub) find(id string) *session {
+	for _, s := range h.list() {
+		if s.hasId(id) {
+			return s
+		}
+	}
+	return nil
+}
+
+// close refuses the vnc-clients joining from now on, and returns every
+// session, including the ones still connecting upstream.
+func (h *sessionHub) close() []*session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	sessions := make([]*session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// len returns the number of sessions, connected or still connecting.
+func (h *sessionHub) len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.sessions)
+}
+
+// list returns a snapshot of the sessions currently connected upstream.
+func (h *sessionHub) list() []*session {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sessions := make([]*session, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		select {
+		case <-s.ready:
+			if s.err == nil {
+				sessions = append(sessions, s)
+			}
+		default:
+		}
+	}
+	return sessions
+}
+
+// Bounds of the queue of upstream bytes waiting to be written to a
+// viewer. A viewer whose queue fills up is disconnected, rather than
+// slowing down the session for the other viewers.
+const (
+	viewerQueueLength = 8192
+	viewerQueueBytes  = 16 << 20
+)
+
+// viewer is a vnc-client attached to a session.
+type viewer struct {
+	conn    *server.ServerConn
+	updater *ServerUpdater
+
+	// ready is set once the vnc-client finished its handshake,
+	// active once it started receiving upstream messages.
+	ready  bool
+	active bool
+
+	// queue holds the upstream bytes written to the vnc-client by its
+	// own goroutine, queued their size, until done is closed.
+	queue  chan []byte
+	queued atomic.Int64
+	done   chan struct{}
+}
+
+func newViewer(conn *server.ServerConn) *viewer {
+	return &viewer{
+		conn:    conn,
+		updater: &ServerUpdater{conn},
+		queue:   make(chan []byte, viewerQueueLength),
+		done:    make(chan struct{}),
+	}
+}
+
+// enqueue queues b to be written to the vnc-client. It reports false if
+// the queue is full.
+func (v *viewer) enqueue(b []byte) bool {
+	if v.queued.Add(int64(len(b))) > viewerQueueBytes {
+		v.queued.Add(-int64(len(b)))
+		return false
+	}
+	select {
+	case v.queue <- b:
+		return true
+	default:
+		v.queued.Add(-int64(len(b)))
+		return false
+	}
+}
+
+// session is one upstream connection to a VNC server, fanned out to
+// every vnc-client viewing it. Each viewer is written to by its own
+// goroutine, from a bounded queue.
+//
+// All viewers share the pixel format and encodings of the session. A
+// viewer alone in the session sets them, the ones joining it must accept
+// them: a viewer asking for another pixel format, or not supporting all
+// the encodings of the session, is refused.
+type session struct {
+	Id     string
+	Target *Target
+
+	hub    *sessionHub
+	key    string
+	logger *zap.Logger
+	conn   *client.ClientConn
+
+	// stateless sessions leave out the stateful encodings, which viewers
+	// joining in the middle of a shared session could not decode, and
+	// which a recording dropping messages could not play
+	stateless bool
+
+	// Input receives the client messages of every viewer that were
+	// forwarded upstream.
+	Input *common.MultiListener
+
+	// writeMu serializes messages written upstream by different viewers.
+	writeMu sync.Mutex
+
+	// framebuffer decodes the upstream screen, when screenshots are enabled.
+	framebuffer *client.FramebufferListener
+
+	// recorder records the session, when recording is enabled.
+	recorder *listeners.Recorder
+
+	ready chan struct{}
+	err   error
+
+	mu          sync.Mutex
+	viewers     []*viewer
+	serverInit  *common.ServerInit
+	desktopName string
+	closed      bool
+
+	// disconnected is set once the session was disconnected before it
+	// could attach its connection.
+	disconnected bool
+
+	// encodings are the encodings requested upstream, nil if none was.
+	// The pixel format is the one of conn.
+	encodings []common.EncodingType
+}
+
+func newSession(hub *sessionHub, key string) *session {
+	return &session{
+		Id:    server.NewSessionId(),
+		hub:   hub,
+		key:   key,
+		Input: &common.MultiListener{},
+		ready: make(chan struct{}),
+	}
+}
+
+// attach sets the upstream connection of the session, before it is
+// connected. It reports false if the session was disconnected meanwhile.
+func (s *session) attach(conn *client.ClientConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disconnected {
+		return false
+	}
+	s.conn = conn
+	return true
+}
+
+// disconnect closes the upstream connection of the session for reason,
+// or prevents the session from attaching one if it is still starting.
+func (s *session) disconnect(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		s.disconnected = true
+		return
+	}
+	if s.recorder != nil {
+		s.recorder.SetCloseReason(reason)
+	}
+	s.conn.Close()
+}
+
+// addViewer attaches v to the session, initializing its connection from
+// the upstream ServerInit. It reports false if the session is closed.
+func (s *session) addViewer(v *viewer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.serverInit != nil {
+		srvInit := *s.serverInit
+		srvInit.PixelFormat = s.conn.PixelFormat
+		v.updater.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &srvInit})
+	}
+	s.viewers = append(s.viewers, v)
+	if s.recorder != nil {
+		var user string
+		if v.conn.Identity != nil {
+			user = v.conn.Identity.Username
+		}
+		s.recorder.ViewerJoined(v.conn.SessionId, user)
+	}
+	go s.writeViewer(v)
+	return true
+}
+
+// writeViewer writes the queue of v to its vnc-client, until v leaves.
+func (s *session) writeViewer(v *viewer) {
+	for {
+		select {
+		case b := <-v.queue:
+			v.queued.Add(-int64(len(b)))
+			seg := &common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: b}
+			if err := v.updater.Consume(seg); err != nil {
+				s.dropViewer(v, err)
+				return
+			}
+		case <-v.done:
+			return
+		}
+	}
+}
+
+// dropViewer disconnects v from the session.
+func (s *session) dropViewer(v *viewer, reason error) {
+	s.logger.Warn("dropping vnc-client from session",
+		zap.String("session_id", s.Id), zap.String("viewer_session_id", v.conn.SessionId), zap.Error(reason))
+	v.conn.Close()
+	s.removeViewer(v)
+}
+
+// removeViewer detaches v, closing the upstream connection once the
+// last viewer is gone.
+func (s *session) removeViewer(v *viewer) {
+	s.mu.Lock()
+	for i, cur := range s.viewers {
+		if cur == v {
+			s.viewers = append(s.viewers[:i], s.viewers[i+1:]...)
+			close(v.done)
+			if s.recorder != nil {
+				s.recorder.ViewerLeft(v.conn.SessionId)
+			}
+			break
+		}
+	}
+	last := len(s.viewers) == 0 && !s.closed
+	if last {
+		s.closed = true
+	}
+	s.mu.Unlock()
+
+	if last {
+		s.hub.remove(s)
+		if s.recorder != nil {
+			s.recorder.SetCloseReason(closeReasonViewersLeft)
+		}
+		s.conn.Close()
+	}
+}
+
+// alone reports whether v is the only viewer of the session.
+func (s *session) alone(v *viewer) bool {
+	return len(s.viewers) == 1 && s.viewers[0] == v
+}
+
+// setPixelFormat handles the pixel format requested by v. It reports
+// whether the request must be forwarded upstream, and fails if v shares
+// the session with viewers using another pixel format.
+func (s *session) setPixelFormat(v *viewer, pf common.PixelFormat) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.alone(v) {
+		s.conn.PixelFormat = pf
+		return true, nil
+	}
+	if pf != s.conn.PixelFormat {
+		return false, fmt.Errorf("the shared session uses the pixel format %+v, not %+v", s.conn.PixelFormat, pf)
+	}
+	return false, nil
+}
+
+// setEncodings handles the encodings requested by v. It returns the
+// encodings to request upstream, nil if none are, and fails if v shares
+// the session with viewers using encodings v does not support.
+func (s *session) setEncodings(v *viewer, encodings []common.EncodingType) ([]common.EncodingType, error) {
+	if s.stateless {
+		encodings = statelessEncodings(encodings)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.alone(v) {
+		s.encodings = encodings
+		return encodings, nil
+	}
+	supported := make(map[common.EncodingType]bool, len(encodings))
+	for _, enc := range encodings {
+		supported[enc] = true
+	}
+	for _, enc := range s.encodings {
+		if !supported[enc] && !preferenceEncoding(enc) {
+			return nil, fmt.Errorf("the shared session uses the encoding %s, which the vnc-client does not support", enc)
+		}
+	}
+	return nil, nil
+}
+
+// statelessEncodings returns encodings without the stateful ones.
+func statelessEncodings(encodings []common.EncodingType) []common.EncodingType {
+	stateless := make([]common.EncodingType, 0, len(encodings))
+	for _, enc := range encodings {
+		if !enc.Stateful() {
+			stateless = append(stateless, enc)
+		}
+	}
+	return stateless
+}
+
+// preferenceEncoding reports whether enc is a pseudo-encoding that only
+// states a preference, such as a JPEG quality or a compression level,
+// and has no effect on the ability of a vnc-client to decode the screen.
+func preferenceEncoding(enc common.EncodingType) bool {
+	return (enc >= common.EncJPEGQualityLevelPseudo1 && enc <= common.EncJPEGQualityLevelPseudo10) ||
+		(enc >= common.EncCompressionLevel1 && enc <= common.EncCompressionLevel10)
+}
+
+func (s *session) markReady(v *viewer) {
+	s.mu.Lock()
+	v.ready = true
+	s.mu.Unlock()
+}
+
+// Viewers returns the number of vnc-clients attached to the session.
+func (s *session) Viewers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.viewers)
+}
+
+// info returns a snapshot of the session.
+func (s *session) info() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := SessionInfo{
+		Id:          s.Id,
+		Target:      s.Target,
+		Viewers:     len(s.viewers),
+		DesktopName: s.desktopName,
+	}
+	for _, v := range s.viewers {
+		info.ViewerSessionIds = append(info.ViewerSessionIds, v.conn.SessionId)
+	}
+	return info
+}
+
+// hasId reports whether id is the id of the session, or the SessionId of
+// one of its viewers.
+func (s *session) hasId(id string) bool {
+	if id == s.Id {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range s.viewers {
+		if v.conn.SessionId == id {
+			return true
+		}
+	}
+	return false
+}
+
+// trackDesktopName follows the renames of the desktop.
+func (s *session) trackDesktopName(msg *client.MsgFramebufferUpdate) {
+	for _, rect := range msg.Rectangles {
+		if enc, ok := rect.Enc.(*encodings.EncDesktopNamePseudo); ok {
+			s.mu.Lock()
+			s.desktopName = string(enc.Name)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Consume receives the segments read from the VNC server and queues
+// their bytes to the viewers. Viewers are only switched on at message
+// boundaries, so each one receives whole messages.
+func (s *session) Consume(seg *common.RfbSegment) error {
+	switch seg.SegmentType {
+	case common.SegmentServerInitMessage:
+		s.mu.Lock()
+		s.serverInit = seg.Message.(*common.ServerInit)
+		s.desktopName = string(s.serverInit.NameText)
+		s.mu.Unlock()
+		return nil
+	case common.SegmentFullyParsedServerMessage:
+		if msg, ok := seg.Message.(*client.MsgFramebufferUpdate); ok {
+			s.trackDesktopName(msg)
+		}
+		return nil
+	case common.SegmentConnectionClosed:
+		s.shutdown()
+		return nil
+	}
+
+	s.mu.Lock()
+	active := make([]*viewer, 0, len(s.viewers))
+	for _, v := range s.viewers {
+		if !v.active && v.ready && seg.SegmentType == common.SegmentMessageStart {
+			v.active = true
+		}
+		if v.active {
+			active = append(active, v)
+		}
+	}
+	s.mu.Unlock()
+
+	if seg.SegmentType != common.SegmentBytes || len(active) == 0 {
+		return nil
+	}
+	// the reader may reuse the buffer once Consume returns
+	b := append([]byte(nil), seg.Bytes...)
+	for _, v := range active {
+		if !v.enqueue(b) {
+			s.dropViewer(v, errViewerTooSlow)
+		}
+	}
+	return nil
+}
+
+// errViewerTooSlow is the reason viewers which fell behind are dropped.
+var errViewerTooSlow = errors.New("vnc-client is too slow, its queue is full")
+
+// shutdown is called once the upstream connection is gone, and
+// disconnects every remaining viewer.
+func (s *session) shutdown() {
+	s.mu.Lock()
+	s.closed = true
+	viewers := s.viewers
+	s.viewers = nil
+	s.mu.Unlock()
+
+	s.hub.remove(s)
+	for _, v := range viewers {
+		close(v.done)
+		v.conn.Close()
+	}
+
+	// the recorder closed itself with the connection
+	if s.recorder != nil {
+		if err := s.recorder.Close(); err != nil {
+			s.logger.Warn("session recording failed",
+				zap.String("session_id", s.Id), zap.String("recording", s.recorder.RBSFileName), zap.Error(err))
+		}
+	}
+}
+
+// viewerListener follows the client messages of a viewer to know
+// when it can start receiving upstream messages and when it leaves.
+type viewerListener struct {
+	session *session
+	viewer  *viewer
+}
+
+func (l *viewerListener) Consume(seg *common.RfbSegment) error {
+	switch seg.SegmentType {
+	case common.SegmentFullyParsedClientMessage:
+		l.session.markReady(l.viewer)
+	case common.SegmentConnectionClosed:
+		l.session.removeViewer(l.viewer)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/borderzero/vncproxy/client"
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/encodings"
+	"github.com/borderzero/vncproxy/server"
+	"go.uber.org/zap"
+)
+
+// testViewer attaches a viewer to s over a pipe, and returns the other
+// end of the pipe.
+func testViewer(t *testing.T, s *session) (*viewer, net.Conn) {
+	c, sc := net.Pipe()
+	t.Cleanup(func() { c.Close() })
+	conn, err := server.NewServerConn(sc, &server.ServerConfig{ClientMessages: server.DefaultClientMessages})
+	if err != nil {
+		t.Fatalf("error creating the connection: %s", err)
+	}
+	v := newViewer(conn)
+	if !s.addViewer(v) {
+		t.Fatal("the session is closed")
+	}
+	s.markReady(v)
+	return v, c
+}
+
+func TestSessionDropsSlowViewer(t *testing.T) {
+	s := newSession(newSessionHub(), "key")
+	s.logger = zap.NewNop()
+	upstream, _ := net.Pipe()
+	s.conn, _ = client.NewClientConn(upstream, &client.ClientConfig{})
+
+	fast, fastConn := testViewer(t, s)
+	received := make(chan error)
+	go func() {
+		_, err := io.ReadFull(fastConn, make([]byte, viewerQueueLength+2))
+		received <- err
+	}()
+	// the slow viewer never reads
+	slow, _ := testViewer(t, s)
+
+	s.Consume(&common.RfbSegment{SegmentType: common.SegmentMessageStart})
+	for i := 0; i < viewerQueueLength+2; i++ {
+		// let the fast viewer keep up
+		for len(fast.queue) > viewerQueueLength/2 {
+			time.Sleep(time.Millisecond)
+		}
+		s.Consume(&common.RfbSegment{SegmentType: common.SegmentBytes, Bytes: []byte{byte(i)}})
+	}
+
+	select {
+	case <-slow.done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the slow viewer to be dropped")
+	}
+	if n := s.Viewers(); n != 1 {
+		t.Fatalf("expected 1 viewer left, got %d", n)
+	}
+
+	// the fast viewer got everything
+	if err := <-received; err != nil {
+		t.Fatalf("the fast viewer did not receive every byte: %s", err)
+	}
+}
+
+func TestSessionPinsPixelFormatAndEncodings(t *testing.T) {
+	s := newSession(newSessionHub(), "key")
+	s.logger = zap.NewNop()
+	s.stateless = true
+	upstream, _ := net.Pipe()
+	s.conn, _ = client.NewClientConn(upstream, &client.ClientConfig{})
+
+	first, _ := testViewer(t, s)
+	pf := *common.NewPixelFormat(32)
+	if forward, err := s.setPixelFormat(first, pf); !forward || err != nil {
+		t.Fatalf("expected the pixel format of a lone viewer to be forwarded, got %v, %v", forward, err)
+	}
+	encodings, err := s.setEncodings(first, []common.EncodingType{
+		common.EncZRLE, common.EncHextile, common.EncRaw, common.EncCursorPseudo, common.EncCompressionLevel9,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []common.EncodingType{common.EncHextile, common.EncRaw, common.EncCursorPseudo, common.EncCompressionLevel9}
+	if fmt.Sprint(encodings) != fmt.Sprint(want) {
+		t.Fatalf("expected the stateful encodings to be left out, got %v", encodings)
+	}
+
+	second, _ := testViewer(t, s)
+	if forward, err := s.setPixelFormat(second, pf); forward || err != nil {
+		t.Fatalf("expected the same pixel format to be accepted and not forwarded, got %v, %v", forward, err)
+	}
+	if _, err := s.setPixelFormat(second, *common.NewPixelFormat(16)); err == nil {
+		t.Fatal("expected another pixel format to be refused")
+	}
+	if encodings, err := s.setEncodings(second, []common.EncodingType{common.EncRaw, common.EncHextile, common.EncCursorPseudo}); encodings != nil || err != nil {
+		t.Fatalf("expected encodings covering the session to be accepted and not forwarded, got %v, %v", encodings, err)
+	}
+	if _, err := s.setEncodings(second, []common.EncodingType{common.EncRaw, common.EncHextile}); err == nil {
+		t.Fatal("expected encodings missing the cursor pseudo-encoding to be refused")
+	}
+}
+
+func TestSessionsInfo(t *testing.T) {
+	vp := &VncProxy{}
+	hub := vp.hub()
+	s := newSession(hub, "key")
+	s.Target = &Target{Hostname: "localhost", Port: 5901}
+	hub.sessions["key"] = s
+	close(s.ready)
+	v, _ := testViewer(t, s)
+	v.conn.SessionId = "viewer-1"
+
+	s.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{NameText: []byte("desktop")}})
+	s.Consume(&common.RfbSegment{
+		SegmentType: common.SegmentFullyParsedServerMessage,
+		Message: &client.MsgFramebufferUpdate{Rectangles: []common.Rectangle{
+			{Enc: &encodings.EncDesktopNamePseudo{Name: []byte("renamed")}},
+		}},
+	})
+
+	infos := vp.Sessions()
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 session, got %+v", infos)
+	}
+	info := infos[0]
+	if info.Id != s.Id || info.Viewers != 1 || info.DesktopName != "renamed" ||
+		len(info.ViewerSessionIds) != 1 || info.ViewerSessionIds[0] != "viewer-1" {
+		t.Fatalf("unexpected session %+v", info)
+	}
+
+	// sessions are found by their id or by the SessionId of a viewer
+	for _, id := range []string{s.Id, "viewer-1"} {
+		if hub.find(id) != s {
+			t.Errorf("session %s not found", id)
+		}
+	}
+	if hub.find("viewer-2") != nil {
+		t.Error("unexpected session for an unknown id")
+	}
+}
+
+func TestShutdownDisconnectsStartingSessions(t *testing.T) {
+	// a vnc-server which accepts connections but never sends its version
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer upstream.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := upstream.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	vp := &VncProxy{Listener: ln}
+	target := &Target{Hostname: "127.0.0.1", Port: uint16(upstream.Addr().(*net.TCPAddr).Port)}
+	joined := make(chan error, 1)
+	go func() {
+		_, err := vp.hub().join("key", newViewer(nil), func(s *session) error {
+			return vp.startSession(context.Background(), zap.NewNop(), s, target, nil)
+		})
+		joined <- err
+	}()
+	conn := <-accepted
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := vp.Shutdown(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := <-joined; err == nil {
+		t.Fatal("expected the starting session to fail")
+	}
+	if _, err := vp.hub().join("key", newViewer(nil), nil); err != errProxyClosing {
+		t.Fatalf("expected %v, got %v", errProxyClosing, err)
+	}
+}
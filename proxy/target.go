@@ -1,9 +1,124 @@
 package proxy
 
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
+	"net"
+	"sort"
+	"strconv"
+)
+
 // Target represents the VNC server
 // we wish to proxy traffic to.
 type Target struct {
 	Hostname string
 	Port     uint16
 	Password string
+
+	// Username is sent along with Password by the authentications
+	// requiring one, such as VeNCrypt Plain. If set, the Apple Remote
+	// Desktop authentication of macOS is preferred over the VNC one.
+	Username string
+
+	// ViewOnly drops keyboard, pointer and clipboard input of the
+	// vnc-clients proxied to this target, so they can only watch.
+	// A TargetResolver can set it per connection.
+	ViewOnly bool
+
+	// TLS, if set, connects to the target with VeNCrypt, over TLS. The
+	// connection fails rather than falling back to an unencrypted one.
+	TLS *TargetTLS
+}
+
+// TargetTLS configures the TLS connection to a target.
+type TargetTLS struct {
+	// RootCAs verifies the certificate of the target, the roots of the
+	// system if nil.
+	RootCAs *x509.CertPool
+
+	// Certificates are presented to targets requiring a client
+	// certificate.
+	Certificates []tls.Certificate
+
+	// ServerName is the name the certificate of the target is verified
+	// for, its Hostname if empty.
+	ServerName string
+
+	// InsecureSkipVerify accepts any certificate of the target, and the
+	// VeNCrypt TLS subtypes, which do not verify it either. Username and
+	// Password may then be sent to whoever is in the middle.
+	InsecureSkipVerify bool
+}
+
+// clientTLSConfig returns the TLS configuration of the connection to t.
+func (t *Target) clientTLSConfig() *tls.Config {
+	serverName := t.TLS.ServerName
+	if serverName == "" {
+		serverName = t.Hostname
+	}
+	return &tls.Config{
+		RootCAs:            t.TLS.RootCAs,
+		Certificates:       t.TLS.Certificates,
+		ServerName:         serverName,
+		InsecureSkipVerify: t.TLS.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+}
+
+// sessionKeySecret keys the HMAC of the session keys, so that the
+// credentials they are derived from cannot be guessed offline.
+var sessionKeySecret = func() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}()
+
+// sessionKey identifies the upstream connections vnc-clients proxied to
+// t can share: the ones to the same server, authenticated with the same
+// credentials and TLS settings. Root CA pools are compared by the
+// subjects of their certificates.
+func (t *Target) sessionKey() string {
+	h := hmac.New(sha256.New, sessionKeySecret)
+	writeField(h, t.Username)
+	writeField(h, t.Password)
+	if t.TLS != nil {
+		writeField(h, "tls")
+		writeField(h, t.TLS.ServerName)
+		writeField(h, strconv.FormatBool(t.TLS.InsecureSkipVerify))
+		if t.TLS.RootCAs == nil {
+			writeField(h, "system")
+		} else {
+			// Subjects leaves out the roots of the system, which the pools
+			// of x509.SystemCertPool all share anyway
+			subjects := t.TLS.RootCAs.Subjects()
+			sort.Slice(subjects, func(i, j int) bool { return bytes.Compare(subjects[i], subjects[j]) < 0 })
+			writeField(h, "pool")
+			for _, subject := range subjects {
+				writeField(h, string(subject))
+			}
+		}
+		for _, cert := range t.TLS.Certificates {
+			for _, der := range cert.Certificate {
+				writeField(h, string(der))
+			}
+		}
+	}
+	addr := net.JoinHostPort(t.Hostname, strconv.Itoa(int(t.Port)))
+	return addr + "/" + hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// writeField writes a length prefixed field to h, so that the fields
+// cannot run into each other.
+func writeField(h hash.Hash, field string) {
+	binary.Write(h, binary.BigEndian, uint32(len(field)))
+	h.Write([]byte(field))
 }
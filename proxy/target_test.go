@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+// certPool returns a pool of certificates of the given subjects.
+func certPool(subjects ...string) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, subject := range subjects {
+		pool.AddCert(&x509.Certificate{Raw: []byte("cert of " + subject), RawSubject: []byte(subject)})
+	}
+	return pool
+}
+
+func TestTargetSessionKey(t *testing.T) {
+	pool := certPool("ca-1", "ca-2")
+	base := Target{Hostname: "10.0.0.1", Port: 5900, Username: "alice", Password: "secret", TLS: &TargetTLS{RootCAs: pool}}
+	key := base.sessionKey()
+
+	same := base
+	same.ViewOnly = true
+	same.TLS = &TargetTLS{RootCAs: certPool("ca-2", "ca-1")}
+	if same.sessionKey() != key {
+		t.Error("expected view-only vnc-clients, with a pool of the same roots, to share the session")
+	}
+
+	for name, change := range map[string]func(*Target){
+		"port":     func(t *Target) { t.Port = 5901 },
+		"username": func(t *Target) { t.Username = "bob" },
+		"password": func(t *Target) { t.Password = "other" },
+		"no tls":   func(t *Target) { t.TLS = nil },
+		"root cas": func(t *Target) { t.TLS = &TargetTLS{RootCAs: certPool("ca-1")} },
+		"system":   func(t *Target) { t.TLS = &TargetTLS{} },
+		"insecure": func(t *Target) { t.TLS = &TargetTLS{RootCAs: pool, InsecureSkipVerify: true} },
+	} {
+		other := base
+		change(&other)
+		if other.sessionKey() == key {
+			t.Errorf("%s: expected another session", name)
+		}
+	}
+
+	// fields must not run into each other
+	a := Target{Hostname: "h", Port: 1, Username: "ab", Password: "c"}
+	b := Target{Hostname: "h", Port: 1, Username: "a", Password: "bc"}
+	if a.sessionKey() == b.sessionKey() {
+		t.Error("expected different keys")
+	}
+}
@@ -0,0 +1,198 @@
+package recorder
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/borderzero/vncproxy/common"
+)
+
+func rect(enc common.EncodingType) *common.RfbSegment {
+	return &common.RfbSegment{SegmentType: common.SegmentRectSeparator, UpcomingObjectType: int(enc)}
+}
+
+func TestQueueOrDrop_StatefulEncodings(t *testing.T) {
+	start := &common.RfbSegment{SegmentType: common.SegmentMessageStart}
+	bytes := &common.RfbSegment{SegmentType: common.SegmentBytes}
+	tests := []struct {
+		name     string
+		segments []*common.RfbSegment
+		queued   int
+		dropped  uint64
+		broken   bool
+	}{
+		{
+			name:     "stateless messages are dropped",
+			segments: []*common.RfbSegment{start, rect(common.EncRaw), bytes, start, rect(common.EncRaw), bytes},
+			queued:   1,
+			dropped:  5,
+		},
+		{
+			name:     "nothing is dropped once a stateful rectangle is queued",
+			segments: []*common.RfbSegment{rect(common.EncZRLE), bytes, start, rect(common.EncRaw), bytes},
+			queued:   5,
+		},
+		{
+			name:     "the recording ends at a dropped stateful rectangle",
+			segments: []*common.RfbSegment{start, bytes, rect(common.EncTight), bytes, start, rect(common.EncRaw)},
+			queued:   1,
+			dropped:  5,
+			broken:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		r := &Recorder{backpressure: BackpressureDrop, segmentChan: make(chan *common.RfbSegment, 1)}
+		queued := 0
+		for _, seg := range tt.segments {
+			// the queue is full after its first segment, unless the
+			// recorder blocks, in which case the writer makes room
+			if r.stateful && len(r.segmentChan) == cap(r.segmentChan) {
+				<-r.segmentChan
+			}
+			before := len(r.segmentChan)
+			r.queueOrDrop(seg)
+			if len(r.segmentChan) > before {
+				queued++
+			}
+		}
+		if queued != tt.queued || r.Dropped() != tt.dropped || r.broken != tt.broken {
+			t.Errorf("%s: queued %d, dropped %d, broken %v; want %d, %d, %v",
+				tt.name, queued, r.Dropped(), r.broken, tt.queued, tt.dropped, tt.broken)
+		}
+	}
+}
+
+// gatedWriter is a slow sink file: its writes wait for release, once
+// started is closed.
+type gatedWriter struct {
+	bytes.Buffer
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+	err     error
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	<-w.release
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.Buffer.Write(p)
+}
+
+func (*gatedWriter) Close() error {
+	return nil
+}
+
+func TestRecorder_SegmentsDropped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slow.rbs")
+	recording := newGatedWriter()
+	sink := SinkFunc(func(name string) (io.WriteCloser, error) {
+		if name == path {
+			return recording, nil
+		}
+		return (&FileSink{}).Create(name)
+	})
+	rec, err := NewRecorderWithOptions(path, RecorderOptions{Sink: sink, Backpressure: BackpressureDrop, QueueSize: 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	start := &common.RfbSegment{SegmentType: common.SegmentMessageStart, UpcomingObjectType: int(common.FramebufferUpdate)}
+	end := &common.RfbSegment{SegmentType: common.SegmentMessageEnd}
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{FBWidth: 4, FBHeight: 2}})
+	for len(rec.segmentChan) > 0 {
+		runtime.Gosched()
+	}
+	rec.Consume(start)
+	// the writer is stuck writing the start of the recording
+	<-recording.started
+	for _, seg := range []*common.RfbSegment{
+		{SegmentType: common.SegmentBytes, Bytes: []byte("first")},
+		end,
+		start,
+		{SegmentType: common.SegmentBytes, Bytes: []byte("second")},
+		end,
+	} {
+		rec.Consume(seg)
+	}
+	close(recording.release)
+
+	if err := rec.Close(); !errors.Is(err, ErrSegmentsDropped) {
+		t.Fatalf("expected %v, got %v", ErrSegmentsDropped, err)
+	}
+	if rec.Dropped() != 4 {
+		t.Fatalf("expected 4 dropped segments, got %d", rec.Dropped())
+	}
+	// the first message, whose end was dropped, is not recorded
+	if !bytes.HasPrefix(recording.Bytes(), []byte("FBS 001.000\n")) ||
+		bytes.Contains(recording.Bytes(), []byte("first")) || bytes.Contains(recording.Bytes(), []byte("second")) {
+		t.Fatalf("unexpected recording %q", recording.Bytes())
+	}
+	meta, err := ReadMetadata(MetadataPath(path))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if meta.DroppedSegments != 4 {
+		t.Fatalf("expected 4 dropped segments in the metadata, got %d", meta.DroppedSegments)
+	}
+}
+
+func TestSpillWriter(t *testing.T) {
+	dir := t.TempDir()
+	dst := newGatedWriter()
+	w, err := newSpillWriter(dst, dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// writes do not wait for the sink
+	var want bytes.Buffer
+	for i := 0; i < 100; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 1000+i)
+		want.Write(data)
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	<-dst.started
+	close(dst.release)
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(dst.Bytes(), want.Bytes()) {
+		t.Fatalf("expected %d bytes in the sink, got %d", want.Len(), dst.Len())
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expected the temporary file to be removed, got %v", files)
+	}
+}
+
+func TestSpillWriter_SinkError(t *testing.T) {
+	dst := newGatedWriter()
+	dst.err = errors.New("sink failed")
+	close(dst.release)
+	w, err := newSpillWriter(dst, t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	w.Write([]byte("data"))
+	if err := w.Close(); err != dst.err {
+		t.Fatalf("expected %v, got %v", dst.err, err)
+	}
+	if _, err := w.Write([]byte("more")); err != dst.err {
+		t.Fatalf("expected writes to fail with %v, got %v", dst.err, err)
+	}
+}
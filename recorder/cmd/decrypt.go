@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/borderzero/vncproxy/recorder"
+)
+
+// decrypt runs the decrypt subcommand, which turns an encrypted
+// recording, index or input file back into a plain one. The player
+// seeks in a decrypted recording with its decrypted index, written to
+// the path of the recording followed by .idx.
+func decrypt(args []string) {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	in := flags.String("in", "", "path of the encrypted file")
+	out := flags.String("out", "", "path of the decrypted file to write")
+	keyFile := flags.String("key-file", "", "file holding the hex encoded AES key of the recording")
+	keyId := flags.String("key-id", "", "id of the -key-file key")
+	flags.Parse(args)
+
+	if *in == "" || *out == "" || *keyFile == "" {
+		fmt.Fprintln(os.Stderr, "-in, -out and -key-file are required")
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := decryptFile(*in, *out, *keyFile, *keyId); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to decrypt %s: %v\n", *in, err)
+		os.Exit(1)
+	}
+}
+
+func decryptFile(in, out, keyFile, keyId string) error {
+	key, err := recorder.ReadKeyFile(keyFile, keyId)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	r, err := recorder.NewDecryptReader(src, key)
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if errors.Is(err, recorder.ErrTruncated) {
+		return fmt.Errorf("%v, %s holds the data up to the cut", err, out)
+	}
+	return err
+}
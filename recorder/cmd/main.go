@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/borderzero/vncproxy/client"
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/encodings"
+	"github.com/borderzero/vncproxy/recorder"
+	"go.uber.org/zap"
+)
+
+var VERSION = "dev"
+
+var allEncodings = []common.IEncoding{
+	&encodings.RawEncoding{},
+	&encodings.TightEncoding{},
+	&encodings.EncCursorPseudo{},
+	&encodings.EncLedStatePseudo{},
+	&encodings.TightPngEncoding{},
+	&encodings.RREEncoding{},
+	&encodings.ZLibEncoding{},
+	&encodings.ZRLEEncoding{},
+	&encodings.CopyRectEncoding{},
+	&encodings.CoRREEncoding{},
+	&encodings.HextileEncoding{},
+	&encodings.EncDesktopNamePseudo{},
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		decrypt(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verify(os.Args[2:])
+		return
+	}
+
+	target := flag.String("target", "", "address of the VNC server to record, host:port")
+	password := flag.String("password", "", "password of the VNC server")
+	out := flag.String("out", "", "path of the .rbs recording to write (default recording-<target>-<timestamp>.rbs)")
+	duration := flag.Duration("duration", 0, "how long to record, 0 records until a signal or disconnection")
+	keyframes := flag.Duration("keyframes", 0, "interval of the keyframes written to make the recording seekable, 0 disables them")
+	keyFile := flag.String("key-file", "", "file holding a hex encoded AES key to encrypt the recording with")
+	keyId := flag.String("key-id", "", "id of the -key-file key, stored in the encrypted recording")
+	signingKey := flag.String("signing-key", "", "file holding a PEM encoded Ed25519 private key to sign the recording with")
+	version := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(VERSION)
+		return
+	}
+	if *target == "" {
+		fmt.Fprintln(os.Stderr, "missing -target")
+		flag.Usage()
+		os.Exit(2)
+	}
+	session := recorder.SessionInfo{Target: *target}
+	if *out == "" {
+		*out = recorder.RecordingName("recording-{target}-{timestamp}.rbs", session, time.Now())
+	}
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create logger: %v\n", err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+
+	opts := recorder.RecorderOptions{KeyframeInterval: *keyframes, Session: session, Logger: logger}
+	if *keyFile != "" {
+		key, err := recorder.ReadKeyFile(*keyFile, *keyId)
+		if err != nil {
+			logger.Fatal("invalid encryption key", zap.Error(err))
+		}
+		opts.Encryption = key
+	}
+	if *signingKey != "" {
+		key, err := recorder.ReadSigningKeyFile(*signingKey)
+		if err != nil {
+			logger.Fatal("invalid signing key", zap.Error(err))
+		}
+		opts.SigningKey = key
+	}
+
+	if err := record(logger, *target, *password, *out, *duration, opts); err != nil {
+		logger.Error("recording failed", zap.Error(err))
+		logger.Sync()
+		os.Exit(1)
+	}
+}
+
+func record(logger *zap.Logger, target, password, out string, duration time.Duration, opts recorder.RecorderOptions) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	nc, err := net.Dial("tcp", target)
+	if err != nil {
+		return fmt.Errorf("failed to connect to vnc server: %v", err)
+	}
+	cconn, err := client.NewClientConn(
+		nc,
+		&client.ClientConfig{
+			Auth: []client.ClientAuth{
+				&client.PasswordAuth{Password: password},
+				&client.ClientAuthNone{},
+			},
+		},
+		allEncodings...,
+	)
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("failed to create vnc client: %v", err)
+	}
+
+	rec, err := recorder.NewRecorderWithOptions(out, opts)
+	if err != nil {
+		nc.Close()
+		return err
+	}
+
+	closed := &closedListener{done: make(chan struct{})}
+	cconn.Listeners.AddListener(rec)
+	cconn.Listeners.AddListener(&recorder.RfbRequester{Conn: cconn, Name: "recorder"})
+	cconn.Listeners.AddListener(closed)
+
+	if err := cconn.Connect(ctx, logger); err != nil {
+		rec.Close()
+		return fmt.Errorf("failed to connect to vnc server: %v", err)
+	}
+	logger.Info("recording", zap.String("target", target), zap.String("file", out))
+
+	select {
+	case <-ctx.Done():
+		cconn.Close()
+		<-closed.done
+	case <-closed.done:
+		logger.Info("vnc server closed the connection")
+	}
+	if err := rec.Close(); err != nil {
+		return fmt.Errorf("failed to save recording %s: %v", out, err)
+	}
+	logger.Info("recording stopped", zap.String("file", out))
+	return nil
+}
+
+// closedListener signals when the connection to the VNC server is closed.
+type closedListener struct {
+	done chan struct{}
+}
+
+func (l *closedListener) Consume(seg *common.RfbSegment) error {
+	if seg.SegmentType == common.SegmentConnectionClosed {
+		close(l.done)
+	}
+	return nil
+}
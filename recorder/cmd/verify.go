@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/borderzero/vncproxy/recorder"
+)
+
+// verify runs the verify subcommand, which checks a recording, its
+// metadata, index and input files against its signed hash chain, and
+// reports the first block not matching the chain.
+func verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	in := flags.String("in", "", "path of the recording, its metadata and chain files being next to it")
+	publicKey := flags.String("public-key", "", "file holding the PEM encoded Ed25519 public key the recording was signed for")
+	keyFile := flags.String("key-file", "", "file holding the hex encoded AES key of an encrypted recording")
+	keyId := flags.String("key-id", "", "id of the -key-file key")
+	flags.Parse(args)
+
+	if *in == "" || *publicKey == "" {
+		fmt.Fprintln(os.Stderr, "-in and -public-key are required")
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := verifyFile(*in, *publicKey, *keyFile, *keyId); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *in, err)
+		os.Exit(1)
+	}
+}
+
+func verifyFile(in, publicKeyFile, keyFile, keyId string) error {
+	pub, err := recorder.ReadPublicKeyFile(publicKeyFile)
+	if err != nil {
+		return err
+	}
+	var keys recorder.KeyProvider
+	if keyFile != "" {
+		key, err := recorder.ReadKeyFile(keyFile, keyId)
+		if err != nil {
+			return err
+		}
+		keys = key
+	}
+
+	res, err := recorder.VerifyFile(in, pub, keys)
+	var corrupt *recorder.CorruptBlockError
+	if errors.As(err, &corrupt) {
+		return fmt.Errorf("CORRUPTED, block %d at offset %d: %s", corrupt.Block, corrupt.Offset, corrupt.Reason)
+	}
+	if err != nil {
+		return err
+	}
+	meta := res.Metadata
+	fmt.Printf("%s: OK, %d blocks, %d bytes, session %s of %s started at %s\n",
+		in, res.Blocks, res.Size, meta.SessionId, meta.User, meta.StartTime.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,298 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted recordings are written in chunks, each sealed with AES-GCM:
+//
+//	header: "RBSENC01" [chunk size uint32][key id length uint8][key id][nonce prefix, 8 bytes]
+//	chunks: [final flag uint8][sealed length uint32][sealed chunk]
+//
+// The nonce of a chunk is the nonce prefix followed by the chunk number
+// as a big endian uint32, and its additional data is the header followed
+// by the final flag, so chunks can be neither reordered, moved to another
+// file, nor dropped from the end of the file.
+const (
+	encryptedMagic     = "RBSENC01"
+	encryptedChunkSize = 64 * 1024
+	noncePrefixSize    = 8
+)
+
+// ErrTruncated is returned when reading an encrypted recording that
+// ends before its final chunk, as when the recorder did not close it.
+var ErrTruncated = errors.New("encrypted recording is truncated")
+
+// ErrEncrypted is returned when reading an encrypted file as a plain
+// one. Encrypted recordings and their index are played once decrypted,
+// the keyframes of the index pointing into the decrypted recording.
+var ErrEncrypted = errors.New("file is encrypted, it must be decrypted first")
+
+// IsEncrypted reports whether header, the start of a file, is the one of
+// an encrypted recording, index or input file.
+func IsEncrypted(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(encryptedMagic))
+}
+
+// KeyProvider supplies the AES keys of encrypted recordings: 16, 24 or
+// 32 bytes long, for AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	// EncryptionKey returns the key to encrypt a new recording with,
+	// and its id, which is stored in clear in the recording.
+	EncryptionKey() (keyId string, key []byte, err error)
+
+	// DecryptionKey returns the key of the given id.
+	DecryptionKey(keyId string) ([]byte, error)
+}
+
+// StaticKey is a KeyProvider of a single key.
+type StaticKey struct {
+	Id  string
+	Key []byte
+}
+
+func (k *StaticKey) EncryptionKey() (string, []byte, error) {
+	return k.Id, k.Key, nil
+}
+
+func (k *StaticKey) DecryptionKey(keyId string) ([]byte, error) {
+	if keyId != k.Id {
+		return nil, fmt.Errorf("unknown encryption key id %q", keyId)
+	}
+	return k.Key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, noncePrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	return nonce
+}
+
+// encryptWriter encrypts the data written to it in chunks. Close seals
+// the final chunk, without which the file cannot be read back whole.
+type encryptWriter struct {
+	w       io.WriteCloser
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+	buf     []byte
+}
+
+func newEncryptWriter(w io.WriteCloser, keys KeyProvider) (*encryptWriter, error) {
+	keyId, key, err := keys.EncryptionKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key: %v", err)
+	}
+	if len(keyId) > 255 {
+		return nil, fmt.Errorf("encryption key id is too long: %d bytes", len(keyId))
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	header.WriteString(encryptedMagic)
+	binary.Write(&header, binary.BigEndian, uint32(encryptedChunkSize))
+	header.WriteByte(uint8(len(keyId)))
+	header.WriteString(keyId)
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	header.Write(prefix)
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header.Bytes(),
+		prefix: prefix,
+		buf:    make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		k := min(len(p), encryptedChunkSize-len(e.buf))
+		e.buf = append(e.buf, p[:k]...)
+		p = p[k:]
+		if len(e.buf) == encryptedChunkSize {
+			if err := e.seal(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) seal(final bool) error {
+	flag := byte(0)
+	if final {
+		flag = 1
+	}
+	if e.counter == ^uint32(0) {
+		return errors.New("encrypted recording is too large")
+	}
+	sealed := e.aead.Seal(nil, chunkNonce(e.prefix, e.counter), e.buf, append(e.header[:len(e.header):len(e.header)], flag))
+	e.counter++
+	e.buf = e.buf[:0]
+
+	chunk := make([]byte, 5, 5+len(sealed))
+	chunk[0] = flag
+	binary.BigEndian.PutUint32(chunk[1:], uint32(len(sealed)))
+	_, err := e.w.Write(append(chunk, sealed...))
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	err := e.seal(true)
+	if cerr := e.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// decryptReader reads the plaintext of an encrypted recording.
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	max     int
+	counter uint32
+	plain   []byte
+	final   bool
+}
+
+// NewDecryptReader returns a reader of the plaintext of an encrypted
+// recording, index or input file. Each chunk is authenticated before it
+// is returned; a file cut short returns ErrTruncated after its last
+// complete chunk.
+func NewDecryptReader(r io.Reader, keys KeyProvider) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	var header bytes.Buffer
+	fixed := make([]byte, len(encryptedMagic)+4+1)
+	if _, err := io.ReadFull(br, fixed); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %v", err)
+	}
+	if string(fixed[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, errors.New("not an encrypted recording")
+	}
+	header.Write(fixed)
+	chunkSize := binary.BigEndian.Uint32(fixed[len(encryptedMagic):])
+	rest := make([]byte, int(fixed[len(fixed)-1])+noncePrefixSize)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %v", err)
+	}
+	header.Write(rest)
+	keyId := string(rest[:len(rest)-noncePrefixSize])
+
+	key, err := keys.DecryptionKey(keyId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get decryption key: %v", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:      br,
+		aead:   aead,
+		header: header.Bytes(),
+		prefix: rest[len(rest)-noncePrefixSize:],
+		max:    int(chunkSize) + aead.Overhead(),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.final {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open reads and authenticates the next chunk.
+func (d *decryptReader) open() error {
+	var hdr [5]byte
+	if _, err := io.ReadFull(d.r, hdr[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrTruncated
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(hdr[1:])
+	if hdr[0] > 1 || int(length) > d.max {
+		return fmt.Errorf("corrupted encrypted recording at chunk %d", d.counter)
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrTruncated
+		}
+		return err
+	}
+	plain, err := d.aead.Open(nil, chunkNonce(d.prefix, d.counter), sealed, append(d.header[:len(d.header):len(d.header)], hdr[0]))
+	if err != nil {
+		return fmt.Errorf("failed to authenticate chunk %d of encrypted recording: %v", d.counter, err)
+	}
+	d.counter++
+	d.plain = plain
+	if hdr[0] == 1 {
+		d.final = true
+		if _, err := d.r.Peek(1); err != io.EOF {
+			return errors.New("encrypted recording has data after its final chunk")
+		}
+	}
+	return nil
+}
+
+// ReadKeyFile returns a StaticKey of id, read from a file holding the
+// key hex encoded, such as the output of `openssl rand -hex 32`.
+func ReadKeyFile(path, id string) (*StaticKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s is not hex encoded: %v", path, err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("key file %s holds a %d bytes key, not an AES key of 16, 24 or 32 bytes", path, len(key))
+	}
+	return &StaticKey{Id: id, Key: key}, nil
+}
@@ -0,0 +1,140 @@
+package recorder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// closeBuffer is a bytes.Buffer with a Close method.
+type closeBuffer struct {
+	bytes.Buffer
+}
+
+func (*closeBuffer) Close() error {
+	return nil
+}
+
+var testKey = &StaticKey{Id: "k1", Key: bytes.Repeat([]byte{7}, 32)}
+
+// encrypt returns data encrypted with testKey, closing the writer with
+// close, and the size of the header.
+func encrypt(t *testing.T, data []byte, close bool) ([]byte, int) {
+	var buf closeBuffer
+	w, err := newEncryptWriter(&buf, testKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	header := buf.Len()
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if close {
+		if err := w.Close(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	return buf.Bytes(), header
+}
+
+func decrypt(encrypted []byte) ([]byte, error) {
+	r, err := NewDecryptReader(bytes.NewReader(encrypted), testKey)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	large := make([]byte, 2*encryptedChunkSize+100)
+	rand.Read(large)
+	for _, data := range [][]byte{nil, []byte("FBS 001.000\n"), large[:encryptedChunkSize], large} {
+		encrypted, _ := encrypt(t, data, true)
+		if !IsEncrypted(encrypted) {
+			t.Fatalf("%d bytes: expected the header of an encrypted file", len(data))
+		}
+		if bytes.Contains(encrypted, []byte("FBS")) {
+			t.Fatalf("%d bytes: plaintext found in the encrypted file", len(data))
+		}
+		got, err := decrypt(encrypted)
+		if err != nil {
+			t.Fatalf("%d bytes: unexpected error: %s", len(data), err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: decrypted data differs", len(data))
+		}
+	}
+}
+
+func TestEncryption_Truncated(t *testing.T) {
+	data := make([]byte, encryptedChunkSize+100)
+	rand.Read(data)
+	encrypted, header := encrypt(t, data, true)
+	// the final chunk holds the last 100 bytes
+	final := len(encrypted) - (5 + 100 + 16)
+
+	unclosed, _ := encrypt(t, data, false)
+	tests := []struct {
+		name      string
+		encrypted []byte
+	}{
+		{"no chunk", encrypted[:header]},
+		{"final chunk removed", encrypted[:final]},
+		{"final chunk cut", encrypted[:len(encrypted)-1]},
+		{"chunk header cut", encrypted[:final+3]},
+		{"not closed", unclosed},
+	}
+	for _, tt := range tests {
+		got, err := decrypt(tt.encrypted)
+		if err != ErrTruncated {
+			t.Errorf("%s: expected %v, got %v", tt.name, ErrTruncated, err)
+		}
+		// the complete chunks are returned before the error
+		if !bytes.Equal(got, data[:len(got)]) {
+			t.Errorf("%s: decrypted data differs", tt.name)
+		}
+	}
+}
+
+func TestEncryption_Tampered(t *testing.T) {
+	data := make([]byte, 2*encryptedChunkSize+100)
+	rand.Read(data)
+	encrypted, header := encrypt(t, data, true)
+	chunk := 5 + encryptedChunkSize + 16
+
+	modified := append([]byte(nil), encrypted...)
+	modified[header+chunk+100] ^= 1
+	// dropping a chunk, or marking one as final, is detected as chunks are
+	// bound to their position and final flag
+	dropped := append(append([]byte(nil), encrypted[:header+chunk]...), encrypted[header+2*chunk:]...)
+	final := append([]byte(nil), encrypted[:header+chunk]...)
+	final[header] = 1
+	tests := []struct {
+		name      string
+		encrypted []byte
+	}{
+		{"modified", modified},
+		{"chunk dropped", dropped},
+		{"marked final", final},
+		{"trailing data", append(append([]byte(nil), encrypted...), 0)},
+	}
+	for _, tt := range tests {
+		_, err := decrypt(tt.encrypted)
+		if err == nil || err == ErrTruncated {
+			t.Errorf("%s: expected an authentication error, got %v", tt.name, err)
+		}
+	}
+
+	if _, err := NewDecryptReader(bytes.NewReader(encrypted), &StaticKey{Id: "k2", Key: testKey.Key}); err == nil {
+		t.Error("expected an error for an unknown key id")
+	}
+	otherKey := &StaticKey{Id: "k1", Key: bytes.Repeat([]byte{8}, 32)}
+	r, err := NewDecryptReader(bytes.NewReader(encrypted), otherKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := io.ReadAll(r); err == nil || err == ErrTruncated {
+		t.Errorf("expected an authentication error with the wrong key, got %v", err)
+	}
+}
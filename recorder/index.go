@@ -0,0 +1,235 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/encodings"
+)
+
+const indexHeader = "RBS INDEX 002\n"
+
+// IndexPath returns the path of the keyframe index of a recording.
+func IndexPath(recordingPath string) string {
+	return recordingPath + ".idx"
+}
+
+// Keyframe is a point of a recording from which it can be played
+// without the blocks before it: the framebuffer decoded up to that
+// point is kept in the index, out of the recording itself.
+//
+// The index file holds, for each keyframe, a big endian
+// [timestamp in ms uint32][block offset uint64][width uint16][height uint16]
+// [pixel format, padded to 16 bytes][zlib window count uint8], followed
+// by the windows, each a [encoding int32][stream id uint8][length uint32][data],
+// then by the pixels of the framebuffer, raw in the pixel format and
+// zlib compressed, as a [length uint32][data].
+type Keyframe struct {
+	// Timestamp is the time of the keyframe, relative to the creation
+	// of the recorder, like the timestamps of the recording.
+	Timestamp time.Duration
+
+	// Offset is the position in the recording of the first block after
+	// the keyframe.
+	Offset int64
+
+	Width       uint16
+	Height      uint16
+	PixelFormat common.PixelFormat
+
+	// stateOffset is the position of the zlib window count in the index.
+	stateOffset int64
+}
+
+// Index is the keyframe index of a recording.
+type Index struct {
+	path      string
+	Keyframes []Keyframe
+}
+
+// writeKeyframe appends a keyframe to an index, with the zlib windows
+// and the pixels of the decoded framebuffer at that keyframe.
+func writeKeyframe(w io.Writer, k *Keyframe, windows []encodings.ZlibWindow, pixels []byte) error {
+	var compressed bytes.Buffer
+	z := zlib.NewWriter(&compressed)
+	z.Write(pixels)
+	if err := z.Close(); err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriter(w)
+	binary.Write(buf, binary.BigEndian, uint32(k.Timestamp/time.Millisecond))
+	binary.Write(buf, binary.BigEndian, uint64(k.Offset))
+	binary.Write(buf, binary.BigEndian, k.Width)
+	binary.Write(buf, binary.BigEndian, k.Height)
+	binary.Write(buf, binary.BigEndian, k.PixelFormat)
+	buf.Write([]byte{0, 0, 0}) // padding
+	buf.WriteByte(uint8(len(windows)))
+	for _, win := range windows {
+		binary.Write(buf, binary.BigEndian, int32(win.Encoding))
+		buf.WriteByte(uint8(win.Id))
+		binary.Write(buf, binary.BigEndian, uint32(len(win.Data)))
+		buf.Write(win.Data)
+	}
+	binary.Write(buf, binary.BigEndian, uint32(compressed.Len()))
+	buf.Write(compressed.Bytes())
+	return buf.Flush()
+}
+
+// OpenIndex reads the keyframe index of the recording at recordingPath.
+// The framebuffers of the keyframes are only read by Framebuffer.
+func OpenIndex(recordingPath string) (*Index, error) {
+	path := IndexPath(recordingPath)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording index: %w", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	header := make([]byte, len(indexHeader))
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != indexHeader {
+		if IsEncrypted(header) {
+			return nil, fmt.Errorf("recording index %s: %w", path, ErrEncrypted)
+		}
+		if string(header) == "RBS INDEX 001\n" {
+			return nil, fmt.Errorf("recording index %s is of an older version, remove it to play the recording", path)
+		}
+		return nil, fmt.Errorf("not a recording index: %s", path)
+	}
+	idx := &Index{path: path}
+	offset := int64(len(indexHeader))
+	for {
+		var entry struct {
+			Timestamp   uint32
+			Offset      uint64
+			Width       uint16
+			Height      uint16
+			PixelFormat common.PixelFormat
+			Padding     [3]byte
+			Windows     uint8
+		}
+		if err := binary.Read(r, binary.BigEndian, &entry); err != nil {
+			if errors.Is(err, io.EOF) {
+				return idx, nil
+			}
+			// a keyframe cut short by a crash is ignored
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return idx, nil
+			}
+			return nil, fmt.Errorf("failed to read recording index: %v", err)
+		}
+		k := Keyframe{
+			Timestamp:   time.Duration(entry.Timestamp) * time.Millisecond,
+			Offset:      int64(entry.Offset),
+			Width:       entry.Width,
+			Height:      entry.Height,
+			PixelFormat: entry.PixelFormat,
+			stateOffset: offset + int64(binary.Size(entry)) - 1,
+		}
+		offset += int64(binary.Size(entry))
+		for i := 0; i < int(entry.Windows); i++ {
+			var win struct {
+				Encoding int32
+				Id       uint8
+				Length   uint32
+			}
+			if err := binary.Read(r, binary.BigEndian, &win); err != nil {
+				return idx, nil
+			}
+			if _, err := r.Discard(int(win.Length)); err != nil {
+				return idx, nil
+			}
+			offset += int64(binary.Size(win)) + int64(win.Length)
+		}
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return idx, nil
+		}
+		if _, err := r.Discard(int(length)); err != nil {
+			return idx, nil
+		}
+		offset += 4 + int64(length)
+		idx.Keyframes = append(idx.Keyframes, k)
+	}
+}
+
+// Find returns the last keyframe before timestamp t, or nil if there is
+// none. The messages received at t are all after it.
+func (idx *Index) Find(t time.Duration) *Keyframe {
+	i := sort.Search(len(idx.Keyframes), func(i int) bool {
+		return idx.Keyframes[i].Timestamp >= t
+	})
+	if i == 0 {
+		return nil
+	}
+	return &idx.Keyframes[i-1]
+}
+
+// Framebuffer reads the framebuffer decoded up to keyframe k, ready to
+// decode the blocks after it.
+func (idx *Index) Framebuffer(k *Keyframe) (*encodings.Framebuffer, error) {
+	f, err := os.Open(idx.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording index: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(k.stateOffset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read recording index: %v", err)
+	}
+	r := bufio.NewReader(f)
+	count, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recording index: %v", err)
+	}
+	windows := make([]encodings.ZlibWindow, count)
+	for i := range windows {
+		var win struct {
+			Encoding int32
+			Id       uint8
+			Length   uint32
+		}
+		if err := binary.Read(r, binary.BigEndian, &win); err != nil {
+			return nil, fmt.Errorf("failed to read recording index: %v", err)
+		}
+		data := make([]byte, win.Length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("failed to read recording index: %v", err)
+		}
+		windows[i] = encodings.ZlibWindow{Encoding: common.EncodingType(win.Encoding), Id: int(win.Id), Data: data}
+	}
+
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("failed to read recording index: %v", err)
+	}
+	z, err := zlib.NewReader(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the keyframe pixels: %v", err)
+	}
+	pixels := make([]byte, int(k.Width)*int(k.Height)*int(k.PixelFormat.BPP/8))
+	if _, err := io.ReadFull(z, pixels); err != nil {
+		return nil, fmt.Errorf("failed to read the keyframe pixels: %v", err)
+	}
+	rect := common.Rectangle{Width: k.Width, Height: k.Height}
+	rect.Enc, err = (&encodings.RawEncoding{}).Read(&k.PixelFormat, &rect, common.NewRfbReadHelper(bytes.NewReader(pixels)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the keyframe pixels: %v", err)
+	}
+
+	fb := encodings.NewFramebuffer(k.Width, k.Height, &k.PixelFormat)
+	if err := fb.Update([]common.Rectangle{rect}); err != nil {
+		return nil, fmt.Errorf("failed to decode the keyframe pixels: %v", err)
+	}
+	fb.SetZlibWindows(windows)
+	return fb, nil
+}
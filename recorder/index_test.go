@@ -0,0 +1,67 @@
+package recorder
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/encodings"
+)
+
+func TestOpenIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "indexed.rbs")
+	pf := common.PixelFormat{BPP: 32, Depth: 24, TrueColor: 1, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8}
+	windows := []encodings.ZlibWindow{{Encoding: common.EncZRLE, Data: []byte("window")}}
+
+	var index bytes.Buffer
+	index.WriteString(indexHeader)
+	for i := 1; i <= 3; i++ {
+		k := &Keyframe{Timestamp: time.Duration(i) * time.Second, Offset: int64(i * 100), Width: 2, Height: 1, PixelFormat: pf}
+		// a red pixel, then a blue one, of intensity i
+		pixels := []byte{0, 0, byte(i), 0, byte(i), 0, 0, 0}
+		if err := writeKeyframe(&index, k, windows, pixels); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	// the last keyframe was cut short by a crash
+	if err := os.WriteFile(IndexPath(path), index.Bytes()[:index.Len()-5], 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	idx, err := OpenIndex(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(idx.Keyframes) != 2 {
+		t.Fatalf("expected 2 keyframes, got %+v", idx.Keyframes)
+	}
+	if idx.Find(time.Second) != nil || idx.Find(2*time.Second).Offset != 100 || idx.Find(time.Hour).Offset != 200 {
+		t.Fatalf("unexpected keyframes found in %+v", idx.Keyframes)
+	}
+
+	fb, err := idx.Framebuffer(&idx.Keyframes[1])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	img := fb.Image()
+	if img.Bounds().Dx() != 2 || img.Pix[0] != 2 || img.Pix[4+2] != 2 {
+		t.Fatalf("unexpected keyframe pixels %v", img.Pix)
+	}
+	if got := fb.ZlibWindows(); len(got) != 1 || string(got[0].Data) != "window" {
+		t.Fatalf("unexpected zlib windows %+v", got)
+	}
+}
+
+func TestOpenIndex_OlderVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.rbs")
+	if err := os.WriteFile(IndexPath(path), []byte("RBS INDEX 001\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := OpenIndex(path); err == nil || !strings.Contains(err.Error(), "older version") {
+		t.Fatalf("expected an older version error, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/server"
+)
+
+// InputPath returns the path of the client input events of a recording.
+func InputPath(recordingPath string) string {
+	return recordingPath + ".input.jsonl"
+}
+
+// Input event types.
+const (
+	InputKey     = "key"
+	InputPointer = "pointer"
+	InputCutText = "cut_text"
+)
+
+// InputEvent is an input event sent by the vnc-clients during a
+// recording. The input file holds one JSON encoded event per line.
+type InputEvent struct {
+	// Timestamp is in milliseconds since the creation of the recorder,
+	// like the block timestamps of the recording.
+	Timestamp int `json:"t"`
+	// Time is the wall clock time of the event.
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	Key     *KeyInput     `json:"key,omitempty"`
+	Pointer *PointerInput `json:"pointer,omitempty"`
+	CutText *CutTextInput `json:"cut_text,omitempty"`
+}
+
+// KeyInput is a key press or release.
+type KeyInput struct {
+	Keysym uint32 `json:"keysym"`
+	Down   bool   `json:"down"`
+
+	// Keycode is the XT scan code of QEMU extended key events.
+	Keycode uint32 `json:"keycode,omitempty"`
+}
+
+// PointerInput is a pointer move or button change.
+type PointerInput struct {
+	X       uint16 `json:"x"`
+	Y       uint16 `json:"y"`
+	Buttons uint8  `json:"buttons"`
+}
+
+// CutTextInput is clipboard text sent to the server.
+type CutTextInput struct {
+	Text string `json:"text"`
+}
+
+// inputEvent returns the input event of a client message, or nil for
+// the messages that are not input.
+func inputEvent(timestamp int, now time.Time, msg common.ClientMessage) *InputEvent {
+	ev := &InputEvent{Timestamp: timestamp, Time: now}
+	switch msg := msg.(type) {
+	case *server.MsgKeyEvent:
+		ev.Type = InputKey
+		ev.Key = &KeyInput{Keysym: uint32(msg.Key), Down: msg.Down != 0}
+	case *server.MsgClientQemuExtendedKey:
+		ev.Type = InputKey
+		ev.Key = &KeyInput{Keysym: msg.KeySym, Down: msg.IsDown != 0, Keycode: msg.KeyCode}
+	case *server.MsgPointerEvent:
+		ev.Type = InputPointer
+		ev.Pointer = &PointerInput{X: msg.X, Y: msg.Y, Buttons: msg.Mask}
+	case *server.MsgClientCutText:
+		ev.Type = InputCutText
+		ev.CutText = &CutTextInput{Text: string(msg.Text)}
+	default:
+		return nil
+	}
+	return ev
+}
+
+// ReadInputEvents reads the client input events of the recording at
+// recordingPath.
+func ReadInputEvents(recordingPath string) ([]InputEvent, error) {
+	f, err := os.Open(InputPath(recordingPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input events: %w", err)
+	}
+	defer f.Close()
+
+	var events []InputEvent
+	scanner := bufio.NewScanner(f)
+	// clipboard pushes can be long lines
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var ev InputEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("failed to read input event at line %d: %v", line, err)
+		}
+		events = append(events, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read input events: %v", err)
+	}
+	return events, nil
+}
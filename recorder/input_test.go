@@ -0,0 +1,69 @@
+package recorder
+
+import (
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/server"
+)
+
+func TestRecorder_InputEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input.rbs")
+	rec, err := NewRecorderWithOptions(path, RecorderOptions{RecordInput: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{FBWidth: 4, FBHeight: 2}})
+
+	msgs := []common.ClientMessage{
+		&server.MsgKeyEvent{Down: 1, Key: 'a'},
+		&server.MsgClientQemuExtendedKey{IsDown: 0, KeySym: 'a', KeyCode: 0x1e},
+		// not an input event
+		&server.MsgSetPixelFormat{PF: *common.NewPixelFormat(32)},
+		&server.MsgPointerEvent{Mask: 1, X: 3, Y: 1},
+		&server.MsgClientCutText{Length: 6, Text: []byte("secret")},
+	}
+	for _, msg := range msgs {
+		time.Sleep(20 * time.Millisecond)
+		rec.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: msg})
+		for len(rec.segmentChan) > 0 {
+			runtime.Gosched()
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	events, err := ReadInputEvents(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []InputEvent{
+		{Type: InputKey, Key: &KeyInput{Keysym: 'a', Down: true}},
+		{Type: InputKey, Key: &KeyInput{Keysym: 'a', Keycode: 0x1e}},
+		{Type: InputPointer, Pointer: &PointerInput{X: 3, Y: 1, Buttons: 1}},
+		{Type: InputCutText, CutText: &CutTextInput{Text: "secret"}},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), events)
+	}
+	last := 0
+	for i, ev := range events {
+		// the timestamps are relative to the start of the recording, as
+		// the ones of its blocks
+		since := ev.Time.Sub(rec.started)
+		if ev.Timestamp < last+20 || (since-time.Duration(ev.Timestamp)*time.Millisecond).Abs() > 10*time.Millisecond {
+			t.Errorf("event %d: unexpected timestamp %d at %v after the start, the previous one at %d", i, ev.Timestamp, since, last)
+		}
+		last = ev.Timestamp
+
+		ev.Timestamp, ev.Time = 0, time.Time{}
+		if !reflect.DeepEqual(ev, want[i]) {
+			t.Errorf("event %d: expected %+v, got %+v", i, want[i], ev)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Reasons a recording ended, as written in its metadata.
+const (
+	// CloseReasonConnectionClosed is the end of the connection to the
+	// VNC server.
+	CloseReasonConnectionClosed = "connection_closed"
+	// CloseReasonClosed is the recorder being closed by its owner.
+	CloseReasonClosed = "recorder_closed"
+)
+
+// MetadataPath returns the path of the metadata file of the recording at
+// recordingPath.
+func MetadataPath(recordingPath string) string {
+	return recordingPath + ".meta.json"
+}
+
+// SessionInfo describes the session being recorded.
+type SessionInfo struct {
+	Id string
+	// User is the identity the vnc-client authenticated as, if any. The
+	// vnc-clients of shared sessions are listed in the Viewers of the
+	// metadata, this one being the client that started the session.
+	User string
+	// Target is the address of the VNC server.
+	Target string
+}
+
+// Metadata summarizes a recording. It is written next to the recording,
+// at MetadataPath, once the recording ends.
+type Metadata struct {
+	SessionId string    `json:"session_id,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	// DurationMs is the duration of the recording in milliseconds.
+	DurationMs int64 `json:"duration_ms"`
+	// Bytes is the size of the recording, before any encryption.
+	Bytes int64 `json:"bytes"`
+	// Width and Height are the size of the desktop when the recording
+	// ended.
+	Width       uint16 `json:"width"`
+	Height      uint16 `json:"height"`
+	DesktopName string `json:"desktop_name"`
+	CloseReason string `json:"close_reason"`
+	// DroppedSegments is the number of segments BackpressureDrop
+	// dropped, the recording missing some messages if not zero.
+	DroppedSegments uint64 `json:"dropped_segments,omitempty"`
+	// Viewers are the vnc-clients which joined the session, as told to
+	// the recorder with ViewerJoined, in the order they joined.
+	Viewers []Viewer `json:"viewers,omitempty"`
+	// IndexSHA256 and InputSHA256 are the digests of the index and input
+	// files of signed recordings, before any encryption.
+	IndexSHA256 string `json:"index_sha256,omitempty"`
+	InputSHA256 string `json:"input_sha256,omitempty"`
+}
+
+// Viewer is a vnc-client of a recorded session.
+type Viewer struct {
+	SessionId string    `json:"session_id"`
+	User      string    `json:"user,omitempty"`
+	JoinTime  time.Time `json:"join_time"`
+	// LeaveTime is the end of the recording for the vnc-clients still
+	// connected then.
+	LeaveTime time.Time `json:"leave_time"`
+}
+
+// ReadMetadata reads the metadata file at path.
+func ReadMetadata(path string) (*Metadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	meta := &Metadata{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("invalid metadata file %s: %v", path, err)
+	}
+	return meta, nil
+}
+
+func writeMetadata(w io.Writer, meta *Metadata) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(meta)
+}
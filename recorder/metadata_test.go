@@ -0,0 +1,39 @@
+package recorder
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMetadataViewers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shared.rbs")
+	rec, err := NewRecorderWithOptions(path, RecorderOptions{Session: SessionInfo{Id: "s1", User: "alice"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rec.ViewerJoined("v1", "alice")
+	rec.ViewerJoined("v2", "bob")
+	rec.ViewerLeft("v1")
+	if err := rec.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	meta, err := ReadMetadata(MetadataPath(path))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(meta.Viewers) != 2 {
+		t.Fatalf("expected 2 viewers, got %+v", meta.Viewers)
+	}
+	alice, bob := meta.Viewers[0], meta.Viewers[1]
+	if alice.SessionId != "v1" || alice.User != "alice" || bob.SessionId != "v2" || bob.User != "bob" {
+		t.Fatalf("unexpected viewers %+v", meta.Viewers)
+	}
+	if alice.JoinTime.IsZero() || alice.LeaveTime.Before(alice.JoinTime) || alice.LeaveTime.After(meta.EndTime) {
+		t.Errorf("unexpected times for alice: %+v", alice)
+	}
+	// bob was still watching when the recording ended
+	if !bob.LeaveTime.Equal(meta.EndTime) {
+		t.Errorf("expected bob to leave at %s, got %s", meta.EndTime, bob.LeaveTime)
+	}
+}
@@ -0,0 +1,45 @@
+package recorder
+
+import (
+	"strings"
+	"time"
+)
+
+// DefaultNameTemplate is the template of recording names used when none
+// is configured.
+const DefaultNameTemplate = "recording-{timestamp}-{session}.rbs"
+
+// nameTimeFormat is the format of {timestamp}, in UTC.
+const nameTimeFormat = "20060102T150405Z"
+
+// RecordingName expands the placeholders of a recording name template:
+// {session} for the session id, {user} for the user, {target} for the
+// address of the VNC server, and {timestamp} for start, e.g.
+// 20240131T235959Z. Characters of the values that are not letters,
+// digits, dots, dashes or underscores are replaced by underscores, so
+// they cannot escape the directory of the template; missing values
+// become "unknown".
+func RecordingName(template string, info SessionInfo, start time.Time) string {
+	return strings.NewReplacer(
+		"{session}", nameValue(info.Id),
+		"{user}", nameValue(info.User),
+		"{target}", nameValue(info.Target),
+		"{timestamp}", start.UTC().Format(nameTimeFormat),
+	).Replace(template)
+}
+
+func nameValue(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	b := []byte(v)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		case c == '.' && strings.Trim(v, ".") != "":
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
@@ -2,19 +2,30 @@ package recorder
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/borderzero/vncproxy/client"
 	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/encodings"
 	"github.com/borderzero/vncproxy/server"
+	"go.uber.org/zap"
 )
 
 type Recorder struct {
 	//common.BytesListener
 	RBSFileName string
-	writer      *os.File
+	writer      io.WriteCloser
+	// offset is the size of the recording written so far, before any
+	// encryption
+	offset int64
 	//logger              common.Logger
 	startTime           int
 	buffer              bytes.Buffer
@@ -22,40 +33,294 @@ type Recorder struct {
 	sessionStartWritten bool
 	segmentChan         chan *common.RfbSegment
 	maxWriteSize        int
+
+	// closeMu guards closed, so no segment is queued after Close
+	closeMu   sync.Mutex
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	// writeErr is the first error of writing the recording
+	writeErr error
+
+	// backpressure is applied when segmentChan is full; dropping is set
+	// while the segments of a dropped message are consumed. stateful is
+	// set once a rectangle of a stateful encoding was queued, after which
+	// nothing is dropped, and broken once one was dropped, after which
+	// no server message is recorded anymore.
+	backpressure Backpressure
+	dropping     bool
+	stateful     bool
+	broken       bool
+	dropped      atomic.Uint64
+	// inMessage is set while the writer buffers a message which may be
+	// dropped
+	inMessage bool
+
+	logger *zap.Logger
+
+	// keyframes, when enabled, are decoded from fb and listed in index
+	keyframeInterval int
+	lastKeyframe     int
+	index            io.WriteCloser
+	fb               *encodings.Framebuffer
+
+	// input, when enabled, gets the input events of the vnc-clients
+	input io.WriteCloser
+
+	// chain, when signing, hashes the blocks written to writer
+	chain      *hashChain
+	chainFile  io.WriteCloser
+	signingKey ed25519.PrivateKey
+
+	// metadata gets the summary of the recording once it ends
+	metadata    io.WriteCloser
+	session     SessionInfo
+	started     time.Time
+	width       uint16
+	height      uint16
+	desktopName string
+	reasonMu    sync.Mutex
+	closeReason string
+	// viewers are guarded by reasonMu
+	viewers []Viewer
+}
+
+// RecorderOptions configures a Recorder.
+type RecorderOptions struct {
+	// KeyframeInterval, if not zero, is how often the recorder writes a
+	// keyframe: the whole desktop, decoded from the recorded updates,
+	// stored compressed in an index file at IndexPath, so players can
+	// seek without replaying the recording from its start. Keyframes
+	// require a true color pixel format.
+	KeyframeInterval time.Duration
+
+	// RecordInput writes the key, pointer and clipboard events of the
+	// vnc-clients to a file at InputPath, as JSON lines.
+	RecordInput bool
+
+	// Encryption, if set, encrypts the recording and its index and
+	// input files with AES-GCM, using the key it provides. Encrypted
+	// files are turned back into plain ones with NewDecryptReader.
+	Encryption KeyProvider
+
+	// Sink, if set, stores the files of the recording, the path given
+	// to the recorder being their name in the sink. It defaults to the
+	// local filesystem.
+	Sink RecordingSink
+
+	// Session describes the recorded session in the metadata file of
+	// the recording.
+	Session SessionInfo
+
+	// Backpressure is what the recorder does when the segments it
+	// consumes are not written as fast as they come, e.g. because of a
+	// slow disk. It defaults to BackpressureBlock.
+	Backpressure Backpressure
+
+	// QueueSize is the number of segments queued for writing, 1000 if
+	// zero.
+	QueueSize int
+
+	// SpillDir is the directory of the temporary files of
+	// BackpressureSpill, os.TempDir() if empty.
+	SpillDir string
+
+	// SigningKey, if set, makes the recording tamper-evident: the
+	// recorder writes a hash chain of its blocks to a file at ChainPath,
+	// signed with the key along with the metadata when the recording
+	// ends. Verify checks a recording against its chain.
+	SigningKey ed25519.PrivateKey
+
+	// Logger, if set, gets the problems which do not end the recording,
+	// such as keyframes stopping.
+	Logger *zap.Logger
 }
 
+// Backpressure is a policy for segments consumed faster than recorded.
+type Backpressure int
+
+const (
+	// BackpressureBlock waits for the queue to have room, which slows
+	// down the recorded session.
+	BackpressureBlock Backpressure = iota
+
+	// BackpressureDrop drops the segments of server messages when the
+	// queue is full. Messages are recorded whole or not at all, so the
+	// recording stays playable, but the screen may be missing updates
+	// until the next ones; Close then reports ErrSegmentsDropped.
+	// Keyframes stop after the first dropped message. The ServerInit and
+	// the client messages are never dropped, and messages are buffered
+	// whole before being written.
+	//
+	// The zlib streams of the ZLib, ZlibHex, Tight and ZRLE encodings
+	// span messages, so none can be dropped once they are in use: after
+	// the first rectangle of these encodings is queued, the recorder
+	// blocks like BackpressureBlock. If that rectangle is in a message
+	// already being dropped, the recording ends at the gap instead, no
+	// server message being recorded after it. The proxy requests no
+	// stateful encoding from the vnc-server when recording with drop.
+	BackpressureDrop
+
+	// BackpressureSpill writes the files of the recording to temporary
+	// files in SpillDir, copied to the sink in the background, so the
+	// queue never waits for the sink; the temporary files grow instead.
+	BackpressureSpill
+)
+
+func (b Backpressure) String() string {
+	switch b {
+	case BackpressureBlock:
+		return "block"
+	case BackpressureDrop:
+		return "drop"
+	case BackpressureSpill:
+		return "spill"
+	}
+	return fmt.Sprintf("Backpressure(%d)", int(b))
+}
+
+// ErrSegmentsDropped is reported by Close when BackpressureDrop dropped
+// some of the recorded messages.
+var ErrSegmentsDropped = errors.New("recording is incomplete, segments were dropped")
+
 func getNowMillisec() int {
 	return int(time.Now().UnixNano() / int64(time.Millisecond))
 }
 
 func NewRecorder(saveFilePath string) (*Recorder, error) {
-	// delete file if it exists
-	if _, err := os.Stat(saveFilePath); err == nil {
-		os.Remove(saveFilePath)
+	return NewRecorderWithOptions(saveFilePath, RecorderOptions{})
+}
+
+func NewRecorderWithOptions(saveFilePath string, opts RecorderOptions) (*Recorder, error) {
+	if opts.Sink == nil {
+		opts.Sink = &FileSink{}
 	}
 
-	rec := Recorder{RBSFileName: saveFilePath, startTime: getNowMillisec()}
+	rec := Recorder{RBSFileName: saveFilePath, session: opts.Session, started: time.Now(), backpressure: opts.Backpressure}
+	rec.startTime = int(rec.started.UnixNano() / int64(time.Millisecond))
+	rec.logger = opts.Logger
+	if rec.logger == nil {
+		rec.logger = zap.NewNop()
+	}
 	var err error
 
 	rec.maxWriteSize = 65535
 
-	rec.writer, err = os.OpenFile(saveFilePath, os.O_RDWR|os.O_CREATE, 0644)
+	rec.writer, err = createFile(saveFilePath, &opts)
 	if err != nil {
 		return nil, fmt.Errorf("unable to open file: %s, error: %v", saveFilePath, err)
 	}
 
+	rec.metadata, err = createFile(MetadataPath(saveFilePath), &opts)
+	if err != nil {
+		rec.writer.Close()
+		return nil, fmt.Errorf("unable to create metadata file for: %s, error: %v", saveFilePath, err)
+	}
+
+	if opts.KeyframeInterval > 0 {
+		rec.keyframeInterval = int(opts.KeyframeInterval / time.Millisecond)
+		rec.index, err = createSignedFile(IndexPath(saveFilePath), &opts)
+		if err == nil {
+			_, err = io.WriteString(rec.index, indexHeader)
+		}
+		if err != nil {
+			rec.writer.Close()
+			rec.metadata.Close()
+			return nil, fmt.Errorf("unable to create index file for: %s, error: %v", saveFilePath, err)
+		}
+	}
+
+	if opts.SigningKey != nil {
+		rec.signingKey = opts.SigningKey
+		rec.chainFile, err = createFile(ChainPath(saveFilePath), &opts)
+		if err == nil {
+			rec.chain, err = newHashChain(rec.chainFile)
+		}
+		if err != nil {
+			rec.writer.Close()
+			rec.metadata.Close()
+			if rec.index != nil {
+				rec.index.Close()
+			}
+			if rec.chainFile != nil {
+				rec.chainFile.Close()
+			}
+			return nil, fmt.Errorf("unable to create chain file for: %s, error: %v", saveFilePath, err)
+		}
+	}
+
+	if opts.RecordInput {
+		rec.input, err = createSignedFile(InputPath(saveFilePath), &opts)
+		if err != nil {
+			rec.writer.Close()
+			rec.metadata.Close()
+			if rec.index != nil {
+				rec.index.Close()
+			}
+			if rec.chainFile != nil {
+				rec.chainFile.Close()
+			}
+			return nil, fmt.Errorf("unable to create input file for: %s, error: %v", saveFilePath, err)
+		}
+	}
+
 	//buffer the channel so we don't halt the proxying flow for slow writes when under pressure
-	rec.segmentChan = make(chan *common.RfbSegment, 1000)
+	queueSize := opts.QueueSize
+	if queueSize <= 0 {
+		queueSize = 1000
+	}
+	rec.segmentChan = make(chan *common.RfbSegment, queueSize)
+	rec.done = make(chan struct{})
 	go func() {
-		for {
-			data := <-rec.segmentChan
-			rec.HandleRfbSegment(data)
+		defer close(rec.done)
+		for data := range rec.segmentChan {
+			if err := rec.HandleRfbSegment(data); err != nil && rec.writeErr == nil {
+				rec.writeErr = err
+			}
 		}
 	}()
 
 	return &rec, nil
 }
 
+// createFile creates a file of a recording in the sink of opts,
+// encrypted and spilled as opts configures.
+func createFile(name string, opts *RecorderOptions) (io.WriteCloser, error) {
+	f, err := opts.Sink.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Backpressure == BackpressureSpill {
+		// spills what is written to the sink, encrypted if it should be
+		spill, err := newSpillWriter(f, opts.SpillDir)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f = spill
+	}
+	if opts.Encryption == nil {
+		return f, nil
+	}
+	w, err := newEncryptWriter(f, opts.Encryption)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// createSignedFile creates a file of the recording whose digest is in
+// the metadata, when the recording is signed.
+func createSignedFile(name string, opts *RecorderOptions) (io.WriteCloser, error) {
+	w, err := createFile(name, opts)
+	if err != nil || opts.SigningKey == nil {
+		return w, err
+	}
+	return newDigestWriter(w), nil
+}
+
 const versionMsg_3_3 = "RFB 003.003\n"
 const versionMsg_3_7 = "RFB 003.007\n"
 const versionMsg_3_8 = "RFB 003.008\n"
@@ -74,8 +339,12 @@ func (r *Recorder) writeStartSession(initMsg *common.ServerInit) error {
 	framebufferWidth := initMsg.FBWidth
 	framebufferHeight := initMsg.FBHeight
 
+	r.width, r.height, r.desktopName = initMsg.FBWidth, initMsg.FBHeight, desktopName
+
 	//write rfb header information (the only part done without the [size|data|timestamp] block wrapper)
-	r.writer.WriteString("FBS 001.000\n")
+	if err := r.write([]byte("FBS 001.000\n")); err != nil {
+		return err
+	}
 
 	//push the version message into the buffer so it will be written in the first rbs block
 	r.buffer.WriteString(versionMsg_3_3)
@@ -101,20 +370,78 @@ func (r *Recorder) writeStartSession(initMsg *common.ServerInit) error {
 	r.buffer.WriteString(desktopName)
 	//binary.Write(&r.buffer, binary.BigEndian, byte(0)) // add null termination for desktop string
 
+	if r.index != nil {
+		r.fb = encodings.NewFramebufferFromServerInit(initMsg)
+		r.lastKeyframe = getNowMillisec() - r.startTime
+	}
+
 	return nil
 }
 
 func (r *Recorder) Consume(data *common.RfbSegment) error {
-	//using async writes so if chan buffer overflows, proxy will not be affected
-	select {
-	case r.segmentChan <- data:
-		// default:
-		// 	logger.Error("error: recorder queue is full")
+	r.closeMu.Lock()
+	if r.closed {
+		r.closeMu.Unlock()
+		return nil
 	}
 
+	// the segments are written asynchronously, the queue buffering
+	// them while the writes are slow
+	if r.backpressure == BackpressureDrop {
+		r.queueOrDrop(data)
+	} else {
+		r.segmentChan <- data
+	}
+	r.closeMu.Unlock()
+
+	// the recording ends with the connection to the vnc server; closing
+	// also seals encrypted recordings
+	if data.SegmentType == common.SegmentConnectionClosed {
+		r.SetCloseReason(CloseReasonConnectionClosed)
+		r.Close()
+	}
 	return nil
 }
 
+// queueOrDrop queues a segment, or drops it if it is part of a server
+// message and the queue is full. Once a segment is dropped, the rest of
+// its message is dropped too, and the writer discards the part of the
+// message it got, on the start of the next one.
+func (r *Recorder) queueOrDrop(seg *common.RfbSegment) {
+	switch seg.SegmentType {
+	case common.SegmentMessageStart:
+		r.dropping = r.broken
+	case common.SegmentRectSeparator:
+		if common.EncodingType(seg.UpcomingObjectType).Stateful() {
+			// the zlib streams would not decode past a dropped rectangle
+			r.broken = r.broken || r.dropping
+			r.stateful = true
+		}
+	case common.SegmentBytes, common.SegmentFullyParsedServerMessage, common.SegmentMessageEnd:
+	default:
+		r.segmentChan <- seg
+		return
+	}
+	if r.stateful && !r.dropping {
+		r.segmentChan <- seg
+		return
+	}
+	if !r.dropping {
+		select {
+		case r.segmentChan <- seg:
+			return
+		default:
+			r.dropping = true
+		}
+	}
+	r.dropped.Add(1)
+}
+
+// Dropped returns the number of segments dropped by BackpressureDrop.
+func (r *Recorder) Dropped() uint64 {
+	return r.dropped.Load()
+}
+
 func (r *Recorder) HandleRfbSegment(data *common.RfbSegment) error {
 	defer func() {
 		if r := recover(); r != nil {
@@ -124,9 +451,15 @@ func (r *Recorder) HandleRfbSegment(data *common.RfbSegment) error {
 
 	switch data.SegmentType {
 	case common.SegmentMessageStart:
+		if r.inMessage {
+			// the end of the previous message was dropped
+			r.buffer.Reset()
+		}
+		r.inMessage = r.backpressure == BackpressureDrop
 		if !r.sessionStartWritten {
 			// logger.Debugf("Recorder.HandleRfbSegment: writing start session segment: %v", r.serverInitMessage)
 			r.writeStartSession(r.serverInitMessage)
+			r.writeToDisk()
 		}
 
 		switch common.ServerMessageType(data.UpcomingObjectType) {
@@ -139,28 +472,57 @@ func (r *Recorder) HandleRfbSegment(data *common.RfbSegment) error {
 		default:
 			// logger.Warn("Recorder.HandleRfbSegment: unknown message type:" + string(data.UpcomingObjectType))
 		}
+	case common.SegmentMessageEnd:
+		// end each block on a message boundary, so its timestamp tells
+		// when the message was received
+		r.inMessage = false
+		return r.writeToDisk()
 	case common.SegmentConnectionClosed:
-		r.writeToDisk()
+		if r.inMessage {
+			r.buffer.Reset()
+		}
+		return r.writeToDisk()
 	case common.SegmentRectSeparator:
 		// logger.Debugf("Recorder.HandleRfbSegment: writing rect")
 		//r.writeToDisk()
 	case common.SegmentBytes:
 		// logger.Debug("Recorder.HandleRfbSegment: writing bytes, len:", len(data.Bytes))
-		if r.buffer.Len()+len(data.Bytes) > r.maxWriteSize-4 {
-			r.writeToDisk()
+		// messages which may be dropped are kept whole until their end
+		if r.buffer.Len()+len(data.Bytes) > r.maxWriteSize-4 && !r.inMessage {
+			if err := r.writeToDisk(); err != nil {
+				return err
+			}
 		}
 		_, err := r.buffer.Write(data.Bytes)
 		return err
 	case common.SegmentServerInitMessage:
 		r.serverInitMessage = data.Message.(*common.ServerInit)
+	case common.SegmentFullyParsedServerMessage:
+		if msg, ok := data.Message.(*client.MsgFramebufferUpdate); ok {
+			r.trackDesktop(msg)
+		}
+		if r.fb != nil {
+			r.decode(data.Message.(common.ServerMessage))
+		}
 	case common.SegmentFullyParsedClientMessage:
 		clientMsg := data.Message.(common.ClientMessage)
 
+		if r.input != nil {
+			if ev := inputEvent(getNowMillisec()-r.startTime, time.Now(), clientMsg); ev != nil {
+				if err := json.NewEncoder(r.input).Encode(ev); err != nil {
+					return err
+				}
+			}
+		}
+
 		switch clientMsg.Type() {
 		case common.SetPixelFormatMsgType:
 			clientMsg := data.Message.(*server.MsgSetPixelFormat)
 			// logger.Debugf("Recorder.HandleRfbSegment: client message %v", *clientMsg)
 			r.serverInitMessage.PixelFormat = clientMsg.PF
+			if r.fb != nil {
+				r.fb.SetPixelFormat(&clientMsg.PF)
+			}
 		default:
 			//return errors.New("unknown client message type:" + string(data.UpcomingObjectType))
 		}
@@ -171,29 +533,123 @@ func (r *Recorder) HandleRfbSegment(data *common.RfbSegment) error {
 	return nil
 }
 
-func (r *Recorder) writeToDisk() error {
+// trackDesktop follows the changes of the desktop size and name, for the
+// metadata.
+func (r *Recorder) trackDesktop(msg *client.MsgFramebufferUpdate) {
+	for _, rect := range msg.Rectangles {
+		if rect.Enc == nil {
+			continue
+		}
+		switch common.EncodingType(rect.Enc.Type()) {
+		case common.EncDesktopSizePseudo:
+			r.width, r.height = rect.Width, rect.Height
+		case common.EncDesktopNamePseudo:
+			if enc, ok := rect.Enc.(*encodings.EncDesktopNamePseudo); ok {
+				r.desktopName = string(enc.Name)
+			}
+		}
+	}
+}
+
+// decode keeps the framebuffer of the keyframes up to date, and writes a
+// keyframe when one is due. Keyframes stop on the first error, as the
+// framebuffer can no longer be trusted.
+func (r *Recorder) decode(msg common.ServerMessage) {
+	if r.dropped.Load() > 0 {
+		// the framebuffer misses the dropped updates
+		r.stopKeyframes(errors.New("segments were dropped"))
+		return
+	}
+	switch msg := msg.(type) {
+	case *client.MsgFramebufferUpdate:
+		if err := r.fb.Update(msg.Rectangles); err != nil {
+			r.stopKeyframes(err)
+			return
+		}
+	case *client.MsgSetColorMapEntries:
+		r.fb.SetColorMapEntries(msg.FirstColor, msg.Colors)
+		return
+	default:
+		return
+	}
+
+	if getNowMillisec()-r.startTime-r.lastKeyframe < r.keyframeInterval {
+		return
+	}
+	if err := r.writeKeyframe(); err != nil {
+		r.stopKeyframes(err)
+	}
+}
+
+// stopKeyframes stops writing keyframes for the rest of the recording,
+// which can then only be played from its start past the last keyframe.
+func (r *Recorder) stopKeyframes(err error) {
+	r.fb = nil
+	r.logger.Warn("recording keyframes stopped",
+		zap.String("recording", r.RBSFileName), zap.Error(err))
+}
+
+// writeKeyframe adds the framebuffer, as decoded up to the end of the
+// last block written, to the index. The recording itself is left as
+// received.
+func (r *Recorder) writeKeyframe() error {
+	bounds := r.fb.Bounds()
+	raw, err := r.fb.EncodeRaw(bounds)
+	if err != nil {
+		return err
+	}
+	var pixels bytes.Buffer
+	if _, err := raw.WriteTo(&pixels); err != nil {
+		return err
+	}
+
+	// the block of the message was written on its end
+	if err := r.writeToDisk(); err != nil {
+		return err
+	}
 	timeSinceStart := getNowMillisec() - r.startTime
+	r.lastKeyframe = timeSinceStart
+
+	return writeKeyframe(r.index, &Keyframe{
+		Timestamp:   time.Duration(timeSinceStart) * time.Millisecond,
+		Offset:      r.offset,
+		Width:       uint16(bounds.Dx()),
+		Height:      uint16(bounds.Dy()),
+		PixelFormat: r.serverInitMessage.PixelFormat,
+	}, r.fb.ZlibWindows(), pixels.Bytes())
+}
+
+func (r *Recorder) writeToDisk() error {
+	return r.writeBlock(getNowMillisec() - r.startTime)
+}
+
+// writeBlock writes the buffered data as a block stamped timeSinceStart.
+func (r *Recorder) writeBlock(timeSinceStart int) error {
 	if r.buffer.Len() == 0 {
 		return nil
 	}
 
-	//write buff length
+	//write buff length, buffer padded to 32bit and timestamp
 	bytesLen := r.buffer.Len()
-	binary.Write(r.writer, binary.BigEndian, uint32(bytesLen))
 	paddedSize := (bytesLen + 3) & 0x7FFFFFFC
-	paddingSize := paddedSize - bytesLen
-
-	//logger.Debugf("paddedSize=%d paddingSize=%d bytesLen=%d", paddedSize, paddingSize, bytesLen)
-	//write buffer padded to 32bit
-	_, err := r.buffer.WriteTo(r.writer)
-	padding := make([]byte, paddingSize)
-	//logger.Debugf("padding=%v ", padding)
-
-	binary.Write(r.writer, binary.BigEndian, padding)
-
-	//write timestamp
-	binary.Write(r.writer, binary.BigEndian, uint32(timeSinceStart))
+	block := make([]byte, 4, 4+paddedSize+4)
+	binary.BigEndian.PutUint32(block, uint32(bytesLen))
+	block = append(block, r.buffer.Bytes()...)
+	block = append(block, make([]byte, paddedSize-bytesLen)...)
+	block = binary.BigEndian.AppendUint32(block, uint32(timeSinceStart))
 	r.buffer.Reset()
+	return r.write(block)
+}
+
+// write writes a block to the recording, and adds it to the hash chain.
+func (r *Recorder) write(block []byte) error {
+	_, err := r.writer.Write(block)
+	r.offset += int64(len(block))
+	if r.chain != nil {
+		if cerr := r.chain.add(block); err == nil {
+			err = cerr
+		}
+	}
 	return err
 }
 
@@ -203,6 +659,111 @@ func (r *Recorder) writeToDisk() error {
 // 	return r.Write(buf)
 // }
 
-func (r *Recorder) Close() {
-	r.writer.Close()
+// SetCloseReason sets why the recording ended, as written in its
+// metadata, unless a reason was already set.
+func (r *Recorder) SetCloseReason(reason string) {
+	r.reasonMu.Lock()
+	defer r.reasonMu.Unlock()
+	if r.closeReason == "" {
+		r.closeReason = reason
+	}
+}
+
+// ViewerJoined records in the metadata that the vnc-client of sessionId
+// joined the session, authenticated as user if not empty.
+func (r *Recorder) ViewerJoined(sessionId, user string) {
+	r.reasonMu.Lock()
+	defer r.reasonMu.Unlock()
+	r.viewers = append(r.viewers, Viewer{SessionId: sessionId, User: user, JoinTime: time.Now()})
+}
+
+// ViewerLeft records in the metadata that the vnc-client of sessionId
+// left the session.
+func (r *Recorder) ViewerLeft(sessionId string) {
+	r.reasonMu.Lock()
+	defer r.reasonMu.Unlock()
+	for i := range r.viewers {
+		if r.viewers[i].SessionId == sessionId && r.viewers[i].LeaveTime.IsZero() {
+			r.viewers[i].LeaveTime = time.Now()
+		}
+	}
+}
+
+// Close writes the segments still queued to the file, and closes it,
+// along with the metadata of the recording. Segments consumed after Close
+// are ignored. It returns the error of closing the files, such as a
+// failed upload of their last part.
+func (r *Recorder) Close() error {
+	r.closeOnce.Do(r.close)
+	return r.closeErr
+}
+
+func (r *Recorder) close() {
+	r.closeMu.Lock()
+	r.closed = true
+	close(r.segmentChan)
+	r.closeMu.Unlock()
+
+	<-r.done
+	if r.inMessage {
+		// the end of the last message was dropped
+		r.buffer.Reset()
+	}
+	r.writeToDisk()
+	r.closeErr = r.writer.Close()
+	if r.writeErr != nil {
+		r.closeErr = r.writeErr
+	}
+
+	r.SetCloseReason(CloseReasonClosed)
+	end := time.Now()
+	r.reasonMu.Lock()
+	reason := r.closeReason
+	viewers := append([]Viewer(nil), r.viewers...)
+	r.reasonMu.Unlock()
+	for i := range viewers {
+		if viewers[i].LeaveTime.IsZero() {
+			viewers[i].LeaveTime = end
+		}
+	}
+	meta := &Metadata{
+		SessionId:       r.session.Id,
+		User:            r.session.User,
+		Target:          r.session.Target,
+		StartTime:       r.started,
+		EndTime:         end,
+		DurationMs:      end.Sub(r.started).Milliseconds(),
+		Bytes:           r.offset,
+		Width:           r.width,
+		Height:          r.height,
+		DesktopName:     r.desktopName,
+		CloseReason:     reason,
+		DroppedSegments: r.dropped.Load(),
+		Viewers:         viewers,
+		IndexSHA256:     digest(r.index),
+		InputSHA256:     digest(r.input),
+	}
+	// the chain signs the metadata as written
+	var metaData bytes.Buffer
+	writeMetadata(&metaData, meta)
+	if _, err := r.metadata.Write(metaData.Bytes()); r.closeErr == nil {
+		r.closeErr = err
+	}
+	if r.chain != nil {
+		if err := r.chain.sign(r.signingKey, metaData.Bytes()); r.closeErr == nil {
+			r.closeErr = err
+		}
+	}
+
+	for _, w := range []io.WriteCloser{r.metadata, r.index, r.input, r.chainFile} {
+		if w == nil {
+			continue
+		}
+		if err := w.Close(); r.closeErr == nil {
+			r.closeErr = err
+		}
+	}
+	if dropped := r.dropped.Load(); dropped > 0 && r.closeErr == nil {
+		r.closeErr = fmt.Errorf("%w: %d segments", ErrSegmentsDropped, dropped)
+	}
 }
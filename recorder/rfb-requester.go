@@ -24,6 +24,7 @@ func (p *RfbRequester) Consume(seg *common.RfbSegment) error {
 		p.Conn.FrameBufferWidth = serverInitMessage.FBWidth
 		p.Conn.DesktopName = string(serverInitMessage.NameText)
 		p.Conn.SetPixelFormat(&serverInitMessage.PixelFormat)
+		p.Conn.SetEncodings(p.Conn.Encodings())
 		p.Width = serverInitMessage.FBWidth
 		p.Height = serverInitMessage.FBHeight
 		p.lastRequestTime = time.Now()
@@ -0,0 +1,316 @@
+package recorder
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MinS3PartSize is the smallest part of a multipart upload S3 accepts,
+	// but for the last one.
+	MinS3PartSize = 5 * 1024 * 1024
+
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Sink stores recordings in a bucket of an S3 compatible object store.
+// Files are streamed with multipart uploads: each part is uploaded as
+// soon as PartSize bytes of the recording were written, so recordings
+// leave the host while they are produced. Files smaller than a part are
+// uploaded in a single request when closed. Uploads are conditional, so
+// an existing object is not overwritten, on stores supporting it.
+type S3Sink struct {
+	// Endpoint is the URL of the object store, e.g.
+	// https://s3.eu-west-1.amazonaws.com.
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	// Prefix is prepended to the names of the files, e.g. "recordings/".
+	Prefix string
+
+	AccessKeyId     string
+	SecretAccessKey string
+	// SessionToken is the token of temporary credentials, if any.
+	SessionToken string
+
+	// PathStyle addresses the bucket in the path of the URLs rather
+	// than in their host, as most S3 compatible stores require.
+	PathStyle bool
+
+	// PartSize is the size of the uploaded parts, MinS3PartSize if it
+	// is smaller.
+	PartSize int
+
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+func (s *S3Sink) Create(name string) (io.WriteCloser, error) {
+	u, err := s.objectURL(s.Prefix + name)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Upload{sink: s, url: u, partSize: max(s.PartSize, MinS3PartSize)}, nil
+}
+
+func (s *S3Sink) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %v", err)
+	}
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/" + key
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	return u, nil
+}
+
+// do sends a signed request of the object, and returns the body of its
+// successful response.
+func (s *S3Sink) do(method string, u *url.URL, query url.Values, header http.Header, body []byte) (http.Header, []byte, error) {
+	reqURL := *u
+	reqURL.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, reqURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, body, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, nil, fmt.Errorf("s3 %s %s: %s: %s", method, u.Path, resp.Status, s3ErrorMessage(respBody))
+	}
+	// CompleteMultipartUpload reports its errors in a 200 response
+	if bytes.Contains(respBody, []byte("<Error>")) {
+		return nil, nil, fmt.Errorf("s3 %s %s: %s", method, u.Path, s3ErrorMessage(respBody))
+	}
+	return resp.Header, respBody, nil
+}
+
+func s3ErrorMessage(body []byte) string {
+	var e struct {
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &e) != nil || e.Code == "" {
+		return strings.TrimSpace(string(body))
+	}
+	return e.Code + ": " + e.Message
+}
+
+// sign adds the AWS Signature Version 4 of req to its headers. Every
+// header of req is signed.
+func (s *S3Sink) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape escapes a query string key or value as SigV4 requires.
+func s3Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// noOverwrite makes the request creating an object fail if it exists.
+var noOverwrite = http.Header{"If-None-Match": {"*"}}
+
+// s3Upload streams a file to S3.
+type s3Upload struct {
+	sink     *S3Sink
+	url      *url.URL
+	partSize int
+
+	buf      []byte
+	uploadId string
+	etags    []string
+	err      error
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	if u.err != nil {
+		return 0, u.err
+	}
+	u.buf = append(u.buf, p...)
+	for len(u.buf) >= u.partSize {
+		if u.err = u.uploadPart(u.buf[:u.partSize]); u.err != nil {
+			u.abort()
+			return 0, u.err
+		}
+		u.buf = append(u.buf[:0], u.buf[u.partSize:]...)
+	}
+	return len(p), nil
+}
+
+func (u *s3Upload) uploadPart(part []byte) error {
+	if u.uploadId == "" {
+		_, body, err := u.sink.do(http.MethodPost, u.url, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return fmt.Errorf("failed to start upload: %v", err)
+		}
+		var result struct {
+			UploadId string
+		}
+		if err := xml.Unmarshal(body, &result); err != nil || result.UploadId == "" {
+			return fmt.Errorf("failed to start upload: invalid response %q", body)
+		}
+		u.uploadId = result.UploadId
+	}
+
+	query := url.Values{
+		"partNumber": {strconv.Itoa(len(u.etags) + 1)},
+		"uploadId":   {u.uploadId},
+	}
+	header, _, err := u.sink.do(http.MethodPut, u.url, query, nil, part)
+	if err != nil {
+		return fmt.Errorf("failed to upload part %d: %v", len(u.etags)+1, err)
+	}
+	u.etags = append(u.etags, header.Get("ETag"))
+	return nil
+}
+
+func (u *s3Upload) abort() {
+	if u.uploadId != "" {
+		u.sink.do(http.MethodDelete, u.url, url.Values{"uploadId": {u.uploadId}}, nil, nil)
+	}
+}
+
+func (u *s3Upload) Close() error {
+	if u.err != nil {
+		return u.err
+	}
+	// files are closed once
+	u.err = errors.New("s3 upload is closed")
+
+	if u.uploadId == "" {
+		// the file fits in a single request
+		if _, _, err := u.sink.do(http.MethodPut, u.url, nil, noOverwrite, u.buf); err != nil {
+			return fmt.Errorf("failed to upload: %v", err)
+		}
+		return nil
+	}
+
+	if len(u.buf) > 0 {
+		if err := u.uploadPart(u.buf); err != nil {
+			u.abort()
+			return err
+		}
+	}
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range u.etags {
+		complete.Parts = append(complete.Parts, part{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	if _, _, err := u.sink.do(http.MethodPost, u.url, url.Values{"uploadId": {u.uploadId}}, noOverwrite, body); err != nil {
+		u.abort()
+		return fmt.Errorf("failed to complete upload: %v", err)
+	}
+	return nil
+}
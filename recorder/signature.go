@@ -0,0 +1,385 @@
+package recorder
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+const chainHeader = "RBS CHAIN 002\n"
+
+// chainTrailerSize is the size of the trailer of a chain file: the block
+// count, the size of the recording, the hash of its metadata and the
+// signature.
+const chainTrailerSize = 8 + 8 + sha256.Size + ed25519.SignatureSize
+
+// chainSignedSize is the size of the part of the trailer which is signed.
+const chainSignedSize = chainTrailerSize - ed25519.SignatureSize
+
+// ErrInvalidSignature is returned by Verify when the signature of a
+// recording does not match its hash chain, or was made with another key.
+var ErrInvalidSignature = errors.New("invalid recording signature")
+
+// ErrMetadataModified is returned by Verify when the metadata of a
+// recording is not the one signed with it.
+var ErrMetadataModified = errors.New("recording metadata does not match its signature")
+
+// ErrSidecarModified is returned by VerifyFile when the index or input
+// file of a recording is not the one whose digest is in its signed
+// metadata.
+var ErrSidecarModified = errors.New("recording index or input file does not match its signature")
+
+// ChainPath returns the path of the signed hash chain of a recording.
+//
+// The chain file holds the running hash of every block of the
+// recording: the FBS header of the recording is block 0, and its
+// [length][data][timestamp] blocks follow. The hash of a block is the
+// SHA-256 of the hash of the previous block and of the bytes of the
+// block, the hash before block 0 being the SHA-256 of the header of the
+// chain file. Once the recording ends, a big endian [block count uint64]
+// [recording size uint64][SHA-256 of the metadata file] trailer is
+// appended, followed by the Ed25519 signature of the header, the trailer
+// and the hash of the last block. The metadata names the session, so a
+// signed recording cannot pass for the one of another session, and holds
+// the digests of the index and input files.
+func ChainPath(recordingPath string) string {
+	return recordingPath + ".chain"
+}
+
+// hashChain hashes the blocks of a recording as they are written, and
+// writes their hashes to a chain file.
+type hashChain struct {
+	w      io.Writer
+	last   [sha256.Size]byte
+	blocks uint64
+	size   uint64
+}
+
+func newHashChain(w io.Writer) (*hashChain, error) {
+	if _, err := io.WriteString(w, chainHeader); err != nil {
+		return nil, err
+	}
+	return &hashChain{w: w, last: sha256.Sum256([]byte(chainHeader))}, nil
+}
+
+func chainHash(prev [sha256.Size]byte, block []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(prev[:])
+	h.Write(block)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// add hashes the next block.
+func (c *hashChain) add(block []byte) error {
+	c.last = chainHash(c.last, block)
+	c.blocks++
+	c.size += uint64(len(block))
+	_, err := c.w.Write(c.last[:])
+	return err
+}
+
+// sign writes the trailer of the chain file, for the recording described
+// by metadata, the contents of its metadata file.
+func (c *hashChain) sign(key ed25519.PrivateKey, metadata []byte) error {
+	trailer := make([]byte, 16, chainTrailerSize)
+	binary.BigEndian.PutUint64(trailer, c.blocks)
+	binary.BigEndian.PutUint64(trailer[8:], c.size)
+	metaHash := sha256.Sum256(metadata)
+	trailer = append(trailer, metaHash[:]...)
+	trailer = append(trailer, ed25519.Sign(key, signedChain(trailer, c.last))...)
+	_, err := c.w.Write(trailer)
+	return err
+}
+
+// signedChain returns the message signed in the trailer of a chain file.
+func signedChain(trailer []byte, last [sha256.Size]byte) []byte {
+	msg := append([]byte(chainHeader), trailer[:chainSignedSize]...)
+	return append(msg, last[:]...)
+}
+
+// CorruptBlockError reports a recording that does not match its signed
+// hash chain, at the first block which does not match the chain file.
+// Only the hash of the last block is signed, so the block is the first
+// modified one only if the chain file itself was not modified.
+type CorruptBlockError struct {
+	// Block is the number of the block, 0 being the FBS header.
+	Block int
+	// Offset is the position of the block in the recording.
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptBlockError) Error() string {
+	return fmt.Sprintf("recording block %d at offset %d: %s", e.Block, e.Offset, e.Reason)
+}
+
+// VerifyResult describes a verified recording.
+type VerifyResult struct {
+	Blocks int
+	Size   int64
+	// Metadata is the signed metadata of the recording, naming its
+	// session.
+	Metadata *Metadata
+}
+
+// Verify checks that a recording, read from recording, and its metadata,
+// read from metadata, are the ones signed in its chain file, read from
+// chain, with the private key of publicKey. It returns
+// ErrInvalidSignature if the chain file is not signed by the key,
+// ErrMetadataModified if the metadata is not the signed one, and a
+// *CorruptBlockError if the recording does not match the signature.
+func Verify(recording, metadata, chain io.Reader, publicKey ed25519.PublicKey) (*VerifyResult, error) {
+	data, err := io.ReadAll(chain)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte(encryptedMagic)) {
+		return nil, errors.New("chain file is encrypted, a decryption key is needed")
+	}
+	if !bytes.HasPrefix(data, []byte(chainHeader)) {
+		return nil, errors.New("not a recording chain file")
+	}
+	data = data[len(chainHeader):]
+	if len(data) < chainTrailerSize || (len(data)-chainTrailerSize)%sha256.Size != 0 {
+		return nil, errors.New("chain file is truncated or was not signed")
+	}
+	trailer := data[len(data)-chainTrailerSize:]
+	hashes := data[:len(data)-chainTrailerSize]
+	blocks := binary.BigEndian.Uint64(trailer)
+	if blocks != uint64(len(hashes)/sha256.Size) {
+		return nil, errors.New("chain file is truncated or was not signed")
+	}
+	last := sha256.Sum256([]byte(chainHeader))
+	if blocks > 0 {
+		copy(last[:], hashes[len(hashes)-sha256.Size:])
+	}
+	if !ed25519.Verify(publicKey, signedChain(trailer, last), trailer[chainSignedSize:]) {
+		return nil, ErrInvalidSignature
+	}
+	metaData, err := io.ReadAll(metadata)
+	if err != nil {
+		return nil, err
+	}
+	if metaHash := sha256.Sum256(metaData); !bytes.Equal(metaHash[:], trailer[16:chainSignedSize]) {
+		return nil, ErrMetadataModified
+	}
+	meta := &Metadata{}
+	if err := json.Unmarshal(metaData, meta); err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+
+	// any block modified, removed or added changes the hash of the last
+	// block, which is signed; the hashes before it are not, so a mismatch
+	// only locates the change if the chain file is intact
+	blockReader := &chainBlockReader{r: recording}
+	prev := sha256.Sum256([]byte(chainHeader))
+	var offset int64
+	for i := 0; i < int(blocks); i++ {
+		h := sha256.New()
+		h.Write(prev[:])
+		size, err := blockReader.next(h, i == 0)
+		if err == io.EOF {
+			return nil, &CorruptBlockError{Block: i, Offset: offset, Reason: "missing, the recording is truncated"}
+		}
+		if err != nil {
+			return nil, &CorruptBlockError{Block: i, Offset: offset, Reason: err.Error()}
+		}
+		h.Sum(prev[:0])
+		if !bytes.Equal(prev[:], hashes[i*sha256.Size:(i+1)*sha256.Size]) {
+			return nil, &CorruptBlockError{Block: i, Offset: offset, Reason: "does not match the hash chain"}
+		}
+		offset += size
+	}
+	if _, err := blockReader.next(io.Discard, blocks == 0); err != io.EOF {
+		return nil, &CorruptBlockError{Block: int(blocks), Offset: offset, Reason: "was added after the recording was signed"}
+	}
+	return &VerifyResult{Blocks: int(blocks), Size: offset, Metadata: meta}, nil
+}
+
+// VerifyFile verifies the recording at recordingPath and its metadata
+// file at MetadataPath against its chain file at ChainPath, and its
+// index and input files against their digests in the metadata, if it
+// has any. keys decrypts encrypted recordings, and may be nil for plain
+// ones. It returns ErrSidecarModified if the index or input file was
+// modified.
+func VerifyFile(recordingPath string, publicKey ed25519.PublicKey, keys KeyProvider) (*VerifyResult, error) {
+	open := func(path string) (io.Reader, io.Closer, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if keys == nil {
+			return f, f, nil
+		}
+		r, err := NewDecryptReader(f, keys)
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("failed to decrypt %s: %v", path, err)
+		}
+		return r, f, nil
+	}
+	recording, rc, err := open(recordingPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	metadata, mc, err := open(MetadataPath(recordingPath))
+	if err != nil {
+		return nil, err
+	}
+	defer mc.Close()
+	chain, cc, err := open(ChainPath(recordingPath))
+	if err != nil {
+		return nil, err
+	}
+	defer cc.Close()
+	res, err := Verify(recording, metadata, chain, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sidecar := range []struct{ path, digest string }{
+		{IndexPath(recordingPath), res.Metadata.IndexSHA256},
+		{InputPath(recordingPath), res.Metadata.InputSHA256},
+	} {
+		if sidecar.digest == "" {
+			continue
+		}
+		r, c, err := open(sidecar.path)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, r)
+		c.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", sidecar.path, err)
+		}
+		if hex.EncodeToString(h.Sum(nil)) != sidecar.digest {
+			return nil, fmt.Errorf("%s: %w", sidecar.path, ErrSidecarModified)
+		}
+	}
+	return res, nil
+}
+
+// digestWriter hashes what is written to a file, so that its digest is
+// signed along with the metadata.
+type digestWriter struct {
+	io.WriteCloser
+	h hash.Hash
+}
+
+func newDigestWriter(w io.WriteCloser) *digestWriter {
+	return &digestWriter{WriteCloser: w, h: sha256.New()}
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	n, err := d.WriteCloser.Write(p)
+	d.h.Write(p[:n])
+	return n, err
+}
+
+// digest returns the hex encoded SHA-256 of what was written to w, if it
+// is a digestWriter, or an empty string.
+func digest(w io.WriteCloser) string {
+	d, ok := w.(*digestWriter)
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(d.h.Sum(nil))
+}
+
+// chainBlockReader splits a recording into the blocks of its hash chain.
+type chainBlockReader struct {
+	r io.Reader
+}
+
+// next writes the bytes of the next block to w, the FBS header if header
+// is set, and returns its size. It returns io.EOF at the end of the
+// recording. Blocks are streamed, so their lengths, read from the
+// recording, allocate nothing.
+func (b *chainBlockReader) next(w io.Writer, header bool) (int64, error) {
+	if header {
+		n, err := io.CopyN(w, b.r, int64(len("FBS 001.000\n")))
+		if err == io.EOF && n > 0 {
+			return n, errors.New("truncated")
+		}
+		return n, err
+	}
+	var length [4]byte
+	if _, err := io.ReadFull(b.r, length[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, errors.New("truncated")
+		}
+		return 0, err
+	}
+	if _, err := w.Write(length[:]); err != nil {
+		return 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(length[:]))
+	n, err := io.CopyN(w, b.r, (size+3)&^3+4)
+	if err == io.EOF {
+		return 4 + n, errors.New("truncated")
+	}
+	return 4 + n, err
+}
+
+// ReadSigningKeyFile reads a PEM encoded PKCS #8 Ed25519 private key,
+// such as the ones made by `openssl genpkey -algorithm ed25519`.
+func ReadSigningKeyFile(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+// ReadPublicKeyFile reads a PEM encoded PKIX Ed25519 public key, such as
+// the ones made by `openssl pkey -pubout`.
+func ReadPublicKeyFile(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %s: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not hold an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s does not hold a PEM encoded %s", path, blockType)
+	}
+	return block.Bytes, nil
+}
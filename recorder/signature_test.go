@@ -0,0 +1,129 @@
+package recorder
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/server"
+)
+
+// testMetadata is the metadata file of the recordings of signedRecording.
+var testMetadata = []byte(`{"session_id": "s1", "user": "alice"}`)
+
+// signedRecording returns a recording of the blocks, and its chain file
+// signed with key, along with testMetadata.
+func signedRecording(t *testing.T, key ed25519.PrivateKey, blocks ...[]byte) ([]byte, []byte) {
+	var recording, chain bytes.Buffer
+	c, err := newHashChain(&chain)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	header := []byte("FBS 001.000\n")
+	recording.Write(header)
+	c.add(header)
+	for _, data := range blocks {
+		block := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		block = append(block, data...)
+		block = append(block, make([]byte, (len(data)+3)&^3-len(data))...)
+		block = binary.BigEndian.AppendUint32(block, 1000)
+		recording.Write(block)
+		c.add(block)
+	}
+	if err := c.sign(key, testMetadata); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return recording.Bytes(), chain.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	recording, chain := signedRecording(t, key, []byte("first"), []byte("second block"))
+	// the header, then blocks of 4+8+4 and 4+12+4 bytes
+	second := int64(12 + 16)
+
+	res, err := Verify(bytes.NewReader(recording), bytes.NewReader(testMetadata), bytes.NewReader(chain), pub)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res.Blocks != 3 || res.Size != int64(len(recording)) || res.Metadata.SessionId != "s1" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	if _, err := Verify(bytes.NewReader(recording), bytes.NewReader(testMetadata), bytes.NewReader(chain), otherPub); err != ErrInvalidSignature {
+		t.Fatalf("expected %v, got %v", ErrInvalidSignature, err)
+	}
+
+	// the metadata is bound to the recording by the signature
+	otherSession := bytes.Replace(testMetadata, []byte("s1"), []byte("s2"), 1)
+	if _, err := Verify(bytes.NewReader(recording), bytes.NewReader(otherSession), bytes.NewReader(chain), pub); err != ErrMetadataModified {
+		t.Fatalf("expected %v, got %v", ErrMetadataModified, err)
+	}
+
+	modified := append([]byte(nil), recording...)
+	modified[second+6] ^= 1
+	hugeLength := append([]byte(nil), recording...)
+	binary.BigEndian.PutUint32(hugeLength[second:], 0xffffffff)
+	tests := []struct {
+		name      string
+		recording []byte
+		block     int
+		offset    int64
+	}{
+		{"modified", modified, 2, second},
+		{"truncated", recording[:len(recording)-3], 2, second},
+		{"huge block length", hugeLength, 2, second},
+		{"removed block", recording[:second], 2, second},
+		{"added block", append(append([]byte(nil), recording...), recording[12:second]...), 3, int64(len(recording))},
+	}
+	for _, tt := range tests {
+		_, err := Verify(bytes.NewReader(tt.recording), bytes.NewReader(testMetadata), bytes.NewReader(chain), pub)
+		var corrupt *CorruptBlockError
+		if !errors.As(err, &corrupt) || corrupt.Block != tt.block || corrupt.Offset != tt.offset {
+			t.Errorf("%s: expected block %d at offset %d to be corrupted, got %v", tt.name, tt.block, tt.offset, err)
+		}
+	}
+}
+
+func TestVerifyFile_Sidecars(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	path := filepath.Join(t.TempDir(), "signed.rbs")
+	rec, err := NewRecorderWithOptions(path, RecorderOptions{SigningKey: key, RecordInput: true, KeyframeInterval: time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentServerInitMessage, Message: &common.ServerInit{FBWidth: 4, FBHeight: 2}})
+	rec.Consume(&common.RfbSegment{SegmentType: common.SegmentFullyParsedClientMessage, Message: &server.MsgKeyEvent{Down: 1, Key: 'a'}})
+	if err := rec.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	res, err := VerifyFile(path, pub, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res.Metadata.IndexSHA256 == "" || res.Metadata.InputSHA256 == "" {
+		t.Fatalf("expected the digests of the index and input files, got %+v", res.Metadata)
+	}
+
+	for _, sidecar := range []string{IndexPath(path), InputPath(path)} {
+		data, err := os.ReadFile(sidecar)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := os.WriteFile(sidecar, append(data, '\n'), 0600); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := VerifyFile(path, pub, nil); !errors.Is(err, ErrSidecarModified) {
+			t.Errorf("%s: expected %v, got %v", sidecar, ErrSidecarModified, err)
+		}
+		os.WriteFile(sidecar, data, 0600)
+	}
+}
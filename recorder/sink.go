@@ -0,0 +1,42 @@
+package recorder
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// RecordingSink stores the files of recordings: the .rbs file and its
+// index and input files. Files are written sequentially and closed once
+// the recording ends.
+type RecordingSink interface {
+	// Create returns a writer of a new file. name is a slash separated
+	// path, relative to the storage of the sink. Sinks should not
+	// overwrite an existing file.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// SinkFunc adapts a factory of io.WriteCloser to a RecordingSink.
+type SinkFunc func(name string) (io.WriteCloser, error)
+
+func (f SinkFunc) Create(name string) (io.WriteCloser, error) {
+	return f(name)
+}
+
+// FileSink stores recordings in a local directory, readable only by
+// their owner. Missing parent directories are created. Existing files
+// are never overwritten: Create fails with an error matching
+// os.ErrExist instead.
+type FileSink struct {
+	// Dir is the directory file names are relative to, the working
+	// directory if empty.
+	Dir string
+}
+
+func (s *FileSink) Create(name string) (io.WriteCloser, error) {
+	path := filepath.Join(s.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
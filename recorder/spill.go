@@ -0,0 +1,107 @@
+package recorder
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// spillWriter decouples the writes of a recording file from its sink:
+// the data is appended to a temporary file, and copied to the sink in
+// the background, so a slow sink only makes the temporary file grow.
+type spillWriter struct {
+	dst  io.WriteCloser
+	tmp  *os.File
+	done chan struct{}
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// written and copied are the offsets in tmp of the end of the data,
+	// and of the data not yet copied to dst
+	written int64
+	copied  int64
+	closed  bool
+	err     error
+}
+
+func newSpillWriter(dst io.WriteCloser, dir string) (*spillWriter, error) {
+	tmp, err := os.CreateTemp(dir, "recording-*.spill")
+	if err != nil {
+		return nil, err
+	}
+	w := &spillWriter{dst: dst, tmp: tmp, done: make(chan struct{})}
+	w.cond = sync.NewCond(&w.mu)
+	go w.copy()
+	return w, nil
+}
+
+func (w *spillWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.tmp.WriteAt(p, w.written)
+	w.written += int64(n)
+	w.cond.Signal()
+	return n, err
+}
+
+// copy copies the data of tmp to dst, until the writer is closed and
+// all of it was copied, or dst fails.
+func (w *spillWriter) copy() {
+	defer close(w.done)
+	buf := make([]byte, 64*1024)
+	for {
+		w.mu.Lock()
+		for w.copied == w.written && !w.closed {
+			w.cond.Wait()
+		}
+		if w.copied == w.written {
+			w.mu.Unlock()
+			return
+		}
+		off, n := w.copied, min(int64(len(buf)), w.written-w.copied)
+		w.mu.Unlock()
+
+		// the data being read is never overwritten nor truncated, as
+		// writes only append, and only this goroutine truncates
+		_, err := w.tmp.ReadAt(buf[:n], off)
+		if err == nil {
+			_, err = w.dst.Write(buf[:n])
+		}
+
+		w.mu.Lock()
+		if err != nil {
+			w.err = err
+			w.mu.Unlock()
+			return
+		}
+		w.copied += n
+		if w.copied == w.written {
+			// everything was copied, start over at the beginning of tmp
+			// to keep it small
+			if err := w.tmp.Truncate(0); err == nil {
+				w.copied, w.written = 0, 0
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// Close waits for the data to be copied, and closes the sink.
+func (w *spillWriter) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	w.cond.Signal()
+	w.mu.Unlock()
+
+	<-w.done
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+	err := w.dst.Close()
+	if w.err != nil {
+		return w.err
+	}
+	return err
+}
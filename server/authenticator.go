@@ -0,0 +1,24 @@
+package server
+
+import "errors"
+
+// ErrAuthenticationFailed is returned by the Authenticators of this
+// package when the username or the password is wrong.
+var ErrAuthenticationFailed = errors.New("invalid username or password")
+
+// Authenticator checks the username and password of a vnc-client, as sent
+// by the VeNCrypt Plain subtypes, and returns who the vnc-client is.
+type Authenticator interface {
+	// Authenticate returns the Identity of the vnc-client, or an error if
+	// it is refused. The error is not sent to the vnc-client. A nil
+	// Identity identifies the vnc-client by its username.
+	Authenticate(username, password string) (*Identity, error)
+}
+
+// AuthenticatorFunc is an Authenticator calling the function, e.g. to
+// check the credentials against an external service.
+type AuthenticatorFunc func(username, password string) (*Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(username, password string) (*Identity, error) {
+	return f(username, password)
+}
@@ -112,7 +112,7 @@ func ServerSecurityHandler(cfg *ServerConfig, c *ServerConn) error {
 	// }
 
 	if authErr != nil {
-		if err := binary.Write(c, binary.BigEndian, len(authErr.Error())); err != nil {
+		if err := binary.Write(c, binary.BigEndian, uint32(len(authErr.Error()))); err != nil {
 			return err
 		}
 		if err := binary.Write(c, binary.BigEndian, []byte(authErr.Error())); err != nil {
@@ -128,12 +128,17 @@ func ServerSecurityHandler(cfg *ServerConfig, c *ServerConn) error {
 }
 
 func ServerServerInitHandler(cfg *ServerConfig, c *ServerConn) error {
+	// prefer the name set on the connection (e.g. by a proxy) over the configured one
+	desktopName := cfg.DesktopName
+	if c.DesktopName() != "" {
+		desktopName = []byte(c.DesktopName())
+	}
 	srvInit := &common.ServerInit{
 		FBWidth:     c.Width(),
 		FBHeight:    c.Height(),
 		PixelFormat: *c.CurrentPixelFormat(),
-		NameLength:  uint32(len(cfg.DesktopName)),
-		NameText:    []byte(cfg.DesktopName),
+		NameLength:  uint32(len(desktopName)),
+		NameText:    desktopName,
 	}
 	if err := binary.Write(c, binary.BigEndian, srvInit.FBWidth); err != nil {
 		return err
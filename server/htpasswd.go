@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// unknownUserHash is compared to the passwords of unknown users, so they
+// take as long to refuse as the known ones.
+var unknownUserHash = []byte("$2a$10$VjbshwhOk/injE31DTXRZOU.ZfuTQzMZjeecRq370/l8SGnl9N0XC")
+
+// HtpasswdAuthenticator authenticates the vnc-clients with the bcrypt
+// hashed passwords of an htpasswd file, such as the ones made by
+// `htpasswd -B`.
+type HtpasswdAuthenticator struct {
+	hashes map[string][]byte
+}
+
+// LoadHtpasswdFile reads the htpasswd file at path: one username:hash
+// line per user, blank lines and lines starting with # being ignored.
+// Only bcrypt hashes are supported.
+func LoadHtpasswdFile(path string) (*HtpasswdAuthenticator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	auth := &HtpasswdAuthenticator{hashes: make(map[string][]byte)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:hash", path, n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: the password of %s is not a bcrypt hash", path, n, username)
+		}
+		if _, ok := auth.hashes[username]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate user %s", path, n, username)
+		}
+		auth.hashes[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(username, password string) (*Identity, error) {
+	hash, ok := a.hashes[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(unknownUserHash, []byte(password))
+		return nil, ErrAuthenticationFailed
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+	return &Identity{Username: username}, nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// aliceHash is the bcrypt hash of "secret", with the minimum cost.
+const aliceHash = "$2a$04$m0rI7J0dOkoJg7ADqK9bjO78kruLpl/2VCLCHL96swIX8DmvddXpC"
+
+func writeHtpasswd(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("error writing the htpasswd file: %s", err)
+	}
+	return path
+}
+
+func TestLoadHtpasswdFile(t *testing.T) {
+	path := writeHtpasswd(t, "# vnc users\n\nalice:"+aliceHash+"\n  # indented comment\n")
+	auth, err := LoadHtpasswdFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	id, err := auth.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if id.Username != "alice" {
+		t.Errorf("unexpected identity %+v", id)
+	}
+	if _, err := auth.Authenticate("alice", "wrong"); err != ErrAuthenticationFailed {
+		t.Errorf("bad password: expected ErrAuthenticationFailed, got %v", err)
+	}
+	if _, err := auth.Authenticate("bob", "secret"); err != ErrAuthenticationFailed {
+		t.Errorf("unknown user: expected ErrAuthenticationFailed, got %v", err)
+	}
+}
+
+func TestLoadHtpasswdFile_Invalid(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		// MD5 and SHA1 hashes, as made by htpasswd without -B
+		{"alice:$apr1$q8Z1e9VB$5ZKQ5F0iTc8E1k5lgd8Lj.\n", "htpasswd:1: the password of alice is not a bcrypt hash"},
+		{"# users\nalice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", "htpasswd:2: the password of alice is not a bcrypt hash"},
+		{"alice:" + aliceHash + "\nalice:" + aliceHash + "\n", "htpasswd:2: duplicate user alice"},
+		{"alice\n", "htpasswd:1: expected username:hash"},
+		{":" + aliceHash + "\n", "htpasswd:1: expected username:hash"},
+	}
+
+	for _, tt := range tests {
+		_, err := LoadHtpasswdFile(writeHtpasswd(t, tt.content))
+		if err == nil || !strings.HasSuffix(err.Error(), tt.err) {
+			t.Errorf("LoadHtpasswdFile(%q) = %v, want an error ending with %q", tt.content, err, tt.err)
+		}
+	}
+}
+
+func TestLoadHtpasswdFile_Missing(t *testing.T) {
+	if _, err := LoadHtpasswdFile(filepath.Join(t.TempDir(), "htpasswd")); err == nil {
+		t.Fatal("error expected")
+	}
+}
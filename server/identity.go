@@ -0,0 +1,13 @@
+package server
+
+// Identity describes the authenticated principal behind a ServerConn.
+// Security handlers that establish who is connecting (rather than only
+// checking a shared secret) store one on the connection.
+type Identity struct {
+	// Username is the name the client authenticated as.
+	Username string
+
+	// Attributes holds any extra information the security handler
+	// knows about the principal, e.g. groups or roles.
+	Attributes map[string]string
+}
@@ -5,8 +5,10 @@ import (
 	"crypto/des"
 	"crypto/rand"
 	"errors"
-	"github.com/borderzero/vncproxy/common"
+	"io"
 	"log"
+
+	"github.com/borderzero/vncproxy/common"
 )
 
 type SecurityType uint8
@@ -212,7 +214,7 @@ func (auth *ServerAuthVNC) Auth(c common.IServerConn) error {
 	}
 	//c.Flush()
 	buf2 := make([]byte, 16)
-	_, err = c.Read(buf2)
+	_, err = io.ReadFull(c, buf2)
 	if err != nil {
 		log.Printf("The authentication result was not read: %s\n", err.Error())
 		return errors.New("The authentication result was not read" + err.Error())
@@ -227,12 +229,8 @@ func (auth *ServerAuthVNC) Auth(c common.IServerConn) error {
 	bk.Encrypt(buf3, buf)               //Encrypt first 8 bytes
 	bk.Encrypt(buf3[8:], buf[8:])       // Encrypt second 8 bytes
 	if bytes.Compare(buf2, buf3) != 0 { // If the result does not decrypt correctly to what we sent then a problem
-		SetUint32(buf, 0, 1)
-		SetUint32(buf, 4, uint32(len([]byte(AUTH_FAIL))))
-		copy(buf[8:], []byte(AUTH_FAIL))
-		c.Write(buf)
-		//c.Flush()
-		return errors.New("Authentication failed")
+		// the failure is sent to the client by ServerSecurityHandler
+		return errors.New(AUTH_FAIL)
 	}
 	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
 	"sync"
 
 	"github.com/borderzero/vncproxy/common"
@@ -41,8 +42,16 @@ type ServerConn struct {
 	// a consumer for the parsed messages, to allow for recording and proxy
 	Listeners *common.MultiListener
 
+	// Interceptors can inspect, rewrite or drop the parsed messages
+	// before they reach the Listeners
+	Interceptors *common.ClientInterceptorChain
+
 	SessionId string
 
+	// Identity is the authenticated principal, or nil when the security
+	// handler used for this connection does not establish one.
+	Identity *Identity
+
 	quit chan struct{}
 }
 
@@ -63,13 +72,14 @@ func NewServerConn(c io.ReadWriter, cfg *ServerConfig) (*ServerConn, error) {
 		c: c,
 		//br:          bufio.NewReader(c),
 		//bw:          bufio.NewWriter(c),
-		cfg:         cfg,
-		quit:        make(chan struct{}),
-		encodings:   cfg.Encodings,
-		pixelFormat: cfg.PixelFormat,
-		fbWidth:     cfg.Width,
-		fbHeight:    cfg.Height,
-		Listeners:   &common.MultiListener{},
+		cfg:          cfg,
+		quit:         make(chan struct{}),
+		encodings:    cfg.Encodings,
+		pixelFormat:  cfg.PixelFormat,
+		fbWidth:      cfg.Width,
+		fbHeight:     cfg.Height,
+		Listeners:    &common.MultiListener{},
+		Interceptors: &common.ClientInterceptorChain{},
 	}, nil
 }
 
@@ -77,6 +87,24 @@ func (c *ServerConn) Conn() io.ReadWriter {
 	return c.c
 }
 
+// RemoteAddr returns the address of the vnc-client, or nil if the
+// underlying transport is not a network connection.
+func (c *ServerConn) RemoteAddr() net.Addr {
+	if nc, ok := c.c.(net.Conn); ok {
+		return nc.RemoteAddr()
+	}
+	return nil
+}
+
+// LocalAddr returns the local address the vnc-client connected to, or nil
+// if the underlying transport is not a network connection.
+func (c *ServerConn) LocalAddr() net.Addr {
+	if nc, ok := c.c.(net.Conn); ok {
+		return nc.LocalAddr()
+	}
+	return nil
+}
+
 func (c *ServerConn) SetEncodings(encs []common.EncodingType) error {
 	encodings := make(map[int32]common.IEncoding)
 	for _, enc := range c.cfg.Encodings {
@@ -174,10 +202,23 @@ func (c *ServerConn) handle() error {
 			msg, ok := clientMessages[messageType]
 			// logger.Debugf("ServerConn.handle: found message type, %v", ok)
 			if !ok {
-				// logger.Errorf("ServerConn.handle: unsupported message-type: %v", messageType)
+				return fmt.Errorf("ServerConn.handle: unsupported message-type: %v", messageType)
 			}
 			parsedMsg, err := msg.Read(c)
+			if err != nil {
+				return fmt.Errorf("server error: %v", err)
+			}
 			// logger.Debugf("ServerConn.handle: got parsed messagetype, %v", parsedMsg)
+
+			// let the interceptors rewrite or drop the message before anyone sees it
+			parsedMsg, err = c.Interceptors.Intercept(parsedMsg)
+			if err != nil {
+				return fmt.Errorf("interceptor error: %v", err)
+			}
+			if parsedMsg == nil {
+				continue
+			}
+
 			//update connection for pixel format / color map changes
 			switch parsedMsg.Type() {
 			case common.SetPixelFormatMsgType:
@@ -191,10 +232,6 @@ func (c *ServerConn) handle() error {
 			}
 			////////
 
-			if err != nil {
-				return fmt.Errorf("server error: %v", err)
-			}
-
 			// logger.Debugf("IServerConn.Handle got ClientMessage: %s, %v", parsedMsg.Type(), parsedMsg)
 			//TODO: treat set encodings by allowing only supported encoding in proxy configurations
 			//// if parsedMsg.Type() == common.SetEncodingsMsgType{
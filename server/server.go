@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"io"
 	"net"
@@ -42,6 +44,7 @@ type ServerConfig struct {
 
 	//handler to allow for registering for messages, this can't be a channel
 	//because of the websockets handler function which will kill the connection on exit if conn.handle() is run on another thread
+	//it runs once the vnc-client is authenticated, with its Identity set on the connection if the security handler established one
 	NewConnHandler ServerHandler
 }
 
@@ -54,10 +57,17 @@ func Serve(ctx context.Context, logger *zap.Logger, ln net.Listener, cfg *Server
 			}
 			return err
 		}
-		go attachNewServerConn(ctx, logger, c, cfg, "dummySession")
+		go attachNewServerConn(ctx, logger, c, cfg, NewSessionId())
 	}
 }
 
+// NewSessionId returns a random identifier for a connection or a session.
+func NewSessionId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 func attachNewServerConn(
 	ctx context.Context,
 	logger *zap.Logger,
@@ -71,6 +81,11 @@ func attachNewServerConn(
 	}
 	defer conn.Close()
 
+	conn.SessionId = sessionId
+	if cfg.UseDummySession {
+		conn.SessionId = "dummySession"
+	}
+
 	if err := ServerVersionHandler(cfg, conn); err != nil {
 		return err
 	}
@@ -94,10 +109,5 @@ func attachNewServerConn(
 		return err
 	}
 
-	conn.SessionId = sessionId
-	if cfg.UseDummySession {
-		conn.SessionId = "dummySession"
-	}
-
 	return conn.handle()
 }
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/borderzero/vncproxy/common"
+)
+
+// maxPlainCredentialLength bounds the username and password read by the
+// Plain subtypes.
+const maxPlainCredentialLength = 1024
+
+// ServerAuthVeNCrypt is the VeNCrypt security type, version 0.2. The
+// vnc-client picks one of SubTypes, the connection is upgraded to TLS,
+// and the vnc-client then authenticates over it, as the subtype says:
+// not at all (None), with the password of the VNC authentication (VNC),
+// or with a username and a password in the clear (Plain).
+// See https://github.com/rfbproto/rfbproto/blob/master/rfbproto.rst#vencrypt
+//
+// The TLS subtypes use the certificate of TLSConfig like the X509 ones:
+// crypto/tls does not implement the anonymous Diffie-Hellman cipher
+// suites the TLS subtypes are meant for, so the vnc-clients using them,
+// such as TigerVNC or libvncclient, fail the TLS handshake. They are
+// only offered if SubTypes lists them.
+type ServerAuthVeNCrypt struct {
+	// TLSConfig is the configuration of the TLS server, holding its
+	// certificate. Required.
+	TLSConfig *tls.Config
+
+	// SubTypes are the subtypes offered to the vnc-clients, in order of
+	// preference. If empty, X509Plain is offered if Authenticator is
+	// set, else X509VNC if Password is set, else X509None.
+	SubTypes []SecuritySubType
+
+	// Password is the password of the VNC subtypes.
+	Password string
+
+	// Authenticator checks the username and password of the Plain
+	// subtypes, and sets the Identity of the connection.
+	Authenticator Authenticator
+}
+
+func (*ServerAuthVeNCrypt) Type() SecurityType {
+	return SecTypeVeNCrypt
+}
+
+func (*ServerAuthVeNCrypt) SubType() SecuritySubType {
+	return SecSubTypeVeNCrypt02Unknown
+}
+
+func (auth *ServerAuthVeNCrypt) subTypes() []SecuritySubType {
+	switch {
+	case len(auth.SubTypes) > 0:
+		return auth.SubTypes
+	case auth.Authenticator != nil:
+		return []SecuritySubType{SecSubTypeVeNCrypt02X509Plain}
+	case auth.Password != "":
+		return []SecuritySubType{SecSubTypeVeNCrypt02X509VNC}
+	}
+	return []SecuritySubType{SecSubTypeVeNCrypt02X509None}
+}
+
+func (auth *ServerAuthVeNCrypt) Auth(c common.IServerConn) error {
+	conn, ok := c.(*ServerConn)
+	if !ok {
+		return errors.New("VeNCrypt requires a *ServerConn")
+	}
+	if auth.TLSConfig == nil {
+		return errors.New("VeNCrypt is not configured, missing its TLS configuration")
+	}
+
+	// version
+	if _, err := c.Write([]byte{0, 2}); err != nil {
+		return err
+	}
+	var version [2]byte
+	if _, err := io.ReadFull(c, version[:]); err != nil {
+		return err
+	}
+	if version != [2]byte{0, 2} {
+		c.Write([]byte{1})
+		return fmt.Errorf("unsupported VeNCrypt version %d.%d", version[0], version[1])
+	}
+	if _, err := c.Write([]byte{0}); err != nil {
+		return err
+	}
+
+	// subtype
+	subTypes := auth.subTypes()
+	if err := binary.Write(c, binary.BigEndian, uint8(len(subTypes))); err != nil {
+		return err
+	}
+	if err := binary.Write(c, binary.BigEndian, subTypes); err != nil {
+		return err
+	}
+	var subType SecuritySubType
+	if err := binary.Read(c, binary.BigEndian, &subType); err != nil {
+		return err
+	}
+	offered := false
+	for _, t := range subTypes {
+		offered = offered || t == subType
+	}
+	if !offered {
+		c.Write([]byte{0})
+		return fmt.Errorf("VeNCrypt subtype %d was not offered", subType)
+	}
+	if subType == SecSubTypeVeNCrypt02Plain {
+		return errors.New("VeNCrypt Plain without TLS is not supported")
+	}
+	if _, err := c.Write([]byte{1}); err != nil {
+		return err
+	}
+
+	if err := conn.StartTLS(auth.TLSConfig); err != nil {
+		return fmt.Errorf("VeNCrypt TLS handshake failed: %v", err)
+	}
+
+	switch subType {
+	case SecSubTypeVeNCrypt02TLSNone, SecSubTypeVeNCrypt02X509None:
+		return nil
+	case SecSubTypeVeNCrypt02TLSVNC, SecSubTypeVeNCrypt02X509VNC:
+		return (&ServerAuthVNC{Pass: auth.Password}).Auth(c)
+	case SecSubTypeVeNCrypt02TLSPlain, SecSubTypeVeNCrypt02X509Plain:
+		return auth.authPlain(conn)
+	}
+	return fmt.Errorf("unsupported VeNCrypt subtype %d", subType)
+}
+
+// authPlain reads the [username length uint32][password length uint32]
+// [username][password] of the Plain subtypes.
+func (auth *ServerAuthVeNCrypt) authPlain(c *ServerConn) error {
+	if auth.Authenticator == nil {
+		return errors.New("VeNCrypt Plain is not configured")
+	}
+	var lengths [2]uint32
+	if err := binary.Read(c, binary.BigEndian, &lengths); err != nil {
+		return err
+	}
+	if lengths[0] > maxPlainCredentialLength || lengths[1] > maxPlainCredentialLength {
+		return errors.New("VeNCrypt Plain credentials are too long")
+	}
+	creds := make([]byte, lengths[0]+lengths[1])
+	if _, err := io.ReadFull(c, creds); err != nil {
+		return err
+	}
+	username := string(creds[:lengths[0]])
+	id, err := auth.Authenticator.Authenticate(username, string(creds[lengths[0]:]))
+	if err != nil {
+		// the reason is sent to the vnc-client, which must not learn
+		// whether the username exists
+		return errors.New(AUTH_FAIL)
+	}
+	if id == nil {
+		id = &Identity{Username: username}
+	}
+	c.Identity = id
+	return nil
+}
+
+// StartTLS upgrades the transport of the connection to TLS, as the
+// server side of the handshake.
+func (c *ServerConn) StartTLS(cfg *tls.Config) error {
+	nc, ok := c.c.(net.Conn)
+	if !ok {
+		return errors.New("the transport is not a network connection")
+	}
+	tc := tls.Server(nc, cfg)
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.c = tc
+	return nil
+}
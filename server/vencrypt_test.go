@@ -0,0 +1,211 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/borderzero/vncproxy/common"
+)
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "vnc-server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// vencryptResult is the outcome of a VeNCrypt handshake, on both sides.
+type vencryptResult struct {
+	// offered are the subtypes offered by the server
+	offered []uint32
+	// accepted is whether the server accepted the subtype of the client
+	accepted bool
+	// err is the error returned by Auth
+	err  error
+	conn *ServerConn
+}
+
+// vencryptHandshake runs auth over a pipe, the client picking subType
+// and, once over TLS, running clientAuth if set.
+func vencryptHandshake(t *testing.T, auth *ServerAuthVeNCrypt, subType uint32, clientAuth func(io.ReadWriter) error) *vencryptResult {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn, err := NewServerConn(server, &ServerConfig{ClientMessages: DefaultClientMessages})
+	if err != nil {
+		t.Fatalf("error creating the connection: %s", err)
+	}
+	authErr := make(chan error, 1)
+	go func() {
+		authErr <- auth.Auth(conn)
+		server.Close()
+	}()
+
+	res := &vencryptResult{conn: conn}
+	clientErr := func() error {
+		var version [2]byte
+		if _, err := io.ReadFull(client, version[:]); err != nil {
+			return err
+		}
+		if _, err := client.Write([]byte{0, 2}); err != nil {
+			return err
+		}
+		var ack [1]byte
+		if _, err := io.ReadFull(client, ack[:]); err != nil {
+			return err
+		}
+		var count uint8
+		if err := binary.Read(client, binary.BigEndian, &count); err != nil {
+			return err
+		}
+		res.offered = make([]uint32, count)
+		if err := binary.Read(client, binary.BigEndian, res.offered); err != nil {
+			return err
+		}
+		if err := binary.Write(client, binary.BigEndian, subType); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(client, ack[:]); err != nil {
+			return err
+		}
+		if res.accepted = ack[0] == 1; !res.accepted {
+			return nil
+		}
+		tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+		if err := tc.Handshake(); err != nil {
+			return err
+		}
+		if clientAuth != nil {
+			return clientAuth(tc)
+		}
+		return nil
+	}()
+	if clientErr != nil {
+		t.Fatalf("client failed: %s", clientErr)
+	}
+	res.err = <-authErr
+	return res
+}
+
+// plainLogin sends the credentials of the Plain subtypes.
+func plainLogin(username, password string) func(io.ReadWriter) error {
+	return func(c io.ReadWriter) error {
+		lengths := []uint32{uint32(len(username)), uint32(len(password))}
+		if err := binary.Write(c, binary.BigEndian, lengths); err != nil {
+			return err
+		}
+		_, err := io.WriteString(c, username+password)
+		return err
+	}
+}
+
+func testAuthenticator() Authenticator {
+	return AuthenticatorFunc(func(username, password string) (*Identity, error) {
+		switch {
+		case username != "alice":
+			return nil, errors.New("unknown user alice")
+		case password != "secret":
+			return nil, errors.New("wrong password for alice")
+		}
+		return &Identity{Username: username, Attributes: map[string]string{"role": "admin"}}, nil
+	})
+}
+
+func TestServerAuthVeNCrypt_DefaultSubTypes(t *testing.T) {
+	tests := []struct {
+		auth *ServerAuthVeNCrypt
+		want SecuritySubType
+	}{
+		{&ServerAuthVeNCrypt{Authenticator: testAuthenticator()}, SecSubTypeVeNCrypt02X509Plain},
+		{&ServerAuthVeNCrypt{Password: "secret"}, SecSubTypeVeNCrypt02X509VNC},
+		{&ServerAuthVeNCrypt{}, SecSubTypeVeNCrypt02X509None},
+	}
+
+	for _, tt := range tests {
+		got := tt.auth.subTypes()
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("subTypes() = %v, want [%d]", got, tt.want)
+		}
+	}
+}
+
+func TestServerAuthVeNCrypt_RefusesSubType(t *testing.T) {
+	auth := &ServerAuthVeNCrypt{
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}},
+		Authenticator: testAuthenticator(),
+	}
+	res := vencryptHandshake(t, auth, uint32(SecSubTypeVeNCrypt02TLSPlain), nil)
+	if len(res.offered) != 1 || res.offered[0] != uint32(SecSubTypeVeNCrypt02X509Plain) {
+		t.Fatalf("unexpected subtypes offered: %v", res.offered)
+	}
+	if res.accepted {
+		t.Fatal("expected the subtype to be refused")
+	}
+	if res.err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestServerAuthVeNCrypt_Plain(t *testing.T) {
+	auth := &ServerAuthVeNCrypt{
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}},
+		Authenticator: testAuthenticator(),
+	}
+	res := vencryptHandshake(t, auth, uint32(SecSubTypeVeNCrypt02X509Plain), plainLogin("alice", "secret"))
+	if res.err != nil {
+		t.Fatalf("unexpected error: %s", res.err)
+	}
+	id := res.conn.Identity
+	if id == nil || id.Username != "alice" || id.Attributes["role"] != "admin" {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+}
+
+func TestServerAuthVeNCrypt_PlainRefused(t *testing.T) {
+	for _, creds := range [][2]string{{"alice", "wrong"}, {"mallory", "secret"}} {
+		auth := &ServerAuthVeNCrypt{
+			TLSConfig:     &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}},
+			Authenticator: testAuthenticator(),
+		}
+		res := vencryptHandshake(t, auth, uint32(SecSubTypeVeNCrypt02X509Plain), plainLogin(creds[0], creds[1]))
+		// the reason is sent to the vnc-client, so it must not say whether
+		// the username exists
+		if res.err == nil || res.err.Error() != AUTH_FAIL {
+			t.Errorf("%s/%s: expected %q, got %v", creds[0], creds[1], AUTH_FAIL, res.err)
+		}
+		if res.conn.Identity != nil {
+			t.Errorf("%s/%s: unexpected identity %+v", creds[0], creds[1], res.conn.Identity)
+		}
+	}
+}
+
+func TestServerAuthVeNCrypt_RequiresServerConn(t *testing.T) {
+	var c common.IServerConn
+	err := (&ServerAuthVeNCrypt{}).Auth(c)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+}
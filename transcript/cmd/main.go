@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/borderzero/vncproxy/transcript"
+)
+
+var VERSION = "dev"
+
+func main() {
+	file := flag.String("file", "", "path of the .rbs recording, recorded with its input events")
+	version := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(VERSION)
+		return
+	}
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "missing -file")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	lines, err := transcript.FromRecording(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read transcript: %v\n", err)
+		os.Exit(1)
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,86 @@
+package transcript
+
+// X keysyms of the keys a transcript renders as tokens, see
+// X11/keysymdef.h.
+const (
+	keyBackSpace   = 0xff08
+	keyTab         = 0xff09
+	keyReturn      = 0xff0d
+	keyPause       = 0xff13
+	keyEscape      = 0xff1b
+	keyHome        = 0xff50
+	keyLeft        = 0xff51
+	keyUp          = 0xff52
+	keyRight       = 0xff53
+	keyDown        = 0xff54
+	keyPageUp      = 0xff55
+	keyPageDown    = 0xff56
+	keyEnd         = 0xff57
+	keyPrint       = 0xff61
+	keyInsert      = 0xff63
+	keyMenu        = 0xff67
+	keyKPSpace     = 0xff80
+	keyKPTab       = 0xff89
+	keyKPEnter     = 0xff8d
+	keyKPMultiply  = 0xffaa
+	keyKP9         = 0xffb9
+	keyKPEqual     = 0xffbd
+	keyF1          = 0xffbe
+	keyF24         = 0xffd5
+	keyShiftL      = 0xffe1
+	keyShiftR      = 0xffe2
+	keyControlL    = 0xffe3
+	keyControlR    = 0xffe4
+	keyMetaL       = 0xffe7
+	keyMetaR       = 0xffe8
+	keyAltL        = 0xffe9
+	keyAltR        = 0xffea
+	keySuperL      = 0xffeb
+	keySuperR      = 0xffec
+	keyDelete      = 0xffff
+	keyISOLeftTab  = 0xfe20
+	keyUnicodeBase = 0x01000000
+)
+
+// specialKeys are the names of the keys without a character.
+var specialKeys = map[uint32]string{
+	keyBackSpace:  "Backspace",
+	keyTab:        "Tab",
+	keyKPTab:      "Tab",
+	keyReturn:     "Enter",
+	keyKPEnter:    "Enter",
+	keyPause:      "Pause",
+	keyEscape:     "Esc",
+	keyHome:       "Home",
+	keyLeft:       "Left",
+	keyUp:         "Up",
+	keyRight:      "Right",
+	keyDown:       "Down",
+	keyPageUp:     "PageUp",
+	keyPageDown:   "PageDown",
+	keyEnd:        "End",
+	keyPrint:      "Print",
+	keyInsert:     "Insert",
+	keyMenu:       "Menu",
+	keyDelete:     "Delete",
+	keyISOLeftTab: "Tab",
+}
+
+// keysymRune returns the character typed by a keysym, if any.
+func keysymRune(keysym uint32) (rune, bool) {
+	switch {
+	case keysym >= 0x20 && keysym <= 0x7e, keysym >= 0xa0 && keysym <= 0xff:
+		// Latin-1 keysyms are their code points
+		return rune(keysym), true
+	case keysym >= keyUnicodeBase+0x100 && keysym <= keyUnicodeBase+0x10ffff:
+		return rune(keysym - keyUnicodeBase), true
+	case keysym == keyKPSpace:
+		return ' ', true
+	case keysym == keyKPEqual:
+		return '=', true
+	case keysym >= keyKPMultiply && keysym <= keyKP9:
+		// * + , - . / 0-9 of the keypad
+		return rune(keysym - keyKPMultiply + '*'), true
+	}
+	return 0, false
+}
@@ -0,0 +1,217 @@
+// Package transcript turns the key events of VNC sessions into readable,
+// timestamped lines of text.
+package transcript
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/recorder"
+	"github.com/borderzero/vncproxy/server"
+)
+
+// TimeFormat is the format of the timestamps of Line.String.
+const TimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Line is a line of a transcript: the keys typed up to and including
+// an Enter. Characters are written as typed, other keys and keys typed
+// with Ctrl, Alt or Super held as tokens such as <Enter> or <Ctrl+C>.
+type Line struct {
+	// Time is when the first key of the line was typed.
+	Time time.Time
+	Text string
+}
+
+func (l Line) String() string {
+	return l.Time.Format(TimeFormat) + " " + l.Text
+}
+
+// modifier is a modifier key, as rendered in tokens.
+type modifier struct {
+	name   string
+	keysym [2]uint32
+}
+
+// modifiers are in the order of the tokens: <Ctrl+Alt+Shift+Del>.
+var modifiers = []modifier{
+	{"Ctrl", [2]uint32{keyControlL, keyControlR}},
+	{"Alt", [2]uint32{keyAltL, keyAltR}},
+	{"Alt", [2]uint32{keyMetaL, keyMetaR}},
+	{"Super", [2]uint32{keySuperL, keySuperR}},
+	{"Shift", [2]uint32{keyShiftL, keyShiftR}},
+}
+
+// Transcriber builds a transcript from key events. It is safe for
+// concurrent use, so it can listen to the viewers of a shared session.
+//
+// As a SegmentConsumer, it transcribes the key events of the client
+// messages it receives, stamped with the time they are consumed, and
+// flushes the last line when the connection closes.
+type Transcriber struct {
+	// OnLine is called with each line of the transcript. It may be
+	// called concurrently by the goroutines sending key events.
+	OnLine func(Line)
+
+	mu      sync.Mutex
+	pressed map[uint32]bool
+	line    strings.Builder
+	start   time.Time
+}
+
+// Key transcribes a key event of keysym, received at the given time.
+func (t *Transcriber) Key(at time.Time, keysym uint32, down bool) {
+	t.mu.Lock()
+	line, ok := t.key(at, keysym, down)
+	t.mu.Unlock()
+	if ok {
+		t.emit(line)
+	}
+}
+
+// key transcribes a key event, and returns the line it ended, if any.
+func (t *Transcriber) key(at time.Time, keysym uint32, down bool) (Line, bool) {
+	if t.pressed == nil {
+		t.pressed = make(map[uint32]bool)
+	}
+	if isModifier(keysym) {
+		t.pressed[keysym] = down
+		return Line{}, false
+	}
+	if !down {
+		return Line{}, false
+	}
+
+	var text string
+	r, printable := keysymRune(keysym)
+	mods := t.modifiers(!printable)
+	switch {
+	case !printable:
+		text = token(mods, keyName(keysym))
+	case len(mods) > 0:
+		if r == ' ' {
+			text = token(mods, "Space")
+		} else {
+			text = token(mods, string(unicode.ToUpper(r)))
+		}
+	default:
+		// with Shift held, the keysym already is the shifted character
+		text = string(r)
+	}
+
+	if t.line.Len() == 0 {
+		t.start = at
+	}
+	t.line.WriteString(text)
+	if keysym == keyReturn || keysym == keyKPEnter {
+		return t.flush()
+	}
+	return Line{}, false
+}
+
+// modifiers returns the names of the modifiers held. Shift is only
+// included with withShift, or with another modifier.
+func (t *Transcriber) modifiers(withShift bool) []string {
+	var names []string
+	for _, m := range modifiers {
+		if !t.pressed[m.keysym[0]] && !t.pressed[m.keysym[1]] {
+			continue
+		}
+		if m.name == "Shift" && !withShift && len(names) == 0 {
+			continue
+		}
+		if len(names) > 0 && names[len(names)-1] == m.name {
+			continue
+		}
+		names = append(names, m.name)
+	}
+	return names
+}
+
+// keyName returns the name of a key without a character.
+func keyName(keysym uint32) string {
+	if name, ok := specialKeys[keysym]; ok {
+		return name
+	}
+	if keysym >= keyF1 && keysym <= keyF24 {
+		return fmt.Sprintf("F%d", keysym-keyF1+1)
+	}
+	return fmt.Sprintf("0x%x", keysym)
+}
+
+func isModifier(keysym uint32) bool {
+	for _, m := range modifiers {
+		if keysym == m.keysym[0] || keysym == m.keysym[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func token(mods []string, name string) string {
+	return "<" + strings.Join(append(mods, name), "+") + ">"
+}
+
+// Flush ends the current line, if it is not empty.
+func (t *Transcriber) Flush() {
+	t.mu.Lock()
+	line, ok := t.flush()
+	t.mu.Unlock()
+	if ok {
+		t.emit(line)
+	}
+}
+
+// flush ends the current line, and returns it unless it is empty.
+func (t *Transcriber) flush() (Line, bool) {
+	if t.line.Len() == 0 {
+		return Line{}, false
+	}
+	line := Line{Time: t.start, Text: t.line.String()}
+	t.line.Reset()
+	return line, true
+}
+
+// emit passes a line to OnLine, once the lock is released, so that
+// OnLine can take its time, or use the Transcriber.
+func (t *Transcriber) emit(line Line) {
+	if t.OnLine != nil {
+		t.OnLine(line)
+	}
+}
+
+func (t *Transcriber) Consume(seg *common.RfbSegment) error {
+	switch seg.SegmentType {
+	case common.SegmentFullyParsedClientMessage:
+		switch msg := seg.Message.(type) {
+		case *server.MsgKeyEvent:
+			t.Key(time.Now(), uint32(msg.Key), msg.Down != 0)
+		case *server.MsgClientQemuExtendedKey:
+			t.Key(time.Now(), msg.KeySym, msg.IsDown != 0)
+		}
+	case common.SegmentConnectionClosed:
+		t.Flush()
+	}
+	return nil
+}
+
+// FromRecording returns the transcript of a recording made with the
+// input events of its vnc-clients, see recorder.RecorderOptions.RecordInput.
+func FromRecording(recordingPath string) ([]Line, error) {
+	events, err := recorder.ReadInputEvents(recordingPath)
+	if err != nil {
+		return nil, err
+	}
+	var lines []Line
+	t := &Transcriber{OnLine: func(l Line) { lines = append(lines, l) }}
+	for _, ev := range events {
+		if ev.Key != nil {
+			t.Key(ev.Time, ev.Key.Keysym, ev.Key.Down)
+		}
+	}
+	t.Flush()
+	return lines, nil
+}
@@ -0,0 +1,126 @@
+package transcript
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/borderzero/vncproxy/common"
+	"github.com/borderzero/vncproxy/server"
+)
+
+// key is a key event of a test.
+type key struct {
+	keysym uint32
+	down   bool
+}
+
+// typed returns the press and release events of each keysym.
+func typed(keysyms ...uint32) []key {
+	var keys []key
+	for _, keysym := range keysyms {
+		keys = append(keys, key{keysym, true}, key{keysym, false})
+	}
+	return keys
+}
+
+// held returns the events of typing keys with the modifier held.
+func held(modifier uint32, keys ...key) []key {
+	return append(append([]key{{modifier, true}}, keys...), key{modifier, false})
+}
+
+func concat(keys ...[]key) []key {
+	var all []key
+	for _, k := range keys {
+		all = append(all, k...)
+	}
+	return all
+}
+
+func TestTranscriber(t *testing.T) {
+	tests := []struct {
+		name  string
+		keys  []key
+		lines []string
+	}{
+		{"text", typed('l', 's', ' ', '-', 'l', keyReturn), []string{"ls -l<Enter>"}},
+		{"shifted characters", held(keyShiftL, typed('L', '!')...), []string{"L!"}},
+		{"special keys", typed(keyBackSpace, keyLeft, keyF1+11, keyKPEnter), []string{"<Backspace><Left><F12><Enter>"}},
+		{"keypad", typed(keyKP9-9, keyKPMultiply+1, keyKPEqual), []string{"0+="}},
+		{"latin-1 and unicode", typed('é', keyUnicodeBase+0x20ac), []string{"é€"}},
+		{"unknown keysym", typed(0xfd01), []string{"<0xfd01>"}},
+		{"ctrl", held(keyControlR, typed('c')...), []string{"<Ctrl+C>"}},
+		{"ctrl space", held(keyControlL, typed(' ')...), []string{"<Ctrl+Space>"}},
+		{"meta is alt", held(keyMetaL, typed(keyTab)...), []string{"<Alt+Tab>"}},
+		{"modifiers in order", held(keyShiftL, held(keyAltL, held(keyControlL, typed(keyDelete)...)...)...), []string{"<Ctrl+Alt+Shift+Delete>"}},
+		{"shift with a special key", held(keyShiftR, typed(keyISOLeftTab)...), []string{"<Shift+Tab>"}},
+		{"both sides held once", held(keyControlL, held(keyControlR, typed('x')...)...), []string{"<Ctrl+X>"}},
+		{"released modifier", concat(held(keyControlL), typed('x')), []string{"x"}},
+		{"lines", typed('a', keyReturn, 'b', keyReturn, 'c'), []string{"a<Enter>", "b<Enter>", "c"}},
+		{"only modifiers", held(keyShiftL), nil},
+	}
+
+	for _, tt := range tests {
+		var lines []string
+		tr := &Transcriber{OnLine: func(l Line) { lines = append(lines, l.Text) }}
+		for _, k := range tt.keys {
+			tr.Key(time.Now(), k.keysym, k.down)
+		}
+		tr.Flush()
+		if !reflect.DeepEqual(lines, tt.lines) {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.lines, lines)
+		}
+	}
+}
+
+func TestTranscriber_LineTime(t *testing.T) {
+	var lines []Line
+	tr := &Transcriber{OnLine: func(l Line) { lines = append(lines, l) }}
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i, keysym := range []uint32{'a', 'b', keyReturn, 'c'} {
+		tr.Key(start.Add(time.Duration(i)*time.Second), keysym, true)
+	}
+	tr.Flush()
+	if len(lines) != 2 || !lines[0].Time.Equal(start) || !lines[1].Time.Equal(start.Add(3*time.Second)) {
+		t.Fatalf("unexpected lines %+v", lines)
+	}
+	if got := lines[0].String(); got != "2024-05-01T10:00:00.000Z ab<Enter>" {
+		t.Fatalf("unexpected line %q", got)
+	}
+}
+
+func TestTranscriber_Consume(t *testing.T) {
+	var lines []string
+	tr := &Transcriber{OnLine: func(l Line) { lines = append(lines, l.Text) }}
+	segments := []*common.RfbSegment{
+		{SegmentType: common.SegmentFullyParsedClientMessage, Message: &server.MsgKeyEvent{Down: 1, Key: 'h'}},
+		{SegmentType: common.SegmentFullyParsedClientMessage, Message: &server.MsgClientQemuExtendedKey{IsDown: 1, KeySym: 'i'}},
+		{SegmentType: common.SegmentFullyParsedClientMessage, Message: &server.MsgPointerEvent{Mask: 1}},
+		{SegmentType: common.SegmentConnectionClosed},
+	}
+	for _, seg := range segments {
+		if err := tr.Consume(seg); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if !reflect.DeepEqual(lines, []string{"hi"}) {
+		t.Fatalf("expected the line to be flushed when the connection closes, got %q", lines)
+	}
+}
+
+func TestTranscriber_OnLineOutsideLock(t *testing.T) {
+	var lines []string
+	tr := &Transcriber{}
+	// OnLine can use the Transcriber, which is not locked while it runs
+	tr.OnLine = func(l Line) {
+		lines = append(lines, l.Text)
+		tr.Flush()
+	}
+	for _, keysym := range []uint32{'a', keyReturn, 'b'} {
+		tr.Key(time.Now(), keysym, true)
+	}
+	tr.Flush()
+	if !reflect.DeepEqual(lines, []string{"a<Enter>", "b"}) {
+		t.Fatalf("unexpected lines %q", lines)
+	}
+}